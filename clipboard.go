@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// clipboardTypes are the types of clipboard contents that can be interpolated as they are, most wanted first,
+// with the extensions they're saved with. PNGs are usually still images, so they're only taken
+// when there's no link to the original either.
+var clipboardTypes = []struct{ mime, ext string }{
+	{"image/gif", ".gif"},
+	{"image/apng", ".png"},
+	{"image/webp", ".webp"},
+	{"video/webm", ".webm"},
+	{"video/mp4", ".mp4"},
+}
+
+// imageSourcePattern matches the address of an image copied from a web page, as browsers put it in the clipboard's HTML.
+var imageSourcePattern = regexp.MustCompile(`(?i)<img[^>]*\ssrc\s*=\s*["']([^"']+)["']`)
+
+func clipboardSystem() (string, error) {
+	// Works out how to reach the clipboard: "darwin" with osascript, "windows" with PowerShell,
+	// or on other systems, "wayland" with wl-clipboard, or "x11" with xclip.
+
+	switch runtime.GOOS {
+	case "darwin":
+		return "darwin", nil
+	case "windows":
+		return "windows", nil
+	}
+	if _, err := exec.LookPath("wl-paste"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+		return "wayland", nil
+	}
+	if _, err := exec.LookPath("xclip"); err == nil && os.Getenv("DISPLAY") != "" {
+		return "x11", nil
+	}
+	return "", errors.New("No clipboard was found. Install wl-clipboard on Wayland, or xclip on X11.")
+}
+
+func readClipboard(ctx context.Context, dir string) (string, error) {
+	// Finds an input in the clipboard, returning the path of a copied file, the URL of a copied image or link,
+	// or the path of an animation in the clipboard itself, once it's saved into `dir` as "clipboard" with its extension.
+
+	system, err := clipboardSystem()
+	if err != nil {
+		return "", err
+	}
+	switch system {
+	case "darwin":
+		return readMacClipboard(ctx, dir)
+	case "windows":
+		return readWindowsClipboard(ctx, dir)
+	}
+
+	// wl-paste and xclip both list what's in the clipboard by type, and print any one of them
+	paste := func(mime string) ([]byte, error) {
+		if system == "wayland" {
+			return exec.CommandContext(ctx, "wl-paste", "--no-newline", "--type", mime).Output()
+		}
+		return exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", mime, "-o").Output()
+	}
+	var listing []byte
+	if system == "wayland" {
+		listing, err = exec.CommandContext(ctx, "wl-paste", "--list-types").Output()
+	} else {
+		listing, err = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", "TARGETS", "-o").Output()
+	}
+	if err != nil {
+		return "", fmt.Errorf("error listing clipboard contents:\n  %w", err)
+	}
+	types := make(map[string]bool)
+	for _, line := range strings.Fields(string(listing)) {
+		types[line] = true
+	}
+
+	for _, clipboardType := range clipboardTypes {
+		if types[clipboardType.mime] {
+			data, err := paste(clipboardType.mime)
+			if err != nil {
+				return "", fmt.Errorf("error reading clipboard:\n  %w", err)
+			}
+			return saveClipboard(data, dir, clipboardType.ext)
+		}
+	}
+	for _, textType := range []string{"text/uri-list", "text/html", "UTF8_STRING", "text/plain;charset=utf-8", "text/plain"} {
+		if !types[textType] {
+			continue
+		}
+		if text, err := paste(textType); err == nil {
+			if input := clipboardTextInput(string(text)); input != "" {
+				return input, nil
+			}
+		}
+	}
+	if types["image/png"] {
+		data, err := paste("image/png")
+		if err != nil {
+			return "", fmt.Errorf("error reading clipboard:\n  %w", err)
+		}
+		return saveClipboard(data, dir, ".png")
+	}
+	return "", errors.New("The clipboard doesn't hold an animation, a file, or a link to one.")
+}
+
+func readMacClipboard(ctx context.Context, dir string) (string, error) {
+	// Finds an input in the clipboard on macOS, asking AppleScript for a copied file, then GIF data,
+	// then a link in the clipboard's text, and last, PNG data.
+
+	if output, err := exec.CommandContext(ctx, "osascript", "-e", "POSIX path of (the clipboard as «class furl»)").Output(); err == nil {
+		if path := strings.TrimSpace(string(output)); path != "" {
+			return path, nil
+		}
+	}
+	if data, err := macClipboardData(ctx, "GIFf"); err == nil {
+		return saveClipboard(data, dir, ".gif")
+	}
+	if output, err := exec.CommandContext(ctx, "pbpaste").Output(); err == nil {
+		if input := clipboardTextInput(string(output)); input != "" {
+			return input, nil
+		}
+	}
+	if data, err := macClipboardData(ctx, "PNGf"); err == nil {
+		return saveClipboard(data, dir, ".png")
+	}
+	return "", errors.New("The clipboard doesn't hold an animation, a file, or a link to one.")
+}
+
+func macClipboardData(ctx context.Context, class string) ([]byte, error) {
+	// Reads the clipboard as the AppleScript data class `class`, which AppleScript prints as «data GIFf4749...».
+
+	output, err := exec.CommandContext(ctx, "osascript", "-e", "the clipboard as «class "+class+"»").Output()
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(output))
+	if !strings.HasPrefix(text, "«data "+class) || !strings.HasSuffix(text, "»") {
+		return nil, errors.New("unexpected clipboard data: " + text)
+	}
+	return hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(text, "«data "+class), "»"))
+}
+
+func readWindowsClipboard(ctx context.Context, dir string) (string, error) {
+	// Finds an input in the clipboard on Windows, asking PowerShell for a copied file, then a link
+	// in the clipboard's HTML or text, and last, a still image, which Windows keeps as a bitmap.
+
+	powershell := func(script string) (string, error) {
+		output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+		return strings.TrimSpace(string(output)), err
+	}
+	if output, err := powershell("Get-Clipboard -Format FileDropList | Select-Object -First 1 -ExpandProperty FullName"); err == nil && output != "" {
+		return output, nil
+	}
+	for _, script := range []string{"Get-Clipboard -Format Text -TextFormatType Html", "Get-Clipboard -Format Text"} {
+		if output, err := powershell(script); err == nil {
+			if input := clipboardTextInput(output); input != "" {
+				return input, nil
+			}
+		}
+	}
+	path := filepath.Join(dir, "clipboard.png")
+	script := "$image = Get-Clipboard -Format Image; if (-not $image) { exit 1 }; $image.Save('" +
+		strings.ReplaceAll(path, "'", "''") + "', [System.Drawing.Imaging.ImageFormat]::Png)"
+	if _, err := powershell(script); err == nil {
+		return path, nil
+	}
+	return "", errors.New("The clipboard doesn't hold an animation, a file, or a link to one.")
+}
+
+func clipboardTextInput(text string) string {
+	// Picks an input out of text copied to the clipboard: the source of an image copied from a web page,
+	// or a link or file path by itself, returning the link or path, or "" if there's none.
+
+	if match := imageSourcePattern.FindStringSubmatch(text); match != nil {
+		text = html.UnescapeString(match[1])
+	}
+	// URI lists may start with comments, and hold several, of which the first is taken
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if isInputURL(line) {
+			return line
+		}
+		if strings.HasPrefix(line, "file://") {
+			if parsed, err := url.Parse(line); err == nil {
+				line = filepath.FromSlash(parsed.Path)
+			}
+		}
+		if info, err := os.Stat(line); err == nil && info.Mode().IsRegular() {
+			return line
+		}
+		return ""
+	}
+	return ""
+}
+
+func saveClipboard(data []byte, dir, ext string) (string, error) {
+	// Saves animation `data` read from the clipboard into `dir`, returning its path.
+
+	if len(data) == 0 {
+		return "", errors.New("The clipboard's animation is empty.")
+	}
+	path := filepath.Join(dir, "clipboard"+ext)
+	return path, saveUpload(bytes.NewReader(data), path)
+}
+
+func copyToClipboard(ctx context.Context, path string) error {
+	// Puts the output at `path` in the clipboard, as the image itself on Wayland and X11, and for GIFs and PNGs on macOS,
+	// or otherwise as a copied file, which chat apps upload when it's pasted, so the file must stay where it is.
+
+	system, err := clipboardSystem()
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch system {
+	case "darwin":
+		script := "set the clipboard to POSIX file " + appleScriptString(path)
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".gif":
+			script = "set the clipboard to (read (POSIX file " + appleScriptString(path) + ") as «class GIFf»)"
+		case ".png":
+			script = "set the clipboard to (read (POSIX file " + appleScriptString(path) + ") as «class PNGf»)"
+		}
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	case "windows":
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Set-Clipboard -LiteralPath '"+strings.ReplaceAll(path, "'", "''")+"'")
+	case "wayland":
+		cmd = exec.CommandContext(ctx, "wl-copy", "--type", objectContentType(path))
+	case "x11":
+		cmd = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", objectContentType(path))
+	}
+	if system == "wayland" || system == "x11" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		cmd.Stdin = file
+	}
+	// wl-copy and xclip stay behind to hand out the clipboard, so their output isn't waited for, as it never ends
+	return cmd.Run()
+}
+
+func appleScriptString(s string) string {
+	// Quotes `s` as an AppleScript string.
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// envPrefix begins the names of environment variables that set flags, e.g. RIFEWT_JOBS for -jobs.
+const envPrefix = "RIFEWT_"
+
+func defaultConfigPath() string {
+	// Returns the path of the per-user config file, which may not exist, or an empty string if there is no config directory.
+	// On macOS, ~/.config/rifewt/config.toml is used instead if it exists, as it is for many command line tools there.
+
+	if runtime.GOOS == "darwin" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path := filepath.Join(home, ".config", "rifewt", "config.toml")
+			if _, err = os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "rifewt", "config.toml")
+}
+
+func applyDefaults(flags *flag.FlagSet, args []string) error {
+	// Overrides the built-in defaults of `flags` with values from a config file and then the environment,
+	// so that flags given in `args` take precedence over both once they are parsed.
+
+	configPath, explicit := findConfigFlag(args)
+	if !explicit {
+		configPath, explicit = os.LookupEnv(envPrefix + "CONFIG")
+	}
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+	if configPath != "" {
+		// The main command's flags are those of flag.CommandLine, named after the executable
+		section := flags.Name()
+		if flags == flag.CommandLine {
+			section = "interpolate"
+		}
+		err := applyConfigFile(flags, configPath, section)
+		if err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			// Already handled above
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %s", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+func findConfigFlag(args []string) (string, bool) {
+	// Looks for a -config flag in `args` ahead of parsing, since it determines the defaults of the other flags.
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// Only positional arguments follow
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if hasValue {
+			return value, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func applyConfigFile(flags *flag.FlagSet, path, section string) error {
+	// Sets flags from the config file at `path` for the subcommand `section`.
+	// The file uses a simple subset of TOML: each line is a `key = value` pair naming a flag without its leading dash,
+	// where values are quoted strings, numbers, or booleans, and # starts a comment. Pairs before any table apply
+	// to every subcommand, while those in a table, such as [serve], apply only to the subcommand it names.
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	table := ""
+	for n, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return fmt.Errorf("%s:%d: expected [subcommand]", path, n+1)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if table != "" && table != section {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, n+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid string for %s", path, n+1, key)
+			}
+		} else if strings.HasPrefix(value, "'") {
+			// TOML literal strings have no escapes
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return fmt.Errorf("%s:%d: invalid string for %s", path, n+1, key)
+			}
+			value = value[1 : len(value)-1]
+		}
+
+		if key == "config" || flags.Lookup(key) == nil {
+			return fmt.Errorf("%s:%d: unknown option %s", path, n+1, key)
+		}
+		if err = flags.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %s", path, n+1, key, err)
+		}
+	}
+	return nil
+}
+
+func stripComment(line string) string {
+	// Removes a trailing # comment from `line`, ignoring any # inside a quoted string, as in a matte colour.
+
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				// Skip the escaped character, which can't end the string
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
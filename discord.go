@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// discordAPI is the base URL of the Discord API.
+const discordAPI = "https://discord.com/api/v10"
+
+// Discord's interaction and interaction response types, as far as the bot uses them.
+const (
+	interactionPing         = 1
+	interactionCommand      = 2
+	interactionPong         = 1
+	interactionDeferMessage = 5
+)
+
+// discordMessageLimit is the most characters a Discord message may hold.
+const discordMessageLimit = 2000
+
+// discordCommands defines the bot's commands: /interpolate, taking an attachment, and Interpolate,
+// in the Apps menu of any message, taking its first attachment.
+const discordCommands = `[
+  {"name": "interpolate", "type": 1, "description": "Smooth out an animated emote, sticker, or GIF", "options": [
+    {"type": 11, "name": "file", "description": "GIF, APNG, or WebP to interpolate", "required": true},
+    {"type": 4, "name": "factor", "description": "Output frames for each source frame", "min_value": 2, "max_value": 16},
+    {"type": 3, "name": "preset", "description": "Fit the output to be used as an emoji or sticker", "choices": [
+      {"name": "emoji", "value": "discord-emoji"},
+      {"name": "sticker", "value": "discord-sticker"}
+    ]}
+  ]},
+  {"name": "Interpolate", "type": 3}
+]`
+
+// discordInteraction is what Discord sends the bot when a command is used, as far as the bot reads it.
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	ApplicationID string `json:"application_id"`
+	Data          struct {
+		Name     string `json:"name"`
+		TargetID string `json:"target_id"`
+		Options  []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]discordAttachment `json:"attachments"`
+			Messages    map[string]struct {
+				Attachments []discordAttachment `json:"attachments"`
+			} `json:"messages"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+// discordAttachment is a file attached to a message or command.
+type discordAttachment struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	Size     int64  `json:"size"`
+}
+
+// discordBot answers the commands Discord sends it over HTTP, interpolating their attachments a few at a time.
+type discordBot struct {
+	ctx       context.Context
+	publicKey ed25519.PublicKey
+	base      rifewt.Options
+	run       runSettings
+	maxUpload int64
+	slots     chan struct{}
+	client    *http.Client
+	logger    *log.Logger
+	wg        sync.WaitGroup
+}
+
+func runDiscord(args []string) {
+	// Runs a Discord bot that interpolates the animations its commands are used on, until interrupted.
+
+	flags := flag.NewFlagSet("discord", flag.ExitOnError)
+	finishFlags := interpolationFlags(flags)
+	listen := flags.String("listen", ":8081", "`address` to listen on for interactions, which Discord must reach over HTTPS, such as through a reverse proxy")
+	publicKey := flags.String("public-key", "", "the application's public `key`, in hex, from the Discord developer portal")
+	appID := flags.String("app-id", "", "the application's `ID`, for -register")
+	token := flags.String("token", "", "the bot's `token`, for -register")
+	register := flags.Bool("register", false, "register the bot's commands with Discord, then exit")
+	maxUpload := flags.String("max-upload", "10MB", "largest `size` of file to accept, and to reply with, as Discord allows the bot to upload")
+	concurrent := flags.Int("concurrent", 1, "number of files to interpolate at once")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s discord [flags]\ninterpolation flags set the defaults for every command\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	errorLogger := log.New(os.Stderr, "", 0)
+	if err := applyDefaults(flags, args); err != nil {
+		errorLogger.Fatal("error reading default options:\n  ", err)
+	}
+	if args = parseArgs(flags, args); len(args) != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	client := &http.Client{Timeout: 2 * time.Minute}
+	if *register {
+		if *appID == "" || *token == "" {
+			errorLogger.Fatal("-register needs -app-id and -token")
+		}
+		if err := registerDiscordCommands(ctx, client, *appID, *token); err != nil {
+			errorLogger.Fatal("error registering commands:\n  ", err)
+		}
+		fmt.Println("registered /interpolate, and Interpolate in the Apps menu of messages")
+		return
+	}
+
+	opts, run := finishFlags()
+	if opts.Poster != "" || opts.Delays != nil || run.dryRun {
+		errorLogger.Fatal("-poster, -delays, and -dry-run can't be used with discord")
+	}
+	key, err := hex.DecodeString(*publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		errorLogger.Fatal("-public-key must be the application's public key, in hex")
+	}
+	uploadLimit, err := parseByteSize(*maxUpload)
+	if err != nil || uploadLimit <= 0 {
+		errorLogger.Fatal("invalid maximum upload size: " + *maxUpload)
+	}
+	if *concurrent < 1 {
+		errorLogger.Fatal("number of concurrent files must be at least 1")
+	}
+
+	bot := &discordBot{
+		ctx:       ctx,
+		publicKey: key,
+		base:      opts,
+		run:       run,
+		maxUpload: uploadLimit,
+		slots:     make(chan struct{}, *concurrent),
+		client:    client,
+		logger:    errorLogger,
+	}
+	httpServer := &http.Server{Addr: *listen, Handler: bot, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+
+	errorLogger.Printf("listening for interactions on %s", *listen)
+	err = httpServer.ListenAndServe()
+	stop()
+	bot.wg.Wait()
+	if !errors.Is(err, http.ErrServerClosed) {
+		errorLogger.Fatal("error serving:\n  ", err)
+	}
+	errorLogger.Print("interrupted")
+	os.Exit(exitInterrupted)
+}
+
+func registerDiscordCommands(ctx context.Context, client *http.Client, appID, token string) error {
+	// Replaces the global commands of the application `appID` with discordCommands, authorized by the bot's `token`.
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, discordAPI+"/applications/"+appID+"/commands", strings.NewReader(discordCommands))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return discordRequest(client, req)
+}
+
+func discordRequest(client *http.Client, req *http.Request) error {
+	// Sends `req` to Discord, returning its error message if it fails.
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("Discord replied %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (b *discordBot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Answers interactions from Discord, having checked they're signed with the application's key, as Discord requires.
+	// Commands are acknowledged straight away, as Discord only waits 3 seconds, and answered once their file's interpolated.
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Interactions are sent with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "error reading interaction", http.StatusBadRequest)
+		return
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	message := append([]byte(r.Header.Get("X-Signature-Timestamp")), body...)
+	if err != nil || !ed25519.Verify(b.publicKey, message, signature) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction discordInteraction
+	if err = json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "error reading interaction", http.StatusBadRequest)
+		return
+	}
+	switch interaction.Type {
+	case interactionPing:
+		writeJSON(w, http.StatusOK, map[string]int{"type": interactionPong})
+	case interactionCommand:
+		writeJSON(w, http.StatusOK, map[string]int{"type": interactionDeferMessage})
+		b.wg.Add(1)
+		go b.answer(interaction)
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+	}
+}
+
+func (b *discordBot) answer(interaction discordInteraction) {
+	// Interpolates the file the command `interaction` was used on, and replies with the output,
+	// or what went wrong, in place of the acknowledgement.
+
+	defer b.wg.Done()
+	output, err := b.interpolate(interaction)
+	if b.ctx.Err() != nil {
+		err = errors.New("The bot was stopped before it could finish.")
+	}
+
+	// The interaction's token lasts longer than the bot will wait, so the reply goes out even when it's stopping
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err != nil {
+		b.logger.Printf("%s : %s", interaction.Data.Name, err)
+		err = b.reply(ctx, interaction, truncateMessage("Couldn't interpolate that: "+err.Error(), discordMessageLimit), "")
+	} else {
+		defer os.RemoveAll(filepath.Dir(output))
+		err = b.reply(ctx, interaction, "", output)
+	}
+	if err != nil {
+		b.logger.Print("error replying to command:\n  ", err)
+	}
+}
+
+func (b *discordBot) interpolate(interaction discordInteraction) (string, error) {
+	// Downloads the file the command `interaction` was used on into a temporary directory, and interpolates it there
+	// with the options the command gives, returning the output's path.
+
+	var attachment discordAttachment
+	opts := b.base
+	if interaction.Data.TargetID != "" {
+		attachments := interaction.Data.Resolved.Messages[interaction.Data.TargetID].Attachments
+		if len(attachments) == 0 {
+			return "", errors.New("That message has no attachment.")
+		}
+		attachment = attachments[0]
+	}
+	for _, option := range interaction.Data.Options {
+		var value string
+		if err := json.Unmarshal(option.Value, &value); err != nil {
+			value = string(option.Value)
+		}
+		switch option.Name {
+		case "file":
+			attachment = interaction.Data.Resolved.Attachments[value]
+		case "factor":
+			factor, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || factor < 2 {
+				return "", errors.New("invalid interpolation factor: " + value)
+			}
+			opts.Factor = factor
+		case "preset":
+			opts.Preset = value
+		}
+	}
+	if attachment.URL == "" {
+		return "", errors.New("There's no file to interpolate.")
+	}
+	if attachment.Size > b.maxUpload {
+		return "", fmt.Errorf("%s is larger than the %d bytes the bot accepts.", attachment.Filename, b.maxUpload)
+	}
+
+	// Outputs must be small enough for the bot to upload, and presets have their own, smaller limits
+	if opts.Preset == "" && (opts.MaxSize == 0 || opts.MaxSize > b.maxUpload) {
+		opts.MaxSize = b.maxUpload
+	}
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+	case <-b.ctx.Done():
+		return "", b.ctx.Err()
+	}
+	defer func() { <-b.slots }()
+
+	dir, err := os.MkdirTemp(opts.TempDir, "rifewt-discord-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	name := filepath.Base(attachment.Filename)
+	opts.Source = filepath.Join(dir, "input"+strings.ToLower(filepath.Ext(name)))
+	opts.Dest = filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))+"-Interpolated"+filepath.Ext(defaultOutputPath(name, opts, "")))
+	opts.TempDir = dir
+	if err = downloadFile(b.ctx, b.client, attachment.URL, opts.Source, b.maxUpload); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("error downloading %s:\n  %w", name, err)
+	}
+
+	ctx := b.ctx
+	if b.run.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.run.timeout)
+		defer cancel()
+	}
+	res, err := rifewt.Interpolate(ctx, opts)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("Timed out after %s.", b.run.timeout)
+		}
+		return "", err
+	}
+	b.logger.Printf("%s : %d frames -> %d frames", name, res.SourceFrames, res.OutputFrames)
+	return res.Dest, nil
+}
+
+func (b *discordBot) reply(ctx context.Context, interaction discordInteraction, message, file string) error {
+	// Replaces the acknowledgement of `interaction` with `message`, attaching `file` if it isn't empty.
+
+	payload := map[string]any{"content": message}
+	if file != "" {
+		payload["attachments"] = []map[string]any{{"id": 0, "filename": filepath.Base(file)}}
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	payloadJSON, err := json.Marshal(payload)
+	if err == nil {
+		err = form.WriteField("payload_json", string(payloadJSON))
+	}
+	if err == nil && file != "" {
+		err = attachFile(form, "files[0]", file)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	url := discordAPI + "/webhooks/" + interaction.ApplicationID + "/" + interaction.Token + "/messages/@original"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return discordRequest(b.client, req)
+}
+
+func attachFile(form *multipart.Writer, field, path string) error {
+	// Adds the file at `path` to `form` as the form field `field`.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	part, err := form.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, file)
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// lowDiskSpace is the free space in the temporary directory below which doctor warns,
+// as every frame is written out several times over as PNGs.
+const lowDiskSpace = 2 << 30
+
+// remedies suggests how to install each dependency reported by rifewt.Dependencies.
+var remedies = map[string]string{
+	"rife-ncnn-vulkan": "run " + filepath.Base(os.Args[0]) + " -install-deps, or download a release from https://github.com/nihui/rife-ncnn-vulkan/releases",
+	"ImageMagick":      "install ImageMagick, e.g. apt install imagemagick, brew install imagemagick, or winget install ImageMagick.ImageMagick",
+	"img2webp":         "install libwebp's tools, e.g. apt install webp or brew install webp",
+	"ffmpeg":           "install FFmpeg, e.g. apt install ffmpeg, brew install ffmpeg, or winget install Gyan.FFmpeg",
+	"ffprobe":          "install FFmpeg, which includes ffprobe, e.g. apt install ffmpeg, brew install ffmpeg, or winget install Gyan.FFmpeg",
+	"gifsicle":         "install gifsicle, version 1.92 or later for -lossy, e.g. apt install gifsicle or brew install gifsicle",
+	"APNG optimizer":   "install apngopt from https://sourceforge.net/projects/apng/files/, or oxipng, e.g. apt install oxipng or brew install oxipng",
+	"Upscaler":         "download a release of realesrgan-ncnn-vulkan from https://github.com/xinntao/Real-ESRGAN-ncnn-vulkan/releases, or of waifu2x-ncnn-vulkan from https://github.com/nihui/waifu2x-ncnn-vulkan/releases",
+}
+
+func runDoctor(ctx context.Context, out io.Writer) bool {
+	// Checks the dependencies, Vulkan devices, and temporary directory, printing what was found to `out`
+	// along with how to fix any problems. Returns false if anything would stop interpolation from working.
+
+	healthy := true
+
+	_, _ = fmt.Fprintln(out, "Dependencies:")
+	var rife string
+	for _, d := range rifewt.Dependencies(ctx) {
+		if d.Path == "" {
+			status := "missing "
+			if d.Required {
+				status = "MISSING "
+				healthy = false
+			}
+			_, _ = fmt.Fprintf(out, "  %s %s, needed for %s\n", status, d.Name, d.Purpose)
+			_, _ = fmt.Fprintf(out, "           To fix, %s,\n           or place it in %s\n", remedies[d.Name], dependenciesDir())
+			continue
+		}
+
+		version := d.Version
+		if version == "" {
+			version = "unknown version"
+		}
+		if d.Minimum != "" {
+			// Older versions may still do for some runs, so only the required ones count as a problem
+			status := "old     "
+			if d.Required {
+				status = "OLD     "
+				healthy = false
+			}
+			_, _ = fmt.Fprintf(out, "  %s %s (%s) at %s, older than %s\n", status, d.Name, version, d.Path, d.Minimum)
+			_, _ = fmt.Fprintf(out, "           To fix, %s\n", remedies[d.Name])
+		} else {
+			_, _ = fmt.Fprintf(out, "  ok       %s (%s) at %s\n", d.Name, version, d.Path)
+		}
+		if d.Name == "rife-ncnn-vulkan" {
+			rife = d.Path
+		}
+	}
+	if rife != "" {
+		if models := rifewt.InstalledModels(rife); len(models) > 0 {
+			_, _ = fmt.Fprintf(out, "           Models: %s\n", strings.Join(models, ", "))
+		} else {
+			_, _ = fmt.Fprintln(out, "  MISSING  RIFE models beside rife-ncnn-vulkan")
+			_, _ = fmt.Fprintln(out, "           To fix, extract the whole rife-ncnn-vulkan release, including its rife-v4.6 directory, next to the executable")
+			healthy = false
+		}
+	}
+
+	_, _ = fmt.Fprintln(out, "Vulkan devices:")
+	if !checkVulkan(ctx, out) {
+		healthy = false
+	}
+
+	_, _ = fmt.Fprintln(out, "Temporary directory:")
+	if !checkTempDir(out) {
+		healthy = false
+	}
+
+	if healthy {
+		_, _ = fmt.Fprintln(out, "Everything needed to interpolate was found.")
+	} else {
+		_, _ = fmt.Fprintln(out, "Some problems above will stop interpolation from working.")
+	}
+	return healthy
+}
+
+func checkVulkan(ctx context.Context, out io.Writer) bool {
+	// Lists the Vulkan devices reported by vulkaninfo to `out`, returning false if there are none at all.
+	// Without vulkaninfo, devices can't be listed, which isn't counted as a problem.
+
+	vulkaninfo, err := exec.LookPath("vulkaninfo")
+	if err != nil {
+		_, _ = fmt.Fprintln(out, "  unknown  vulkaninfo isn't installed, so Vulkan devices can't be listed")
+		_, _ = fmt.Fprintln(out, "           To check, install the Vulkan tools, e.g. apt install vulkan-tools, or the Vulkan SDK")
+		return true
+	}
+	output, err := exec.CommandContext(ctx, vulkaninfo, "--summary").Output()
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "  MISSING  vulkaninfo failed: %s\n", err)
+		_, _ = fmt.Fprintln(out, "           To fix, install or update your GPU's drivers, which provide Vulkan")
+		return false
+	}
+
+	// Each device's summary lists its name after its type
+	var names, types []string
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "deviceType":
+			types = append(types, strings.TrimPrefix(strings.TrimSpace(value), "PHYSICAL_DEVICE_TYPE_"))
+		case "deviceName":
+			names = append(names, strings.TrimSpace(value))
+		}
+	}
+	if len(names) == 0 {
+		_, _ = fmt.Fprintln(out, "  MISSING  no Vulkan devices found")
+		_, _ = fmt.Fprintln(out, "           To fix, install or update your GPU's drivers, which provide Vulkan")
+		return false
+	}
+
+	gpu := false
+	for i, name := range names {
+		deviceType := "unknown type"
+		if i < len(types) {
+			deviceType = strings.ToLower(strings.ReplaceAll(types[i], "_", " "))
+		}
+		gpu = gpu || (i < len(types) && types[i] != "CPU")
+		_, _ = fmt.Fprintf(out, "  ok       -gpu %d: %s (%s)\n", i, name, deviceType)
+	}
+	if !gpu {
+		_, _ = fmt.Fprintln(out, "  warning  only software Vulkan devices were found, so rife will run slowly on the CPU")
+		_, _ = fmt.Fprintln(out, "           To fix, install your GPU's Vulkan drivers")
+	}
+	return true
+}
+
+func checkTempDir(out io.Writer) bool {
+	// Checks that files can be written to the temporary directory, and reports how much space is free there to `out`.
+
+	dir := os.TempDir()
+	probe, err := os.MkdirTemp(dir, "rife-doctor-*")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(probe, "probe.png"), []byte("probe"), 0600)
+		_ = os.RemoveAll(probe)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "  MISSING  %s isn't writable: %s\n", dir, err)
+		tempVariable := "TMPDIR"
+		if runtime.GOOS == "windows" {
+			tempVariable = "TMP"
+		}
+		_, _ = fmt.Fprintf(out, "           To fix, set %s to a writable directory\n", tempVariable)
+		return false
+	}
+
+	free, err := rifewt.FreeSpace(dir)
+	switch {
+	case err != nil:
+		_, _ = fmt.Fprintf(out, "  ok       %s is writable, with unknown free space\n", dir)
+	case free < lowDiskSpace:
+		_, _ = fmt.Fprintf(out, "  warning  %s is writable, but only %.1f GiB is free\n", dir, float64(free)/(1<<30))
+		_, _ = fmt.Fprintln(out, "           Long or large animations may run out of space; free some up, or point TMPDIR at a bigger disk")
+	default:
+		_, _ = fmt.Fprintf(out, "  ok       %s is writable, with %.1f GiB free\n", dir, float64(free)/(1<<30))
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// downloadTimeout is how long downloading an input may take, from connecting to reading its last byte.
+const downloadTimeout = 10 * time.Minute
+
+// inputClient downloads inputs named on the command line, from anywhere the user running it can reach.
+var inputClient = &http.Client{Timeout: downloadTimeout}
+
+// publicClient downloads inputs named by remote clients, as for serve's -allow-url-sources, from public addresses only,
+// so they can't reach the server itself or the network it's on, such as cloud metadata endpoints or admin ports.
+// It ignores proxies, which would hide where requests are really going.
+var publicClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, Control: refusePrivateAddress}).DialContext
+	return &http.Client{Timeout: downloadTimeout, Transport: transport}
+}()
+
+// contentTypeExtensions maps the content types of downloaded inputs to the extensions they're saved with,
+// for URLs that don't end in one.
+var contentTypeExtensions = map[string]string{
+	"image/gif":        ".gif",
+	"image/png":        ".png",
+	"image/apng":       ".png",
+	"image/webp":       ".webp",
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/x-msvideo":  ".avi",
+	"video/avi":        ".avi",
+}
+
+func downloadFile(ctx context.Context, client *http.Client, url, path string, limit int64) error {
+	// Downloads `url` into a new file at `path`, failing if it's larger than `limit` bytes.
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("The server replied %s.", res.Status)
+	}
+	return saveDownload(res, path, limit)
+}
+
+func saveDownload(res *http.Response, path string, limit int64) error {
+	// Saves the body of the response `res` into a new file at `path`, failing if it's larger than `limit` bytes,
+	// unless `limit` is 0.
+
+	if limit == 0 {
+		return saveUpload(res.Body, path)
+	}
+	if res.ContentLength > limit {
+		return fmt.Errorf("It's %d bytes, more than the limit of %d.", res.ContentLength, limit)
+	}
+
+	// The length isn't always given, so the download is cut off just past the limit to tell if it's too large
+	if err := saveUpload(io.LimitReader(res.Body, limit+1), path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > limit {
+		return fmt.Errorf("It's more than the limit of %d bytes.", limit)
+	}
+	return nil
+}
+
+func isInputURL(s string) bool {
+	// Reports whether `s` is an http:// or https:// URL to download an input from.
+
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func inputURLName(rawURL string) string {
+	// Names the input downloaded from `rawURL` after the last element of its path, as a local file would be named,
+	// for naming its output.
+
+	name := "download"
+	if parsed, err := url.Parse(rawURL); err == nil {
+		if base := path.Base(parsed.Path); base != "." && base != "/" {
+			name = base
+		}
+	}
+	// Names are only ever used within a directory, so they can't say where
+	return strings.NewReplacer("\\", "_", ":", "_").Replace(name)
+}
+
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	// Refuses connections to `address` unless it's a public one: not loopback, private, link-local, multicast,
+	// or unspecified. As it's checked as each connection is made, after names are resolved, redirects are checked too.
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%s isn't a public address, so it can't be downloaded from.", host)
+	}
+	return nil
+}
+
+func downloadInput(ctx context.Context, client *http.Client, rawURL, path string, limit int64) (string, error) {
+	// Downloads the input at `rawURL` with `client` into a new file at `path`, failing if it's larger than `limit` bytes,
+	// or isn't an image or video, and returns its path, with the extension of its content type added if it has none.
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("The server replied %s.", res.Status)
+	}
+
+	// Servers that don't know what they're serving say so, or say nothing, while pages such as errors and logins are refused
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	switch {
+	case contentType == "", contentType == "application/octet-stream", contentType == "binary/octet-stream":
+	case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "video/"):
+	default:
+		return "", fmt.Errorf("It's %s, not an image or video.", contentType)
+	}
+
+	if filepath.Ext(path) == "" {
+		path += contentTypeExtensions[contentType]
+	}
+	return path, saveDownload(res, path, limit)
+}
+
+func readStdin(dir string) (string, error) {
+	// Saves the input read from stdin into `dir`, named "input" with the extension of the format it turns out to be,
+	// and returns its path.
+
+	stdin := bufio.NewReader(os.Stdin)
+	head, err := stdin.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if len(head) == 0 {
+		return "", errors.New("Nothing was read from stdin.")
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	path := filepath.Join(dir, "input"+contentTypeExtensions[contentType])
+	return path, saveUpload(stdin, path)
+}
+
+func writeStdout(path string) error {
+	// Copies the file at `path` to stdout.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRefusePrivateAddress(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:80":         true,
+		"[2606:2800:220:1::1]:443": true,
+		"127.0.0.1:8080":           false,
+		"[::1]:80":                 false,
+		"10.0.0.5:80":              false,
+		"172.16.3.4:80":            false,
+		"192.168.1.1:80":           false,
+		"169.254.169.254:80":       false,
+		"[fe80::1]:80":             false,
+		"[fd00::1]:80":             false,
+		"0.0.0.0:80":               false,
+		"[::ffff:127.0.0.1]:80":    false,
+		"224.0.0.1:80":             false,
+	} {
+		if err := refusePrivateAddress("tcp", address, nil); (err == nil) != allowed {
+			t.Errorf("%s: got error %v, want allowed %v", address, err, allowed)
+		}
+	}
+}
+
+func TestPublicClientRefusesLoopback(t *testing.T) {
+	// A server on this machine stands in for anything on the server's own network.
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_, _ = w.Write([]byte("GIF89a"))
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "input.gif")
+
+	_, err := downloadInput(context.Background(), publicClient, server.URL+"/in.gif", path, 1000)
+	if err == nil || !strings.Contains(err.Error(), "isn't a public address") {
+		t.Errorf("got error %v, want the loopback address refused", err)
+	}
+	if _, err = downloadInput(context.Background(), inputClient, server.URL+"/in.gif", path, 1000); err != nil {
+		t.Errorf("inputClient couldn't download from the command line's own machine: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// rifeRelease is the rife-ncnn-vulkan release downloaded by -install-deps, the one the default -rife-compat suits.
+const rifeRelease = "20221029"
+
+// rifePlatforms maps GOOS/GOARCH pairs to the platform suffix of the rife-ncnn-vulkan release built for them.
+var rifePlatforms = map[string]string{
+	"linux/amd64":   "ubuntu",
+	"windows/amd64": "windows",
+	"darwin/amd64":  "macos",
+	"darwin/arm64":  "macos",
+}
+
+// versionsFile lists what -install-deps installed into the Dependencies directory, one "name version digest" line each.
+const versionsFile = "versions.txt"
+
+// githubRelease holds the parts of a GitHub release used to find and check its downloads.
+type githubRelease struct {
+	Assets []struct {
+		Name        string `json:"name"`
+		DownloadURL string `json:"browser_download_url"`
+		// Digest is e.g. "sha256:<hex>", or empty for assets GitHub hasn't computed one for.
+		Digest string `json:"digest"`
+	} `json:"assets"`
+}
+
+func dependenciesDir() string {
+	// Returns the Dependencies directory beside the executable, which dependencies are searched for in after the PATH.
+
+	return filepath.Join(filepath.Dir(os.Args[0]), "Dependencies")
+}
+
+func installDependencies(ctx context.Context, out io.Writer) error {
+	// Downloads the rife-ncnn-vulkan release for this system into the Dependencies directory, checks its digest,
+	// and records its version there, reporting progress to `out`.
+
+	platform, ok := rifePlatforms[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("rife-ncnn-vulkan has no release for %s/%s; build it from source instead", runtime.GOOS, runtime.GOARCH)
+	}
+
+	dir := dependenciesDir()
+	if installed, _ := readInstalledVersions(dir); installed["rife-ncnn-vulkan"] == rifeRelease {
+		_, _ = fmt.Fprintf(out, "rife-ncnn-vulkan %s is already installed in %s\n", rifeRelease, dir)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating dependencies directory:\n  %s", err)
+	}
+
+	// Find the download for this platform in the release's metadata
+	var release githubRelease
+	if err := getJSON(ctx, "https://api.github.com/repos/nihui/rife-ncnn-vulkan/releases/tags/"+rifeRelease, &release); err != nil {
+		return fmt.Errorf("error reading rife-ncnn-vulkan release:\n  %s", err)
+	}
+	suffix := "-" + platform + ".zip"
+	var url, digest string
+	for _, asset := range release.Assets {
+		if strings.HasSuffix(asset.Name, suffix) {
+			url, digest = asset.DownloadURL, asset.Digest
+			break
+		}
+	}
+	if url == "" {
+		return fmt.Errorf("error reading rife-ncnn-vulkan release:\n  No download ending in %s found.", suffix)
+	}
+
+	_, _ = fmt.Fprintf(out, "Downloading %s\n", url)
+	archive, err := os.CreateTemp(dir, "download-*.zip")
+	if err != nil {
+		return fmt.Errorf("error downloading rife-ncnn-vulkan:\n  %s", err)
+	}
+	defer func(path string) { _ = os.Remove(path) }(archive.Name())
+	sum, err := download(ctx, url, archive)
+	_ = archive.Close()
+	if err != nil {
+		return fmt.Errorf("error downloading rife-ncnn-vulkan:\n  %s", err)
+	}
+
+	actual := "sha256:" + hex.EncodeToString(sum)
+	switch {
+	case digest == "":
+		_, _ = fmt.Fprintf(out, "warning: GitHub lists no digest for this download, so it can't be verified; its digest is %s\n", actual)
+	case !strings.EqualFold(digest, actual):
+		return fmt.Errorf("error verifying rife-ncnn-vulkan download:\n  Expected %s, but the download is %s.", digest, actual)
+	}
+
+	// The archive holds a single directory, whose contents are extracted straight into the Dependencies directory,
+	// so that the models sit beside the executable where rife looks for them
+	if err = extractZip(archive.Name(), dir); err != nil {
+		return fmt.Errorf("error extracting rife-ncnn-vulkan:\n  %s", err)
+	}
+
+	if err = recordInstalledVersion(dir, "rife-ncnn-vulkan", rifeRelease, actual); err != nil {
+		return fmt.Errorf("error recording installed version:\n  %s", err)
+	}
+
+	_, _ = fmt.Fprintf(out, "Installed rife-ncnn-vulkan %s in %s\n", rifeRelease, dir)
+	_, _ = fmt.Fprintln(out, "ImageMagick (or FFmpeg), and img2webp or FFmpeg for WebP or WebM output, are best installed with your system's package manager.")
+	return nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	// Fetches `url` and decodes its JSON body into `v`.
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) { _ = body.Close() }(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func download(ctx context.Context, url string, w io.Writer) ([]byte, error) {
+	// Downloads `url` into `w`, returning the SHA-256 digest of what was downloaded.
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func(body io.ReadCloser) { _ = body.Close() }(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(w, hash), response.Body); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func extractZip(path, dest string) error {
+	// Extracts the zip archive at path `path` into `dest`, dropping the first directory of each entry's path.
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer func(archive *zip.ReadCloser) { _ = archive.Close() }(archive)
+
+	for _, entry := range archive.File {
+		_, name, found := strings.Cut(entry.Name, "/")
+		if !found || name == "" {
+			continue
+		}
+		// Refuse entries that would land outside `dest`
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		if relative, err := filepath.Rel(dest, target); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside the archive's directory", entry.Name)
+		}
+
+		if entry.FileInfo().IsDir() {
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// Archives made on Windows carry no permissions, so make the programs executable regardless
+		mode := entry.Mode().Perm() | 0644
+		if base := strings.TrimSuffix(filepath.Base(target), ".exe"); base == "rife-ncnn-vulkan" {
+			mode |= 0111
+		}
+		if err = extractZipEntry(entry, target, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipEntry(entry *zip.File, target string, mode os.FileMode) error {
+	reader, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer func(reader io.ReadCloser) { _ = reader.Close() }(reader)
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, reader); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func readInstalledVersions(dir string) (map[string]string, error) {
+	// Reads the versions of the dependencies recorded in `dir` by -install-deps, by name.
+
+	file, err := os.Open(filepath.Join(dir, versionsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	versions := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions, scanner.Err()
+}
+
+func recordInstalledVersion(dir, name, version, digest string) error {
+	// Records `version` of the dependency `name`, downloaded with `digest`, in `dir`'s versions file,
+	// replacing any earlier record of it.
+
+	var lines []string
+	existing, err := os.ReadFile(filepath.Join(dir, versionsFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] != name {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, strings.Join([]string{name, version, digest}, " "))
+	return os.WriteFile(filepath.Join(dir, versionsFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
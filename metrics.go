@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// Bucket bounds of the histograms exported, in seconds and bytes.
+var (
+	durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	sizeBuckets     = []float64{16e3, 64e3, 256e3, 1e6, 4e6, 16e6, 64e6}
+)
+
+// histogram counts observations into buckets, as a Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	// counts holds the observations in each bucket, not cumulatively, with the last for those beyond every bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(value float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	// Writes the histogram's samples for `name`, adding `labels`, such as `stage="merge",`, to each.
+
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64), name, labels, h.count)
+}
+
+// metrics counts what a server or watcher has interpolated, to export to Prometheus at /metrics.
+// Its counting methods do nothing if it's nil, so that callers needn't check whether metrics are being kept.
+type metrics struct {
+	mutex sync.Mutex
+
+	queued, running int
+	// jobs counts finished jobs by status, and failures counts failed ones by the stage that failed
+	jobs     map[string]uint64
+	failures map[string]uint64
+	// wait is how long jobs waited for a slot to run in, which the GPU is shared between
+	wait        *histogram
+	stages      map[string]*histogram
+	outputBytes *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		jobs:        make(map[string]uint64),
+		failures:    make(map[string]uint64),
+		wait:        newHistogram(durationBuckets),
+		stages:      make(map[string]*histogram),
+		outputBytes: newHistogram(sizeBuckets),
+	}
+}
+
+func (m *metrics) enqueue() {
+	// Counts a job joining the queue.
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queued++
+}
+
+func (m *metrics) dequeue() {
+	// Counts a queued job being cancelled before it ran.
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queued--
+	m.jobs[jobCancelled]++
+}
+
+func (m *metrics) start(wait time.Duration) {
+	// Counts a queued job starting to run, having waited `wait` for a slot.
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queued--
+	m.running++
+	m.wait.observe(wait.Seconds())
+}
+
+func (m *metrics) finish(status string, res rifewt.Result, err error) {
+	// Counts a running job finishing with `status`, with the result `res` if it's done, or the failure `err`.
+
+	if m == nil {
+		return
+	}
+	var outputBytes int64 = -1
+	if status == jobDone {
+		if info, statErr := os.Stat(res.Dest); statErr == nil {
+			outputBytes = info.Size()
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.running--
+	m.jobs[status]++
+	switch status {
+	case jobDone:
+		for _, timing := range res.Timings {
+			if m.stages[timing.Stage] == nil {
+				m.stages[timing.Stage] = newHistogram(durationBuckets)
+			}
+			m.stages[timing.Stage].observe(timing.Duration.Seconds())
+		}
+		if outputBytes >= 0 {
+			m.outputBytes.observe(float64(outputBytes))
+		}
+	case jobFailed:
+		// Failures before the pipeline started, such as invalid options, aren't any stage's
+		stage := "none"
+		var stageErr *rifewt.Error
+		if errors.As(err, &stageErr) {
+			stage = stageErr.Stage
+		}
+		m.failures[stage]++
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Writes every metric in Prometheus's text format.
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	_, _ = fmt.Fprintf(w, "# HELP rifewt_jobs_queued Jobs waiting to run.\n# TYPE rifewt_jobs_queued gauge\nrifewt_jobs_queued %d\n", m.queued)
+	_, _ = fmt.Fprintf(w, "# HELP rifewt_jobs_running Jobs running.\n# TYPE rifewt_jobs_running gauge\nrifewt_jobs_running %d\n", m.running)
+	writeCounters(w, "rifewt_jobs_total", "Jobs finished, by status.", "status", m.jobs)
+	writeCounters(w, "rifewt_failures_total", "Jobs failed, by the stage of the pipeline that failed.", "stage", m.failures)
+
+	_, _ = fmt.Fprint(w, "# HELP rifewt_wait_seconds Time jobs waited for a slot to run in, sharing the GPU.\n# TYPE rifewt_wait_seconds histogram\n")
+	m.wait.write(w, "rifewt_wait_seconds", "")
+	_, _ = fmt.Fprint(w, "# HELP rifewt_stage_duration_seconds Time each stage of the pipeline took, in jobs that were done.\n# TYPE rifewt_stage_duration_seconds histogram\n")
+	for _, stage := range sortedKeys(m.stages) {
+		m.stages[stage].write(w, "rifewt_stage_duration_seconds", fmt.Sprintf("stage=%q,", stage))
+	}
+	_, _ = fmt.Fprint(w, "# HELP rifewt_output_bytes Size of each output.\n# TYPE rifewt_output_bytes histogram\n")
+	m.outputBytes.write(w, "rifewt_output_bytes", "")
+}
+
+func writeCounters(w io.Writer, name, help, label string, counts map[string]uint64) {
+	// Writes the counter `name`, with a sample for each of `counts`, labelled by `label`.
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, value := range sortedKeys(counts) {
+		_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, value, counts[value])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	// Returns the keys of `m` in order, so metrics are always written in the same order.
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notifyTimeout is how long a -notify-url endpoint has to answer each notification.
+const notifyTimeout = 10 * time.Second
+
+// notification is what's posted to -notify-url when an input is finished with.
+type notification struct {
+	// ID names the job, from serve only
+	ID     string `json:"id,omitempty"`
+	Input  string `json:"input"`
+	Status string `json:"status"`
+	// Output is the output's path, or from serve, where to download it, once the input is done
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Elapsed is how long the input took to interpolate, in seconds
+	Elapsed float64       `json:"elapsed"`
+	Result  *resultReport `json:"result,omitempty"`
+}
+
+func notify(ctx context.Context, url string, n notification) error {
+	// Posts `n` to `url` as JSON, failing if it doesn't reply with success.
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		reply, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if message := strings.TrimSpace(string(reply)); message != "" {
+			return fmt.Errorf("The server replied %s: %s", res.Status, message)
+		}
+		return fmt.Errorf("The server replied %s.", res.Status)
+	}
+	return nil
+}
@@ -1,311 +1,1052 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"image"
 	"log"
+	"math"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"RifeWithTransparency/rifewt"
 )
 
+// exitInterrupted is the exit status after being stopped by a signal, following the shell convention for SIGINT.
+const exitInterrupted = 130
+
+// failureStatuses maps the causes of failed runs to the exit status reported for them, so scripts can tell them apart.
+// Other failures exit with status 1, and invalid arguments with 2.
+var failureStatuses = []struct {
+	err    error
+	status int
+}{
+	{rifewt.ErrDependencyMissing, 3},
+	{rifewt.ErrOutputExists, 9},
+	{rifewt.ErrInsufficientSpace, 8},
+	{rifewt.ErrExtraction, 4},
+	{rifewt.ErrInterpolation, 5},
+	{rifewt.ErrMerge, 6},
+	{rifewt.ErrAssembly, 7},
+}
+
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if run, ok := subcommands[args[0]]; ok {
+			run(args[1:])
+			return
+		}
+		// Interpolating is the default, but may be asked for by name too
+		if args[0] == "interpolate" {
+			args = args[1:]
+		}
+	}
+	runInterpolate(args)
+}
+
+func runInterpolate(args []string) {
+	// Interpolates the inputs named in `args`, along with any flags.
+
 	errorLogger := log.New(os.Stderr, "", 0)
 
-	nArgs := len(os.Args)
-	if nArgs < 2 || nArgs > 4 || strings.ToLower(os.Args[1]) == "-h" || strings.ToLower(os.Args[1]) == "--help" {
-		errorLogger.Fatal("usage: " + os.Args[0] + " input.gif [output.png|output.gif] [#matte]")
+	finishFlags := interpolationFlags(flag.CommandLine)
+	output := flag.String("output", "", "output `path`, as an alternative to the second positional argument")
+	format := flag.String("format", "", "`format` to write to stdout in, given - as the output path: gif, apng, webp, or webm (default gif, or the preset's)")
+	batch := flag.Bool("batch", false, "treat every positional argument as an input file or glob, each saved under its default output name")
+	fromClipboard := flag.Bool("from-clipboard", false, "take the input from the clipboard: a copied animation, file, or image from a web page, leaving the positional arguments as [output] [#matte]")
+	toClipboard := flag.Bool("to-clipboard", false, "copy the output to the clipboard once it's done, to paste into a chat, keeping the file it's copied from")
+	installDeps := flag.Bool("install-deps", false, "download rife-ncnn-vulkan for this system into the Dependencies directory beside the executable, then exit")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "usage: "+os.Args[0]+" [interpolate] [flags] input.gif [output.png|output.gif] [#matte]\n       "+os.Args[0]+" [interpolate] -from-clipboard [flags] [output.png|output.gif] [#matte]\n       "+os.Args[0]+" [interpolate] -batch [flags] input.gif...\n       "+
+			os.Args[0]+" extract|assemble|convert|info|watch|serve|discord|telegram [flags] ...\n       "+os.Args[0]+" doctor\nflags may be given before or after the positional arguments; run a subcommand with -h for its own")
+		flag.PrintDefaults()
 	}
-
-	source, err := filepath.Abs(os.Args[1])
-	if err != nil {
-		errorLogger.Fatal("error recognizing input path:\n  ", err)
+	if err := applyDefaults(flag.CommandLine, args); err != nil {
+		errorLogger.Fatal("error reading default options:\n  ", err)
 	}
-	if _, err = os.Stat(source); err != nil {
-		errorLogger.Fatal("error opening input file:\n  ", err)
+	args = parseArgs(flag.CommandLine, args)
+	if *installDeps {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := installDependencies(ctx, os.Stdout)
+		stop()
+		if err != nil {
+			errorLogger.Fatal(err)
+		}
+		return
+	}
+	nArgs := len(args)
+	if *fromClipboard {
+		// The input is the clipboard's, so only the output and matte may be given
+		nArgs++
+	}
+	if nArgs < 1 || (nArgs > 3 && !*batch) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *batch && (*fromClipboard || *toClipboard) {
+		errorLogger.Fatal("-from-clipboard and -to-clipboard can't be used with -batch, as the clipboard holds a single file")
 	}
 
-	var dest string
-	if nArgs >= 3 {
-		dest, err = filepath.Abs(os.Args[2])
+	opts, run := finishFlags()
+
+	// The first SIGINT or SIGTERM stops any running programs and cleans up before exiting,
+	// while a second one exits immediately, as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *batch {
+		if *output != "" {
+			errorLogger.Fatal("-output can't be used with -batch; each input is saved under its default output name")
+		}
+		if opts.Poster != "" || opts.Delays != nil {
+			errorLogger.Fatal("-poster and -delays can't be used with -batch, as they apply to a single input")
+		}
+
+		inputs, err := expandInputs(args)
 		if err != nil {
-			errorLogger.Fatal("error recognizing output path:\n  ", err)
+			errorLogger.Fatal("error finding input files:\n  ", err)
 		}
-	} else {
-		dest = strings.TrimSuffix(source, filepath.Ext(source)) + "-2x-Interpolated.gif"
-	}
 
-	var background string
-	if nArgs == 4 {
-		background = os.Args[3]
-	} else {
-		background = "#36393F"
+		// Inputs are processed concurrently up to the job limit, and still share its limit on external programs
+		failures := 0
+		var failuresMutex sync.Mutex
+		var wg sync.WaitGroup
+		inputSlots := make(chan struct{}, run.jobs)
+		for _, input := range inputs {
+			inputSlots <- struct{}{}
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(input string) {
+				defer wg.Done()
+				defer func() { <-inputSlots }()
+				if err := interpolateFile(ctx, input, "", opts, run); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					errorLogger.Printf("%s : %s", input, err)
+					failuresMutex.Lock()
+					failures++
+					failuresMutex.Unlock()
+				}
+			}(input)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			errorLogger.Print("interrupted")
+			os.Exit(exitInterrupted)
+		}
+		if failures > 0 {
+			errorLogger.Fatalf("%d of %d inputs failed", failures, len(inputs))
+		}
+		return
 	}
 
-	frameCount, err := interpolate(source, dest, background)
+	// Animations in the clipboard itself are saved into a directory of their own, and named as if they'd been saved
+	// in the current directory, while copied files and links are read as they would be from the command line.
+	// Deferred calls don't run on exiting, so the directory is removed explicitly.
+	var clipboardDir string
+	fatal := func(v ...any) {
+		if clipboardDir != "" {
+			_ = os.RemoveAll(clipboardDir)
+		}
+		errorLogger.Fatal(v...)
+	}
+	if *fromClipboard {
+		var err error
+		if clipboardDir, err = os.MkdirTemp(opts.TempDir, "rifewt-clipboard-"); err != nil {
+			fatal("error creating clipboard directory:\n  ", err)
+		}
+		input, err := readClipboard(ctx, clipboardDir)
+		if err != nil {
+			fatal("error reading clipboard:\n  ", err)
+		}
+		args = append([]string{input}, args...)
+		if filepath.Dir(input) == clipboardDir && *output == "" && nArgs < 2 {
+			if run.template != "" {
+				fatal("-output-template can't name an output for an animation in the clipboard, which has no name; give an output path instead")
+			}
+			named, err := filepath.Abs("clipboard" + filepath.Ext(input))
+			if err != nil {
+				fatal("error recognizing output path:\n  ", err)
+			}
+			*output = defaultOutputPath(named, opts, run.suffix)
+		}
+	}
+	if nArgs >= 2 {
+		*output = args[1]
+	}
+	if nArgs == 3 {
+		opts.Background = args[2]
+	}
+	if *toClipboard {
+		if _, ok := parseObjectURL(*output); ok || *output == "-" {
+			fatal("-to-clipboard needs the output to be saved as a local file, to copy it from")
+		}
+		run.toClipboard = true
+	}
+	if *output == "-" {
+		// Anything else printed to stdout would end up in the output
+		if run.json || run.progress == "json" {
+			fatal("-json and -progress json can't be used when writing the output to stdout")
+		}
+		if len(opts.Sizes) > 0 {
+			fatal("-sizes can't be used when writing the output to stdout, which only has room for one")
+		}
+		if _, ok := outputFormats[*format]; *format != "" && !ok {
+			fatal("unrecognized output format: " + *format)
+		}
+		if *format != "" && opts.Preset != "" {
+			fatal("-format can't be used with -preset, which decides it")
+		}
+		run.stdoutFormat = *format
+	} else if *format != "" {
+		fatal("-format only applies when writing the output to stdout, with - as the output path")
+	}
+	err := interpolateFile(ctx, args[0], *output, opts, run)
+	if clipboardDir != "" {
+		_ = os.RemoveAll(clipboardDir)
+	}
 	if err != nil {
-		errorLogger.Fatal(err)
+		if ctx.Err() != nil {
+			errorLogger.Print("interrupted")
+			os.Exit(exitInterrupted)
+		}
+		errorLogger.Print(err)
+		os.Exit(failureStatus(err))
 	}
-
-	fmt.Printf("%s : %d frames -> %d frames\n", os.Args[1], frameCount, frameCount*2+1)
 }
 
-func findProgram(names ...string) (string, error) {
-	var lastErr error
+func interpolationFlags(flags *flag.FlagSet) func() (rifewt.Options, runSettings) {
+	// Adds the flags setting interpolation options to `flags`, returning a function to call once `flags` is parsed,
+	// which checks them, exiting if any are invalid, and returns the options and settings they give.
 
-	for _, name := range names {
-		// Try searching the PATH
-		program, err := exec.LookPath(name)
-		if err == nil {
-			return program, nil
+	var opts rifewt.Options
+	var run runSettings
+	flags.Uint64Var(&opts.Factor, "x", 2, "interpolation `factor`: the number of output frames for each source frame")
+	flags.Float64Var(&opts.FPS, "fps", 0, "resample the output to this constant frame `rate`, choosing a factor to suit unless -x is given")
+	flags.StringVar(&opts.Img2webpArgs, "img2webp-args", "auto", "how img2webp is given the frames for WebP output: inline on its command line, in an argument file, or auto, inline unless there are over 250 frames")
+	flags.StringVar(&opts.Poster, "poster", "", "also export a still `image` of a single output frame")
+	flags.Uint64Var(&opts.PosterFrame, "poster-frame", 0, "output frame number to use for -poster, counting from 1 (default the middle frame)")
+	flags.Float64Var(&opts.DefaultFPS, "default-fps", 10, "output frame rate to use when the source has no frame delays")
+	flags.BoolVar(&opts.NoAlpha, "no-alpha", false, "flatten the source against the matte colour and produce fully opaque output")
+	flags.Uint64Var(&opts.LoopCrossfade, "loop-crossfade", 0, "number of frames blending the last frame into the first to insert at the loop seam")
+	flags.Float64Var(&opts.Fuzz, "fuzz", 0, "make pixels within this `percent`age of the matte colour transparent when reapplying alpha")
+	flags.Float64Var(&opts.Decontaminate, "decontaminate", 0, "`strength` (0-1) with which to remove the matte colour blended into semi-transparent edges when reapplying alpha")
+	flags.StringVar(&opts.MergeMode, "merge-mode", "alpha", "how interpolated alpha is applied: alpha keeps transparency, matte blends over the matte colour, dual recovers it from frames over black and white")
+	flags.BoolVar(&opts.Optimize, "optimize", false, "shrink GIF output with gifsicle -O3, and APNG output with apngopt, oxipng, or zopflipng")
+	flags.UintVar(&opts.Lossy, "lossy", 0, "gifsicle lossy compression `level` for -optimize, such as 80 (default lossless)")
+	flags.StringVar(&opts.Preset, "preset", "", "fit the output to a site's requirements: discord-emoji, discord-sticker, telegram-sticker, slack-emoji, or twitch-emote")
+	flags.StringVar(&opts.Flatten, "flatten", "", "composite the output over this `colour or image` for places without transparency support")
+	flags.BoolVar(&opts.VerifyAlpha, "verify-alpha", false, "check that the original frames' alpha is unchanged in the output")
+	alphaThreshold := flags.Uint("alpha-threshold", 128, "least alpha, from 1 to 255, a pixel needs to stay visible in GIF output")
+	verifyAlphaTolerance := flags.Uint("verify-alpha-tolerance", 0, "largest alpha difference, out of 255, allowed by -verify-alpha")
+	flags.BoolVar(&opts.Once, "once", false, "produce a clip that plays once, without interpolating back to the first frame")
+	flags.StringVar(&opts.Model, "model", "", "RIFE `model` to use: the name of one installed beside rife, such as rife-v4.15, or a model directory")
+	flags.StringVar(&opts.RIFECompat, "rife-compat", "v4.6", "family of rife build to invoke arguments for: v4.6 or generic")
+	flags.StringVar(&opts.Backend, "backend", "auto", "image tool for sources not decoded in Go and for frame edits: magick, ffmpeg, or auto")
+	flags.DurationVar(&opts.Duration, "duration", 0, "stretch or squeeze the output to last exactly this `duration` (e.g. 2.5s)")
+	flags.Float64Var(&opts.Speed, "speed", 0, "playback speed `multiplier`, e.g. 0.5 for half-speed slow motion or 2 for double speed, with more frames interpolated when slowing down unless -x is set")
+	flags.BoolVar(&opts.Reverse, "reverse", false, "play the output backwards, for a rewind of the animation")
+	flags.DurationVar(&opts.SlowWarn, "slow-warn", 0, "warn when a stage of the pipeline takes longer than this `duration` (0 to never warn)")
+	flags.BoolVar(&opts.Dedupe, "dedupe", false, "collapse runs of identical frames into single longer frames before interpolating")
+	flags.Float64Var(&opts.SceneThreshold, "scene-threshold", 0, "treat consecutive frames differing by more than this `fraction` (0-1) as a cut, holding instead of interpolating (0 to disable)")
+	gpus := flags.String("gpu", "", "comma-separated `list` of GPUs for rife to use, e.g. 0,1, or -1 for the CPU; with several, colour and alpha run on separate GPUs (default rife's choice)")
+	flags.StringVar(&opts.TTA, "tta", "auto", "rife's test-time augmentation, slower but higher quality: none, spatial, temporal, both, or auto for -rife-compat's choice")
+	flags.BoolVar(&opts.UHD, "uhd", false, "enable rife's UHD mode, for frames larger than about 1080p")
+	flags.StringVar(&opts.RIFEThreads, "rife-threads", "", "rife's load:proc:save thread `counts`, e.g. 1:2:2, with a proc count per -gpu if several; lower proc counts use less VRAM (default rife's own)")
+	key := flags.String("key", "", "`colour[,tolerance]` to key out as transparency, such as #00FF00,10 for a green screen, with tolerance a percentage (default 10)")
+	crop := flags.String("crop", "", "region of the source to keep, as `WxH+X+Y`, before anything's interpolated")
+	flags.Float64Var(&opts.Scale, "scale", 0, "`factor` to scale the source's frames by before interpolating, such as 2 or 0.5")
+	resize := flags.String("resize", "", "`WxH` to resize the source's frames to before interpolating, leaving W or H empty to keep the aspect ratio, as in 320x")
+	upscale := flags.String("upscale", "", "`factor`, 2x or 4x, to upscale frames by with realesrgan-ncnn-vulkan or waifu2x-ncnn-vulkan before interpolating")
+	flags.BoolVar(&opts.UpscaleAfter, "upscale-after", false, "upscale the interpolated frames instead, keeping rife's work small but upscaling every frame")
+	maxSize := flags.String("max-size", "", "largest output `size` to allow, such as 256KB or 8MB, reducing colours, frames, or scale until it fits")
+	maxDownload := flags.String("max-download", "100MB", "largest `size` of input to download from an http:// or https:// URL")
+	sizes := flags.String("sizes", "", "comma-separated `list` of pixel sizes to also save downscaled copies of the output at")
+	delayManifest := flags.String("delays", "", "`file` listing a delay for each source frame, overriding the source's own timing")
+	flags.IntVar(&run.jobs, "jobs", runtime.NumCPU(), "maximum number of external programs to run at once")
+	flags.DurationVar(&run.timeout, "per-file-timeout", 0, "abandon an input if processing it takes longer than this `duration` (0 for no limit)")
+	flags.StringVar(&opts.TempDir, "tmpdir", "", "`directory` to write temporary frames in, such as a fast SSD or RAM disk (default TMPDIR, or the system's)")
+	flags.BoolVar(&opts.Force, "force", false, "replace output files that already exist, and go ahead even if the temporary directory looks too small for the frames")
+	flags.BoolVar(&opts.KeepTemp, "keep-temp", false, "keep the temporary directory of extracted, interpolated, and merged frames, and print its path")
+	flags.BoolVar(&run.dryRun, "dry-run", false, "print the commands each input would run, with the frame counts and timing worked out, without running rife or writing any frames")
+	verbose := flags.Bool("verbose", false, "print every external program run, and everything it prints, to stderr")
+	flags.StringVar(&run.progress, "progress", "text", "how to report progress through each stage: text (on stderr), json (lines on stdout), or none")
+	flags.BoolVar(&run.json, "json", false, "print each input's result, or failure, as a JSON object on its own line of stdout instead of the text summary")
+	flags.StringVar(&run.template, "output-template", "", "`template` naming each output in place of the default name, e.g. out/{name}-{factor}x-{fps}fps.{ext}, from {name}, {dir}, {ext}, {factor}, and {fps}")
+	flags.StringVar(&run.suffix, "suffix", "-Interpolated", "`text` ending default output names, before the extension, e.g. in-2x-Interpolated.gif")
+	flags.StringVar(&run.notifyURL, "notify-url", "", "`URL` to POST a JSON notification to as each input is done or fails, with its output path or error")
+	flags.StringVar(&opts.Background, "matte", "#36393F", "matte `colour` for transparent pixels, or auto to match the edges of transparent areas; overridden by a third positional argument")
+	flags.String("config", defaultConfigPath(), "read default option values from this `file`")
+	// Other programs, such as the optimizers and upscalers, can still be set by their environment variables
+	programPaths := make(map[string]*string)
+	for _, program := range []string{"rife", "magick", "ffmpeg", "ffprobe", "img2webp", "gifsicle"} {
+		programPaths[program] = flags.String(program+"-path", "", "`program` to run as "+program+", ahead of RIFEWT_"+strings.ToUpper(program)+" and the PATH")
+	}
+
+	return func() (rifewt.Options, runSettings) {
+		errorLogger := log.New(os.Stderr, "", 0)
+
+		if opts.Factor < 2 {
+			errorLogger.Fatal("interpolation factor must be at least 2")
+		}
+		if (opts.FPS > 0 || opts.Speed > 0 || opts.Duration > 0) && !isFlagSet(flags, "x") {
+			// Choose the factor once the source's timing is known
+			opts.Factor = 0
 		}
-		lastErr = err
 
-		// Try searching a dependencies directory
-		here := filepath.Dir(os.Args[0])
-		program, err = exec.LookPath(filepath.Join(here, "Dependencies", name))
-		if err == nil {
-			return program, nil
+		if opts.DefaultFPS <= 0 {
+			errorLogger.Fatal("default frame rate must be positive")
+		}
+
+		if run.jobs < 1 {
+			errorLogger.Fatal("job limit must be at least 1")
+		}
+		rifewt.SetProcessLimit(run.jobs)
+		for program, path := range programPaths {
+			rifewt.SetProgramPath(program, *path)
 		}
-	}
 
-	return "", lastErr
+		if *verifyAlphaTolerance > 255 {
+			errorLogger.Fatal("alpha verification tolerance must be at most 255")
+		}
+		opts.VerifyAlphaTolerance = uint8(*verifyAlphaTolerance)
+		if *alphaThreshold < 1 || *alphaThreshold > 255 {
+			errorLogger.Fatal("alpha threshold must be between 1 and 255")
+		}
+		opts.AlphaThreshold = uint8(*alphaThreshold)
+
+		// The library validates everything else, but treats zero values as unset, which on the command line are mistakes
+		if *gpus != "" {
+			for _, gpu := range strings.Split(*gpus, ",") {
+				parsed, err := strconv.Atoi(strings.TrimSpace(gpu))
+				if err != nil {
+					errorLogger.Fatal("invalid GPU: " + gpu)
+				}
+				opts.GPUs = append(opts.GPUs, parsed)
+			}
+		}
+		if *upscale != "" {
+			parsed, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(*upscale), "x"), 10, 64)
+			if err != nil || parsed == 0 {
+				errorLogger.Fatal("invalid upscale factor: " + *upscale)
+			}
+			opts.Upscale = parsed
+		}
+		if err := opts.Validate(); err != nil {
+			errorLogger.Fatal(err)
+		}
+		opts.Overwrite = opts.Force
+		opts.Warnings = log.New(os.Stderr, "warning: ", 0)
+		if *verbose {
+			opts.Verbose = log.New(os.Stderr, "", 0)
+		}
+		if run.progress != "text" && run.progress != "json" && run.progress != "none" {
+			errorLogger.Fatal("unrecognized progress format: " + run.progress)
+		}
+		if err := checkTemplate(run.template); err != nil {
+			errorLogger.Fatal("invalid output template: ", err)
+		}
+		if run.notifyURL != "" {
+			if parsed, err := url.Parse(run.notifyURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				errorLogger.Fatal("invalid notification URL: " + run.notifyURL)
+			}
+		}
+
+		if *key != "" {
+			// Named colours such as rgb(0,255,0) contain commas too, so only a number after the last one is a tolerance
+			opts.Key = *key
+			if i := strings.LastIndex(*key, ","); i >= 0 {
+				if tolerance, err := strconv.ParseFloat(strings.TrimSpace((*key)[i+1:]), 64); err == nil {
+					opts.Key, opts.KeyTolerance = (*key)[:i], tolerance
+				}
+			}
+		}
+
+		if *crop != "" {
+			parsed, err := parseCrop(*crop)
+			if err != nil {
+				errorLogger.Fatal("invalid crop: " + *crop)
+			}
+			opts.Crop = parsed
+		}
+		if *resize != "" {
+			parsed, err := parseDimensions(*resize)
+			if err != nil || parsed == (image.Point{}) {
+				errorLogger.Fatal("invalid size to resize to: " + *resize)
+			}
+			opts.Resize = parsed
+		}
+
+		if *maxSize != "" {
+			parsed, err := parseByteSize(*maxSize)
+			if err != nil || parsed <= 0 {
+				errorLogger.Fatal("invalid maximum output size: " + *maxSize)
+			}
+			opts.MaxSize = parsed
+		}
+		if parsed, err := parseByteSize(*maxDownload); err != nil || parsed <= 0 {
+			errorLogger.Fatal("invalid maximum download size: " + *maxDownload)
+		} else {
+			run.maxDownload = parsed
+		}
+
+		if *sizes != "" {
+			for _, size := range strings.Split(*sizes, ",") {
+				parsed, err := strconv.ParseUint(strings.TrimSpace(size), 10, 64)
+				if err != nil || parsed == 0 {
+					errorLogger.Fatal("invalid output size: " + size)
+				}
+				opts.Sizes = append(opts.Sizes, parsed)
+			}
+		}
+
+		if *delayManifest != "" {
+			delays, err := rifewt.ReadDelays(*delayManifest)
+			if err != nil {
+				errorLogger.Fatal("error reading delay manifest:\n  ", err)
+			}
+			opts.Delays = delays
+		}
+
+		if opts.Poster != "" {
+			poster, err := filepath.Abs(opts.Poster)
+			if err != nil {
+				errorLogger.Fatal("error recognizing poster path:\n  ", err)
+			}
+			opts.Poster = poster
+		}
+		return opts, run
+	}
 }
 
-func interpolate(source, dest, background string) (uint64, error) {
-	// Interpolates the file at path `source`, outputting at path `dest`, with an intermediate matting colour specified by `background`.
+// byteUnits maps the suffixes accepted by parseByteSize to their multiples of a byte, decimal for KB and MB as sites use them.
+var byteUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1000,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"M":   1000 * 1000,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"G":   1000 * 1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+}
 
-	isGif := strings.ToLower(filepath.Ext(dest)) == ".gif"
+func parseByteSize(size string) (int64, error) {
+	// Parses a size like 256KB, 1.5MB, or 300000, in bytes.
 
-	// Locate dependencies
-	magick, err := findProgram("magick")
-	if err != nil {
-		return 0, fmt.Errorf("error locating dependency:\n  %s", err)
+	size = strings.TrimSpace(size)
+	split := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if split < 0 {
+		split = len(size)
 	}
-	rife, err := findProgram("rife", "rife-ncnn-vulkan")
-	if err != nil {
-		return 0, fmt.Errorf("error locating dependency:\n  %s", err)
+	multiple, ok := byteUnits[strings.ToUpper(strings.TrimSpace(size[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("unrecognized unit in %s", size)
 	}
-	apngasm, err := findProgram("apngasm64", "apngasm")
+	value, err := strconv.ParseFloat(size[:split], 64)
 	if err != nil {
-		return 0, fmt.Errorf("error locating dependency:\n  %s", err)
-	}
-	apng2gif, err := findProgram("apng2gif", "apngasm")
-	if err != nil && isGif {
-		return 0, fmt.Errorf("error locating dependency:\n  %s", err)
+		return 0, err
 	}
+	return int64(value * multiple), nil
+}
 
-	// Set up temporary directory structure
+func parseDimensions(dimensions string) (image.Point, error) {
+	// Parses dimensions like 320x240, where either side may be left empty, as in 320x, to leave it zero.
 
-	dir, err := os.MkdirTemp("", "rife-interpolation-*")
-	if err != nil {
-		return 0, fmt.Errorf("error creating temporary directory:\n  %s", err)
+	width, height, ok := strings.Cut(strings.ToLower(strings.TrimSpace(dimensions)), "x")
+	if !ok {
+		return image.Point{}, fmt.Errorf("expected WxH, not %s", dimensions)
 	}
-	defer func(path string) { _ = os.RemoveAll(path) }(dir)
-
-	if err != nil {
-		return 0, fmt.Errorf("error opening temporary directory:\n  %s", err)
+	var size image.Point
+	for _, side := range []struct {
+		text  string
+		value *int
+	}{{width, &size.X}, {height, &size.Y}} {
+		if side.text == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(side.text)
+		if err != nil || parsed <= 0 {
+			return image.Point{}, fmt.Errorf("invalid side length %s", side.text)
+		}
+		*side.value = parsed
 	}
+	return size, nil
+}
 
-	frameDir := filepath.Join(dir, "Frames")
-	alphaDir := filepath.Join(dir, "Alpha")
-	interpolatedFrameDir := filepath.Join(dir, "IFrames")
-	interpolatedAlphaDir := filepath.Join(dir, "IAlpha")
-	mergedDir := filepath.Join(dir, "Merged")
+func parseCrop(crop string) (image.Rectangle, error) {
+	// Parses a region like 200x100+40+20, 200 by 100 pixels from (40, 20), or 200x100 from the top-left corner.
 
-	for _, childDir := range []string{frameDir, alphaDir, interpolatedFrameDir, interpolatedAlphaDir, mergedDir} {
-		err = os.Mkdir(childDir, 0600)
-		if err != nil {
-			return 0, fmt.Errorf("error creating temporary subdirectory:\n  %s", err)
+	dimensions, offset, _ := strings.Cut(crop, "+")
+	size, err := parseDimensions(dimensions)
+	if err != nil || size.X == 0 || size.Y == 0 {
+		return image.Rectangle{}, fmt.Errorf("expected WxH+X+Y, not %s", crop)
+	}
+	var origin image.Point
+	if offset != "" {
+		x, y, ok := strings.Cut(offset, "+")
+		if origin.X, err = strconv.Atoi(x); err != nil || !ok {
+			return image.Rectangle{}, fmt.Errorf("expected WxH+X+Y, not %s", crop)
+		}
+		if origin.Y, err = strconv.Atoi(y); err != nil || origin.X < 0 || origin.Y < 0 {
+			return image.Rectangle{}, fmt.Errorf("expected WxH+X+Y, not %s", crop)
 		}
 	}
+	return image.Rectangle{Min: origin, Max: origin.Add(size)}, nil
+}
 
-	// Get information about the source animation
+func failureStatus(err error) int {
+	// Chooses the exit status for the failed run that returned `err`.
 
-	output, err := exec.Command(magick, "identify", "-format", "%n %T ", source).Output()
-	if err != nil {
-		return 0, fmt.Errorf("error getting number of frames in source:\n  %s", err)
+	for _, failure := range failureStatuses {
+		if errors.Is(err, failure.err) {
+			return failure.status
+		}
 	}
+	return 1
+}
 
-	var frameCount uint64
-	var frameLength uint64
-	_, err = fmt.Sscan(string(output), &frameCount, &frameLength)
-	if err != nil {
-		return 0, fmt.Errorf("error reading number of frames in source:\n  %s", err)
+func expandInputs(args []string) ([]string, error) {
+	// Expands any glob patterns in `args`, for shells that don't, returning every input path in order without duplicates.
+
+	var inputs []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		matches := []string{arg}
+		// URLs aren't patterns, though their queries start with ?
+		if _, isObject := parseObjectURL(arg); strings.ContainsAny(arg, "*?[") && !isObject && !isInputURL(arg) {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %s", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				inputs = append(inputs, match)
+			}
+		}
 	}
+	return inputs, nil
+}
+
+func defaultOutputPath(source string, opts rifewt.Options, suffix string) string {
+	// Names the output for `source` after the preset, if there is one, or otherwise the interpolation factor,
+	// or the frame rate when the factor is chosen to suit it, or neither when it's chosen for -speed or -duration,
+	// followed by `suffix`.
 
-	if frameCount <= 1 {
-		return 0, fmt.Errorf("error reading source frames:\n  Found 1 or fewer frames in source; nothing to interpolate.")
+	if opts.Preset != "" {
+		return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(source, filepath.Ext(source)), opts.Preset, rifewt.PresetExtension(opts.Preset))
+	}
+	if opts.Factor == 0 && opts.FPS > 0 {
+		return fmt.Sprintf("%s-%gfps%s.gif", strings.TrimSuffix(source, filepath.Ext(source)), opts.FPS, suffix)
+	}
+	if opts.Factor == 0 {
+		return fmt.Sprintf("%s%s.gif", strings.TrimSuffix(source, filepath.Ext(source)), suffix)
 	}
+	return fmt.Sprintf("%s-%dx%s.gif", strings.TrimSuffix(source, filepath.Ext(source)), opts.Factor, suffix)
+}
 
-	inputPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(frameCount, 10))) // E.g. %02d.png
+// runSettings are the command line settings for interpolating each input that aren't interpolation options.
+type runSettings struct {
+	// timeout, if nonzero, is how long an input may take before it's abandoned.
+	timeout time.Duration
+	// progress is the format to report progress in, as for progressPrinter.
+	progress string
+	// dryRun prints the plan for each input instead of interpolating it.
+	dryRun bool
+	// json prints each input's result, or failure, as a JSON object instead of the text summary.
+	json bool
+	// suffix ends default output names, as for defaultOutputPath.
+	suffix string
+	// template, if set, names outputs in place of the default names, as for templateOutputPath.
+	template string
+	// jobs is the most external programs to run at once, and with -batch, the most inputs to process at once.
+	jobs int
+	// metrics, if set, counts each input interpolated, as watch does for -metrics.
+	metrics *metrics
+	// notifyURL, if set, is posted a notification as each input is finished with.
+	notifyURL string
+	// maxDownload is the largest input to download from a URL, in bytes.
+	maxDownload int64
+	// stdoutFormat is the format, as in outputFormats, to write the output in when it's written to stdout.
+	stdoutFormat string
+	// toClipboard copies the output to the clipboard once it's done.
+	toClipboard bool
+}
 
-	// Extract frames and frame alpha
+// templatePattern matches the placeholders in -output-template.
+var templatePattern = regexp.MustCompile(`\{([a-z]+)\}`)
 
-	errChannel := make(chan error)
+// templateFields are the names of the placeholders -output-template accepts.
+var templateFields = map[string]bool{"name": true, "dir": true, "ext": true, "factor": true, "fps": true}
 
-	go func(result chan error) {
-		localErr := exec.Command(magick, "convert", source, "-background", background, "-coalesce", "-alpha", "Background", "-alpha", "Off", "-strip", "-define", "png:color-type=2", filepath.Join(frameDir, inputPaddingSpecifier)).Run()
-		if localErr != nil {
-			result <- fmt.Errorf("error extracting frames from source:\n  %s", localErr)
-			return
-		}
-		result <- nil
-	}(errChannel)
+func checkTemplate(template string) error {
+	// Checks that every placeholder in the output name `template` is one templateOutputPath fills in.
 
-	go func(result chan error) {
-		localErr := exec.Command(magick, "convert", source, "-coalesce", "-alpha", "Extract", "-strip", "-define", "png:color-type=0", filepath.Join(alphaDir, inputPaddingSpecifier)).Run()
-		if localErr != nil {
-			result <- fmt.Errorf("error extracting alpha from source frames:\n  %s", localErr)
-			return
+	for _, match := range templatePattern.FindAllStringSubmatch(template, -1) {
+		if !templateFields[match[1]] {
+			return fmt.Errorf("unknown placeholder %s", match[0])
 		}
-		result <- nil
-	}(errChannel)
-
-	if err = coalesce(2, errChannel); err != nil {
-		return 0, err
 	}
+	if strings.ContainsAny(templatePattern.ReplaceAllString(template, ""), "{}") {
+		return errors.New("unmatched brace")
+	}
+	return nil
+}
 
-	// Copy the first frame to the end, for smoother looping
+func templateOutputPath(ctx context.Context, source string, opts rifewt.Options, template string) (string, error) {
+	// Names the output for `source` by `template`, filling in its name and directory, the default output extension,
+	// and the factor and frame rate the run will use, planning the run to find them if they're chosen automatically.
+
+	ext := ".gif"
+	if opts.Preset != "" {
+		ext = rifewt.PresetExtension(opts.Preset)
+	}
+	name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	values := map[string]string{
+		"name":   name,
+		"dir":    filepath.Dir(source),
+		"ext":    strings.TrimPrefix(ext, "."),
+		"factor": strconv.FormatUint(opts.Factor, 10),
+		"fps":    strconv.FormatFloat(opts.FPS, 'f', -1, 64),
+	}
 
-	for _, childDir := range []string{frameDir, alphaDir} {
-		firstFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, 0))
-		lastFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, frameCount))
-		err = os.Link(firstFrame, lastFrame)
+	// Without -fps, the frame rate is the output's average
+	if (opts.Factor == 0 && strings.Contains(template, "{factor}")) || (opts.FPS == 0 && strings.Contains(template, "{fps}")) {
+		opts.Dest, opts.Overwrite = filepath.Join(filepath.Dir(source), name+ext), true
+		plan, err := rifewt.PlanInterpolation(ctx, opts)
 		if err != nil {
-			// Maybe hardlinking just isn't supported
-			_, err = copyFile(firstFrame, lastFrame)
-			if err != nil {
-				return 0, fmt.Errorf("error duplicating first frame:\n  %s", err)
-			}
+			return "", err
+		}
+		var seconds float64
+		for _, d := range plan.Delays {
+			seconds += float64(d.Num) / float64(d.Den)
+		}
+		values["factor"] = strconv.FormatUint(plan.Factor, 10)
+		if opts.FPS == 0 && seconds > 0 {
+			values["fps"] = strconv.FormatFloat(math.Round(float64(plan.OutputFrames)/seconds*100)/100, 'f', -1, 64)
 		}
 	}
 
-	// Perform interpolation
+	return filepath.Abs(templatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[strings.Trim(placeholder, "{}")]
+	}))
+}
 
-	// Numbering from 1, and including the first half of the interpolated duplicate frame pair
-	finalFrameCount := frameCount*2 + 1
-	outputPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(finalFrameCount, 10)))
+// resultReport is what -json prints for each input that's interpolated.
+type resultReport struct {
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+	Bytes        int64  `json:"bytes"`
+	SourceFrames uint64 `json:"sourceFrames"`
+	OutputFrames uint64 `json:"outputFrames"`
+	// Duration is how long the output plays for, and Elapsed how long the run took, both in seconds
+	Duration        float64           `json:"duration"`
+	Elapsed         float64           `json:"elapsed"`
+	Matte           string            `json:"matte"`
+	Model           string            `json:"model"`
+	DuplicateFrames uint64            `json:"duplicateFrames"`
+	SceneCuts       uint64            `json:"sceneCuts"`
+	OpaqueSource    bool              `json:"opaqueSource"`
+	Stages          []stageReport     `json:"stages"`
+	Versions        map[string]string `json:"versions"`
+}
 
-	go func(result chan error) {
-		localErr := exec.Command(rife, "-m", "rife-v4.6", "-i", frameDir, "-o", interpolatedFrameDir, "-x", "-z", "-f", outputPaddingSpecifier).Run()
-		if localErr != nil {
-			result <- fmt.Errorf("error interpolating frames:\n  %s", localErr)
-			return
+func newResultReport(input string, res rifewt.Result, elapsed time.Duration) resultReport {
+	// Describes the result `res` of interpolating `input`, which took `elapsed`, for -json.
+
+	report := resultReport{
+		Input:           input,
+		Output:          res.Dest,
+		SourceFrames:    res.SourceFrames,
+		OutputFrames:    res.OutputFrames,
+		Duration:        res.Duration.Seconds(),
+		Elapsed:         elapsed.Seconds(),
+		Matte:           res.Matte,
+		Model:           res.Model,
+		DuplicateFrames: res.DuplicateFrames,
+		SceneCuts:       res.SceneCuts,
+		OpaqueSource:    res.OpaqueSource,
+		Versions:        res.Versions,
+	}
+	if info, err := os.Stat(res.Dest); err == nil {
+		report.Bytes = info.Size()
+	}
+	for _, timing := range res.Timings {
+		report.Stages = append(report.Stages, stageReport{timing.Stage, timing.Duration.Seconds()})
+	}
+	return report
+}
+
+// stageReport is how long a stage of the pipeline took, in seconds, in a resultReport.
+type stageReport struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+}
+
+func interpolateFile(ctx context.Context, input, output string, opts rifewt.Options, run runSettings) (err error) {
+	// Interpolates the file at path `input` into `output`, or its default output path if `output` is empty,
+	// as `run` says, and prints a summary when done, or with run.dryRun, prints the plan for the run instead.
+
+	start := time.Now()
+	if run.json {
+		// Failures are reported on stdout too, so scripts reading it hear about every input
+		defer func() {
+			if err != nil {
+				line, _ := json.Marshal(struct {
+					Input  string `json:"input"`
+					Error  string `json:"error"`
+					Status int    `json:"status"`
+				}{input, err.Error(), failureStatus(err)})
+				fmt.Println(string(line))
+			}
+		}()
+	}
+
+	// Inputs downloaded from URLs, and inputs and outputs in S3 or Cloud Storage, are kept in a staging directory
+	// of their own, removed once everything else is done
+	var staging string
+	var outputObject objectURL
+	var toStdout bool
+	defer func() {
+		if staging != "" {
+			_ = os.RemoveAll(staging)
 		}
-		result <- nil
-	}(errChannel)
+	}()
 
-	go func(result chan error) {
-		localErr := exec.Command(rife, "-m", "rife-v4.6", "-i", alphaDir, "-o", interpolatedAlphaDir, "-x", "-z", "-f", outputPaddingSpecifier).Run()
-		if localErr != nil {
-			result <- fmt.Errorf("error interpolating alpha:\n  %s", localErr)
+	// Inputs that fail before they're interpolated, such as missing ones, are counted and notified as failures too,
+	// while those interrupted aren't finished with
+	var res rifewt.Result
+	parentCtx := ctx
+	defer func() {
+		status := jobDone
+		if err != nil {
+			status = jobFailed
+		}
+		run.metrics.finish(status, res, err)
+		if run.notifyURL == "" || run.dryRun || parentCtx.Err() != nil {
 			return
 		}
-		result <- nil
-	}(errChannel)
+		n := notification{Input: input, Status: status, Elapsed: time.Since(start).Seconds()}
+		if err != nil {
+			n.Error = err.Error()
+		} else {
+			report := newResultReport(input, res, time.Since(start))
+			if outputObject.key != "" {
+				report.Output = uploadedObject(res.Dest, outputObject).String()
+			} else if toStdout {
+				report.Output = "-"
+			}
+			n.Output, n.Result = report.Output, &report
+		}
+		if notifyErr := notify(context.Background(), run.notifyURL, n); notifyErr != nil {
+			opts.Warnings.Printf("%s : error notifying %s:\n  %s", input, run.notifyURL, notifyErr)
+		}
+	}()
 
-	if err = coalesce(2, errChannel); err != nil {
-		return 0, err
+	sourcePath := input
+	inputObject, remoteInput := parseObjectURL(input)
+	if remoteInput {
+		switch {
+		case output == "" && run.template != "":
+			return fmt.Errorf("error naming output from template:\n  Templates name local files, so give an output path or URL for %s instead.", input)
+		case output == "":
+			// Outputs are saved beside objects as they are beside files
+			output = objectURL{inputObject.scheme, inputObject.bucket, defaultOutputPath(inputObject.key, opts, run.suffix)}.String()
+		}
+	}
+	if object, ok := parseObjectURL(output); ok {
+		if !opts.Force && !run.dryRun && objectExists(ctx, object) {
+			return fmt.Errorf("error checking output path:\n  %w", existingObjectError(output))
+		}
+		outputObject = object
+	}
+	if remoteInput || isInputURL(input) || input == "-" || outputObject.key != "" || output == "-" {
+		if staging, err = os.MkdirTemp(opts.TempDir, "rifewt-staging-"); err != nil {
+			return fmt.Errorf("error creating staging directory:\n  %w", err)
+		}
+	}
+	if remoteInput {
+		sourcePath = filepath.Join(staging, "input"+strings.ToLower(path.Ext(inputObject.key)))
+		if err = downloadObject(ctx, inputObject, sourcePath, 0); err != nil {
+			return fmt.Errorf("error downloading %s:\n  %w", input, err)
+		}
+	} else if isInputURL(input) {
+		sourcePath = filepath.Join(staging, "input"+strings.ToLower(path.Ext(inputURLName(input))))
+		if sourcePath, err = downloadInput(ctx, inputClient, input, sourcePath, run.maxDownload); err != nil {
+			return fmt.Errorf("error downloading %s:\n  %w", input, err)
+		}
+	} else if input == "-" {
+		if sourcePath, err = readStdin(staging); err != nil {
+			return fmt.Errorf("error reading input from stdin:\n  %w", err)
+		}
+	}
+	if outputObject.key != "" {
+		output = filepath.Join(staging, "output"+strings.ToLower(path.Ext(outputObject.key)))
+	}
+	// The output is written to stdout once it's whole, with the summary going to stderr instead
+	toStdout = output == "-"
+	summary := os.Stdout
+	if toStdout {
+		output = defaultOutputPath(filepath.Join(staging, "output"), opts, "")
+		if run.stdoutFormat != "" {
+			output = filepath.Join(staging, "output"+outputFormats[run.stdoutFormat])
+		}
+		summary = os.Stderr
 	}
 
-	// Merge alpha channel with opaque frames
+	source, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return fmt.Errorf("error recognizing input path:\n  %s", err)
+	}
+	if _, err = os.Stat(source); err != nil {
+		return fmt.Errorf("error opening input file:\n  %s", err)
+	}
+	opts.Source = source
+	// Outputs for inputs downloaded from URLs, or read from stdin, are named as if they'd been saved in the current directory
+	named := source
+	if isInputURL(input) || input == "-" {
+		name := "stdin"
+		if input != "-" {
+			name = inputURLName(input)
+		}
+		if named, err = filepath.Abs(name); err != nil {
+			return fmt.Errorf("error recognizing output path:\n  %s", err)
+		}
+	}
 
-	for frame := uint64(1); frame <= finalFrameCount; frame++ {
-		// RIFE output is numbered starting from 1
-		go func(i uint64, result chan error) {
-			frameName := fmt.Sprintf(outputPaddingSpecifier, i)
-			localErr := exec.Command(
-				magick, filepath.Join(interpolatedFrameDir, frameName), filepath.Join(interpolatedAlphaDir, frameName),
-				"-alpha", "Off", "-compose", "CopyOpacity", "-composite", filepath.Join(mergedDir, frameName),
-			).Run()
-			if localErr != nil {
-				result <- fmt.Errorf("error applying transparency to frames:\n  %s", localErr)
-				return
+	switch {
+	case output != "":
+		if opts.Dest, err = filepath.Abs(output); err != nil {
+			return fmt.Errorf("error recognizing output path:\n  %s", err)
+		}
+	case run.template != "":
+		if opts.Dest, err = templateOutputPath(ctx, named, opts, run.template); err != nil {
+			return fmt.Errorf("error naming output from template:\n  %w", err)
+		}
+		// Templates may name directories that don't exist yet
+		if !run.dryRun {
+			if err = os.MkdirAll(filepath.Dir(opts.Dest), 0755); err != nil {
+				return fmt.Errorf("error creating output directory:\n  %w", err)
 			}
-			result <- nil
-		}(frame, errChannel)
+		}
+	default:
+		opts.Dest = defaultOutputPath(named, opts, run.suffix)
+	}
+	// Even with -force, an input is never replaced by its own output
+	if opts.Dest == source {
+		return fmt.Errorf("error checking output path:\n  %s is the input itself; choose another output path, or another -suffix.", opts.Dest)
 	}
 
-	if err = coalesce(finalFrameCount, errChannel); err != nil {
-		return 0, err
+	if run.dryRun {
+		plan, err := rifewt.PlanInterpolation(ctx, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Print(describePlan(input, plan))
+		return nil
 	}
 
-	close(errChannel)
+	opts.Progress = progressPrinter(input, run.progress)
+
+	if run.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, run.timeout)
+		defer cancel()
+	}
 
-	// Assemble into an APNG
+	res, err = rifewt.Interpolate(ctx, opts)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("error interpolating %s:\n  Timed out after %s.", input, run.timeout)
+		}
+		return err
+	}
+	if outputObject.key != "" {
+		if err = uploadOutputs(ctx, staging, outputObject); err != nil {
+			return fmt.Errorf("error uploading output to %s:\n  %w", outputObject, err)
+		}
+	}
+	if toStdout {
+		if err = writeStdout(res.Dest); err != nil {
+			return fmt.Errorf("error writing output to stdout:\n  %w", err)
+		}
+	}
+	if run.toClipboard {
+		if err = copyToClipboard(ctx, res.Dest); err != nil {
+			return fmt.Errorf("error copying output to clipboard:\n  %w", err)
+		}
+	}
 
-	var apngDest string
-	if isGif {
-		// Only an intermediate step
-		apngDest = filepath.Join(dir, "anim.png")
-	} else {
-		apngDest = dest
+	if run.json {
+		report := newResultReport(input, res, time.Since(start))
+		if outputObject.key != "" {
+			report.Output = uploadedObject(res.Dest, outputObject).String()
+		}
+		line, _ := json.Marshal(report)
+		fmt.Println(string(line))
+		return nil
 	}
 
-	var framerateNumerator, framerateDenominator string
-	if frameLength > 0 {
-		// GIF frame lengths are in multiples of 1/100 of a second,
-		// so for (roughly) twice as many frames, double the denominator to keep the duration the same.
-		framerateNumerator = strconv.FormatUint(frameLength, 10)
-		framerateDenominator = "200"
-	} else {
-		// Default to 10 FPS if there is no frame length.
-		framerateNumerator = "1"
-		framerateDenominator = "10"
+	rifeDescription := res.Model
+	if res.RIFEVersion != "" {
+		rifeDescription += ", rife " + res.RIFEVersion
 	}
-	err = exec.Command(apngasm, apngDest, filepath.Join(mergedDir, "*.png"), "-i30", framerateNumerator, framerateDenominator).Run()
-	if err != nil {
-		return 0, fmt.Errorf("error assembling APNG:\n  %s", err)
+	fmt.Fprintf(summary, "%s : %d frames -> %d frames (%s)\n", input, res.SourceFrames, res.OutputFrames, rifeDescription)
+	if opts.Background == "auto" {
+		fmt.Fprintf(summary, "%s : chose matte %s\n", input, res.Matte)
+	}
+	if res.AlphaVerified {
+		fmt.Fprintf(summary, "%s : alpha verified, maximum deviation %d/255\n", input, res.AlphaDeviation)
+	}
+	if res.DuplicateFrames > 0 {
+		fmt.Fprintf(summary, "%s : collapsed %d duplicate frames\n", input, res.DuplicateFrames)
+	}
+	if res.OpaqueSource {
+		fmt.Fprintf(summary, "%s : source is fully opaque, so its alpha was skipped\n", input)
 	}
+	if res.SceneCuts > 0 {
+		fmt.Fprintf(summary, "%s : held across %d scene changes\n", input, res.SceneCuts)
+	}
+	return nil
+}
 
-	// Optionally convert to GIF
+func describePlan(input string, plan rifewt.Plan) string {
+	// Describes the planned run for the file at path `input`, with each step's command, in a single string,
+	// so plans for inputs in a batch aren't interleaved.
 
-	if isGif {
-		err = exec.Command(apng2gif, apngDest, dest).Run()
-		if err != nil {
-			return 0, fmt.Errorf("error converting APNG to GIF:\n  %s", err)
+	var description strings.Builder
+	var seconds float64
+	var delays []string
+	for i, d := range plan.Delays {
+		seconds += float64(d.Num) / float64(d.Den)
+		// Runs of the same delay are listed once
+		if run := 1; i == len(plan.Delays)-1 || plan.Delays[i+1] != d {
+			for j := i - 1; j >= 0 && plan.Delays[j] == d; j-- {
+				run++
+			}
+			delays = append(delays, fmt.Sprintf("%d x %d/%ds", run, d.Num, d.Den))
 		}
 	}
+	loops := "looping forever"
+	if plan.Loops > 0 {
+		loops = fmt.Sprintf("playing %d times", plan.Loops)
+	}
+	alpha := "with alpha"
+	if !plan.Alpha {
+		alpha = "opaque"
+	}
 
-	return frameCount, nil
+	_, _ = fmt.Fprintf(&description, "%s : dry run, %d frames -> %d frames at %dx, %gs, %s, %s, into %s\n",
+		input, plan.SourceFrames, plan.OutputFrames, plan.Factor, math.Round(seconds*1000)/1000, loops, alpha, plan.Dest)
+	_, _ = fmt.Fprintf(&description, "%s : frame delays %s\n", input, strings.Join(delays, ", "))
+	if plan.TempBytes > 0 {
+		_, _ = fmt.Fprintf(&description, "%s : about %.1f MiB of temporary frames in %s\n", input, float64(plan.TempBytes)/(1<<20), plan.TempDir)
+	}
+	for _, step := range plan.Steps {
+		_, _ = fmt.Fprintf(&description, "  %-13s %s\n", step.Stage, step.Description)
+		if step.Command != nil {
+			args := make([]string, len(step.Command))
+			for i, arg := range step.Command {
+				args[i] = arg
+				if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+					args[i] = strconv.Quote(arg)
+				}
+			}
+			_, _ = fmt.Fprintf(&description, "  %-13s $ %s\n", "", strings.Join(args, " "))
+		}
+	}
+	return description.String()
 }
 
-func coalesce(count uint64, errChannel chan error) error {
-	var err error
-	for i := uint64(0); i < count; i++ {
-		if procErr := <-errChannel; procErr != nil && err == nil {
-			// Save only the first error, but wait for all channels to report back
-			err = procErr
+func progressPrinter(input, format string) func(rifewt.Progress) {
+	// Produces a progress callback for the file at path `input`, printing in the format `format`:
+	// "text" prints a line to stderr each time a stage passes another tenth of the way through,
+	// "json" prints every update to stdout as a JSON object on its own line, and "none" prints nothing.
+
+	switch format {
+	case "json":
+		return func(p rifewt.Progress) {
+			line, _ := json.Marshal(struct {
+				Input string `json:"input"`
+				Stage string `json:"stage"`
+				Done  uint64 `json:"done"`
+				Total uint64 `json:"total"`
+			}{input, p.Stage, p.Done, p.Total})
+			fmt.Println(string(line))
+		}
+	case "text":
+		lastStage, lastTenth := "", uint64(0)
+		return func(p rifewt.Progress) {
+			if p.Total == 0 {
+				return
+			}
+			tenth := p.Done * 10 / p.Total
+			if p.Stage == lastStage && tenth == lastTenth {
+				return
+			}
+			lastStage, lastTenth = p.Stage, tenth
+			_, _ = fmt.Fprintf(os.Stderr, "%s : %s %d%%\n", input, p.Stage, tenth*10)
 		}
 	}
-	return err
+	return nil
 }
 
-func copyFile(src, dst string) (int64, error) {
-	// From https://opensource.com/article/18/6/copying-files-go
-	sourceFileStat, err := os.Stat(src)
-	if err != nil {
-		return 0, err
-	}
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	// Parses `args` with `flags`, allowing flags to come after positional arguments, and returns the positional arguments.
+	// As usual, everything following a -- argument is positional.
 
-	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", src)
+	var positional []string
+	for {
+		_ = flags.Parse(args)
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
 	}
+}
 
-	source, err := os.Open(src)
-	if err != nil {
-		return 0, err
-	}
-	defer func(source *os.File) { _ = source.Close() }(source)
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	// Reports whether the flag `name` was given in the arguments `flags` parsed.
 
-	destination, err := os.Create(dst)
-	if err != nil {
-		return 0, err
-	}
-	defer func(destination *os.File) { _ = destination.Close() }(destination)
-	nBytes, err := io.Copy(destination, source)
-	return nBytes, err
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
@@ -0,0 +1,568 @@
+package rifewt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// composedFrame is a single fully composed frame of an animation decoded in Go.
+type composedFrame struct {
+	image *image.NRGBA
+	// delay is zero if the frame has no delay of its own.
+	delay Delay
+}
+
+// errNotAPNG is returned by decodeAPNG for files that aren't animated PNGs.
+var errNotAPNG = errors.New("not an animated PNG")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunk is a raw PNG chunk, without its length or CRC.
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func readPNGChunks(r io.Reader) ([]pngChunk, error) {
+	// Reads every chunk of a PNG stream, up to and including IEND.
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return nil, errNotAPNG
+	}
+
+	var chunks []pngChunk
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("truncated PNG: %s", err)
+		}
+		chunk := pngChunk{kind: string(header[4:8]), data: make([]byte, binary.BigEndian.Uint32(header[0:4]))}
+		// The data is followed by a CRC, which image/png checks for the chunks it decodes
+		if _, err := io.ReadFull(r, chunk.data); err != nil {
+			return nil, fmt.Errorf("truncated PNG: %s", err)
+		}
+		if _, err := io.ReadFull(r, header[:4]); err != nil {
+			return nil, fmt.Errorf("truncated PNG: %s", err)
+		}
+		chunks = append(chunks, chunk)
+		if chunk.kind == "IEND" {
+			return chunks, nil
+		}
+	}
+}
+
+func writePNGChunk(w io.Writer, kind string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	copy(header[4:8], kind)
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:8])
+	checksum.Write(data)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], checksum.Sum32())
+
+	for _, part := range [][]byte{header[:], data, crc[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apngFrameControl is the contents of an APNG fcTL chunk.
+type apngFrameControl struct {
+	width, height  uint32
+	xOffset        uint32
+	yOffset        uint32
+	delayNumerator uint16
+	delayDenom     uint16
+	disposeOp      byte
+	blendOp        byte
+}
+
+const (
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+func isAPNG(path string) bool {
+	// Reports whether the file at path `path` is a PNG with an animation control chunk.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	chunks, err := readPNGChunks(file)
+	if err != nil {
+		return false
+	}
+	for _, chunk := range chunks {
+		if chunk.kind == "acTL" {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeAPNG(path string) ([]composedFrame, uint64, error) {
+	// Decodes every frame of the APNG at path `path`, composed onto the full canvas as they would be displayed,
+	// along with the number of times the animation plays, or 0 if it loops forever.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	chunks, err := readPNGChunks(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(chunks) == 0 || chunks[0].kind != "IHDR" || len(chunks[0].data) != 13 {
+		return nil, 0, fmt.Errorf("missing PNG header")
+	}
+	header := chunks[0].data
+	canvasWidth, canvasHeight := binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8])
+
+	// Chunks other than the image data and animation chunks that the frames need in order to decode, like the palette
+	var shared []pngChunk
+	var loops uint64
+	animated := false
+
+	// Each frame's control chunk and image data, which for the first frame may be the default image's IDAT chunks
+	type rawFrame struct {
+		control apngFrameControl
+		data    [][]byte
+	}
+	var frames []rawFrame
+	for _, chunk := range chunks[1:] {
+		switch chunk.kind {
+		case "acTL":
+			if len(chunk.data) != 8 {
+				return nil, 0, fmt.Errorf("invalid acTL chunk")
+			}
+			animated = true
+			loops = uint64(binary.BigEndian.Uint32(chunk.data[4:8]))
+		case "fcTL":
+			if len(chunk.data) != 26 {
+				return nil, 0, fmt.Errorf("invalid fcTL chunk")
+			}
+			d := chunk.data
+			frames = append(frames, rawFrame{control: apngFrameControl{
+				width:          binary.BigEndian.Uint32(d[4:8]),
+				height:         binary.BigEndian.Uint32(d[8:12]),
+				xOffset:        binary.BigEndian.Uint32(d[12:16]),
+				yOffset:        binary.BigEndian.Uint32(d[16:20]),
+				delayNumerator: binary.BigEndian.Uint16(d[20:22]),
+				delayDenom:     binary.BigEndian.Uint16(d[22:24]),
+				disposeOp:      d[24],
+				blendOp:        d[25],
+			}})
+		case "IDAT":
+			// The default image is only part of the animation if a frame control chunk precedes it
+			if len(frames) == 1 {
+				frames[0].data = append(frames[0].data, chunk.data)
+			}
+		case "fdAT":
+			if len(frames) == 0 || len(chunk.data) < 4 {
+				return nil, 0, fmt.Errorf("invalid fdAT chunk")
+			}
+			// Skip the sequence number to leave plain image data
+			frames[len(frames)-1].data = append(frames[len(frames)-1].data, chunk.data[4:])
+		case "IEND":
+		default:
+			shared = append(shared, chunk)
+		}
+	}
+	if !animated {
+		return nil, 0, errNotAPNG
+	}
+
+	canvasBounds := image.Rect(0, 0, int(canvasWidth), int(canvasHeight))
+	canvas := image.NewNRGBA(canvasBounds)
+	decoded := make([]composedFrame, 0, len(frames))
+	for i, frame := range frames {
+		control := frame.control
+		bounds := image.Rect(int(control.xOffset), int(control.yOffset), int(control.xOffset+control.width), int(control.yOffset+control.height))
+		if !bounds.In(canvasBounds) || bounds.Empty() {
+			return nil, 0, fmt.Errorf("frame %d lies outside the canvas", i+1)
+		}
+
+		// Re-wrap the frame's data as a standalone PNG of the frame's size
+		var standalone bytes.Buffer
+		standalone.Write(pngSignature)
+		frameHeader := append([]byte(nil), header...)
+		binary.BigEndian.PutUint32(frameHeader[0:4], control.width)
+		binary.BigEndian.PutUint32(frameHeader[4:8], control.height)
+		writePNGChunk(&standalone, "IHDR", frameHeader)
+		for _, chunk := range shared {
+			writePNGChunk(&standalone, chunk.kind, chunk.data)
+		}
+		for _, data := range frame.data {
+			writePNGChunk(&standalone, "IDAT", data)
+		}
+		writePNGChunk(&standalone, "IEND", nil)
+
+		frameImage, err := png.Decode(&standalone)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error decoding frame %d: %s", i+1, err)
+		}
+
+		disposeOp := control.disposeOp
+		if i == 0 && disposeOp == apngDisposePrevious {
+			// There's nothing previous to the first frame
+			disposeOp = apngDisposeBackground
+		}
+		var previous *image.NRGBA
+		if disposeOp == apngDisposePrevious {
+			previous = image.NewNRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		op := draw.Src
+		if control.blendOp == apngBlendOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, bounds, frameImage, frameImage.Bounds().Min, op)
+
+		composed := image.NewNRGBA(canvasBounds)
+		copy(composed.Pix, canvas.Pix)
+		frameDelay := Delay{}
+		if control.delayNumerator > 0 {
+			denominator := uint64(control.delayDenom)
+			if denominator == 0 {
+				// As the APNG specification says, a zero denominator means hundredths of a second
+				denominator = 100
+			}
+			frameDelay = reducedDelay(uint64(control.delayNumerator), denominator)
+		}
+		decoded = append(decoded, composedFrame{image: composed, delay: frameDelay})
+
+		switch disposeOp {
+		case apngDisposeBackground:
+			draw.Draw(canvas, bounds, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			draw.Draw(canvas, bounds, previous, bounds.Min, draw.Src)
+		}
+	}
+
+	return decoded, loops, nil
+}
+
+func writeAPNG(ctx context.Context, dest string, framePaths []string, delays []Delay, loops uint64, opaque bool, progress func(done uint64)) error {
+	// Encodes the PNG frames at `framePaths` into an APNG at path `dest`, each lasting the corresponding entry of `delays`,
+	// playing `loops` times, or forever if 0. The frames are stored without alpha if `opaque` is set.
+	// Each frame after the first only stores the rectangle that changed since the frame before.
+	// If set, `progress` is called with the number of frames written after each one.
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	w := bufio.NewWriter(file)
+
+	colorType, channels := byte(6), 4
+	if opaque {
+		colorType, channels = 2, 3
+	}
+
+	var previous *image.NRGBA
+	var sequence uint32
+	for i, path := range framePaths {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		decoded, err := decodePNG(path)
+		if err != nil {
+			return err
+		}
+		frame := toNRGBA(decoded)
+		bounds := frame.Bounds()
+
+		region := bounds
+		if previous == nil {
+			header := make([]byte, 13)
+			binary.BigEndian.PutUint32(header[0:4], uint32(bounds.Dx()))
+			binary.BigEndian.PutUint32(header[4:8], uint32(bounds.Dy()))
+			// 8 bits per channel, then the colour type, and default compression, filtering, and interlacing
+			header[8], header[9] = 8, colorType
+			animationControl := make([]byte, 8)
+			binary.BigEndian.PutUint32(animationControl[0:4], uint32(len(framePaths)))
+			binary.BigEndian.PutUint32(animationControl[4:8], uint32(loops))
+
+			if _, err = w.Write(pngSignature); err != nil {
+				return err
+			}
+			if err = writePNGChunk(w, "IHDR", header); err != nil {
+				return err
+			}
+			if err = writePNGChunk(w, "acTL", animationControl); err != nil {
+				return err
+			}
+		} else {
+			if bounds != previous.Bounds() {
+				return fmt.Errorf("%s is %v, but the first frame is %v", filepath.Base(path), bounds.Size(), previous.Bounds().Size())
+			}
+			region = changedRegion(previous, frame)
+		}
+
+		// Frames replace the region they cover, and are left in place for the next frame to build on
+		frameControl := make([]byte, 26)
+		binary.BigEndian.PutUint32(frameControl[0:4], sequence)
+		binary.BigEndian.PutUint32(frameControl[4:8], uint32(region.Dx()))
+		binary.BigEndian.PutUint32(frameControl[8:12], uint32(region.Dy()))
+		binary.BigEndian.PutUint32(frameControl[12:16], uint32(region.Min.X))
+		binary.BigEndian.PutUint32(frameControl[16:20], uint32(region.Min.Y))
+		binary.BigEndian.PutUint16(frameControl[20:22], uint16(delays[i].Num))
+		binary.BigEndian.PutUint16(frameControl[22:24], uint16(delays[i].Den))
+		sequence++
+		if err = writePNGChunk(w, "fcTL", frameControl); err != nil {
+			return err
+		}
+
+		data, err := compressRegion(frame, region, channels)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			// The first frame doubles as the default image shown by viewers without APNG support
+			err = writePNGChunk(w, "IDAT", data)
+		} else {
+			frameData := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(frameData, sequence)
+			sequence++
+			err = writePNGChunk(w, "fdAT", append(frameData, data...))
+		}
+		if err != nil {
+			return err
+		}
+
+		previous = frame
+		if progress != nil {
+			progress(uint64(i + 1))
+		}
+	}
+
+	if err = writePNGChunk(w, "IEND", nil); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// pngOptimizers lists the programs optimizeAPNG can use, in order of preference.
+var pngOptimizers = []string{"apngopt", "oxipng", "zopflipng"}
+
+func apngOptimizerArgs(optimizer, path, optimized string) []string {
+	// Produces the arguments for `optimizer` to write an optimized copy of the APNG at path `path` to `optimized`.
+
+	switch strings.TrimSuffix(filepath.Base(optimizer), filepath.Ext(optimizer)) {
+	case "apngopt":
+		return []string{path, optimized}
+	case "oxipng":
+		return []string{"-o", "4", "--strip", "safe", "--out", optimized, path}
+	default:
+		return []string{"-y", "--keepchunks=acTL,fcTL,fdAT", path, optimized}
+	}
+}
+
+func optimizeAPNG(ctx context.Context, optimizer, path string) (bool, error) {
+	// Runs the APNG at path `path` through `optimizer`, which is apngopt, oxipng, or zopflipng, replacing it
+	// only if the result is smaller and still displays exactly the same frames for the same time.
+	// Only apngopt understands animation, so the others can lose or garble frames, in which case it's left as it was.
+	// Returns false if the optimized file wasn't kept.
+
+	optimized := strings.TrimSuffix(path, filepath.Ext(path)) + "-optimized.png"
+	defer func(path string) { _ = os.Remove(path) }(optimized)
+
+	if err := command(ctx, optimizer, apngOptimizerArgs(optimizer, path, optimized)...).Run(); err != nil {
+		return false, err
+	}
+
+	before, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	after, err := os.Stat(optimized)
+	if err != nil || after.Size() >= before.Size() {
+		return false, nil
+	}
+	original, loops, err := decodeAPNG(path)
+	if err != nil {
+		return false, err
+	}
+	result, resultLoops, err := decodeAPNG(optimized)
+	if err != nil || resultLoops != loops || !sameFrames(original, result) {
+		return false, nil
+	}
+	return true, os.Rename(optimized, path)
+}
+
+func sameFrames(a, b []composedFrame) bool {
+	// Reports whether `a` and `b` display the same, ignoring the colour of fully transparent pixels,
+	// and differences in delays too small to see.
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i].delay.seconds()-b[i].delay.seconds()) > 0.001 || a[i].image.Rect != b[i].image.Rect {
+			return false
+		}
+		pa, pb := a[i].image.Pix, b[i].image.Pix
+		for j := 0; j < len(pa); j += 4 {
+			if pa[j+3] != pb[j+3] || (pa[j+3] > 0 && (pa[j] != pb[j] || pa[j+1] != pb[j+1] || pa[j+2] != pb[j+2])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Bounds().Min == (image.Point{}) {
+		return nrgba
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+func changedRegion(previous, current *image.NRGBA) image.Rectangle {
+	// Finds the smallest rectangle containing every pixel that differs between `previous` and `current`,
+	// or a single pixel if none do, as every frame needs some image data.
+
+	bounds := current.Bounds()
+	region := image.Rectangle{Min: bounds.Max, Max: bounds.Min}
+	for y := 0; y < bounds.Dy(); y++ {
+		previousRow := previous.Pix[y*previous.Stride : y*previous.Stride+4*bounds.Dx()]
+		currentRow := current.Pix[y*current.Stride : y*current.Stride+4*bounds.Dx()]
+		if bytes.Equal(previousRow, currentRow) {
+			continue
+		}
+		for x := 0; x < bounds.Dx(); x++ {
+			if !bytes.Equal(previousRow[4*x:4*x+4], currentRow[4*x:4*x+4]) {
+				region = region.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if region.Empty() {
+		return image.Rect(0, 0, 1, 1)
+	}
+	return region
+}
+
+func compressRegion(img *image.NRGBA, region image.Rectangle, channels int) ([]byte, error) {
+	// Produces the compressed PNG image data for `region` of `img`, with 3 or 4 `channels`,
+	// choosing the filter for each row as the PNG specification recommends.
+
+	var compressed bytes.Buffer
+	writer, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	rowLength := channels * region.Dx()
+	current, previous := make([]byte, rowLength), make([]byte, rowLength)
+	var filtered [5][]byte
+	for filter := range filtered {
+		filtered[filter] = make([]byte, 1+rowLength)
+		filtered[filter][0] = byte(filter)
+	}
+
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(region.Min.X, y):img.PixOffset(region.Max.X, y)]
+		if channels == 4 {
+			copy(current, row)
+		} else {
+			for x := 0; x < region.Dx(); x++ {
+				copy(current[3*x:3*x+3], row[4*x:4*x+3])
+			}
+		}
+
+		if _, err = writer.Write(filterRow(&filtered, current, previous, channels)); err != nil {
+			return nil, err
+		}
+		current, previous = previous, current
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func filterRow(filtered *[5][]byte, current, previous []byte, channels int) []byte {
+	// Applies each PNG filter to `current`, given the unfiltered row above it, `previous`,
+	// and returns the filtered row, led by its filter type, with the smallest sum of absolute differences.
+
+	for i, value := range current {
+		var left, upLeft byte
+		if i >= channels {
+			left, upLeft = current[i-channels], previous[i-channels]
+		}
+		up := previous[i]
+		filtered[0][i+1] = value
+		filtered[1][i+1] = value - left
+		filtered[2][i+1] = value - up
+		filtered[3][i+1] = value - byte((uint16(left)+uint16(up))/2)
+		filtered[4][i+1] = value - paeth(left, up, upLeft)
+	}
+
+	best, bestSum := 0, -1
+	for filter, row := range filtered {
+		sum := 0
+		for _, value := range row[1:] {
+			sum += abs(int(int8(value)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = filter, sum
+		}
+	}
+	return filtered[best]
+}
+
+func paeth(a, b, c byte) byte {
+	// Predicts a byte from its left (`a`), upper (`b`), and upper left (`c`) neighbours.
+
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
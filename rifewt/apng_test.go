@@ -0,0 +1,186 @@
+package rifewt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPNGRoundTrip(t *testing.T) {
+	// Frames written by writeAPNG read back the same through decodeAPNG, including repeated frames, which are stored
+	// as a single pixel, small changes, stored as the rectangle around them, and fully transparent frames.
+
+	base := testPattern(9, 7, 0)
+	changed := copyNRGBA(base)
+	for y := 2; y < 4; y++ {
+		for x := 3; x < 6; x++ {
+			changed.SetNRGBA(x, y, color.NRGBA{0x10, 0x20, 0x30, 0xFF})
+		}
+	}
+	transparent := image.NewNRGBA(base.Bounds())
+	frames := []*image.NRGBA{base, copyNRGBA(base), changed, transparent, image.NewNRGBA(base.Bounds()), testPattern(9, 7, 5)}
+	delays := []Delay{{1, 10}, {3, 100}, {1, 30}, {2, 25}, {7, 100}, {1, 20}}
+	// The size of the region each frame is expected to store
+	regions := []image.Point{{9, 7}, {1, 1}, {3, 2}, {9, 7}, {1, 1}, {9, 7}}
+
+	for _, opaque := range []bool{false, true} {
+		t.Run(fmt.Sprintf("opaque=%v", opaque), func(t *testing.T) {
+			testFrames := frames
+			if opaque {
+				testFrames = make([]*image.NRGBA, len(frames))
+				for i, frame := range frames {
+					testFrames[i] = flattenForTest(frame)
+				}
+			}
+
+			dir := t.TempDir()
+			paths := make([]string, len(testFrames))
+			for i, frame := range testFrames {
+				paths[i] = filepath.Join(dir, fmt.Sprintf("%08d.png", i+1))
+				writeTestPNG(t, paths[i], frame)
+			}
+			dest := filepath.Join(dir, "animation.png")
+			if err := writeAPNG(context.Background(), dest, paths, delays, 3, opaque, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, loops, err := decodeAPNG(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loops != 3 {
+				t.Errorf("loops %d, want 3", loops)
+			}
+			want := make([]composedFrame, len(testFrames))
+			for i, frame := range testFrames {
+				want[i] = composedFrame{image: frame, delay: delays[i]}
+			}
+			if len(decoded) != len(want) {
+				t.Fatalf("decoded %d frames, want %d", len(decoded), len(want))
+			}
+			for i := range decoded {
+				if decoded[i].delay != delays[i] {
+					t.Errorf("frame %d: delay %v, want %v", i, decoded[i].delay, delays[i])
+				}
+			}
+			if !sameFrames(decoded, want) {
+				t.Error("decoded frames differ from those written")
+			}
+
+			// Each frame after the first stores only what changed, in sequence
+			var sequence uint32
+			var controls []image.Point
+			for _, chunk := range readTestChunks(t, dest) {
+				switch chunk.kind {
+				case "fcTL":
+					if got := binary.BigEndian.Uint32(chunk.data[0:4]); got != sequence {
+						t.Errorf("fcTL has sequence number %d, want %d", got, sequence)
+					}
+					sequence++
+					controls = append(controls, image.Pt(int(binary.BigEndian.Uint32(chunk.data[4:8])), int(binary.BigEndian.Uint32(chunk.data[8:12]))))
+				case "fdAT":
+					if got := binary.BigEndian.Uint32(chunk.data[0:4]); got != sequence {
+						t.Errorf("fdAT has sequence number %d, want %d", got, sequence)
+					}
+					sequence++
+				}
+			}
+			if fmt.Sprint(controls) != fmt.Sprint(regions) {
+				t.Errorf("frames store regions %v, want %v", controls, regions)
+			}
+		})
+	}
+}
+
+func TestSameFrames(t *testing.T) {
+	a := []composedFrame{{image: testPattern(4, 4, 0), delay: Delay{1, 10}}}
+	b := []composedFrame{{image: copyNRGBA(a[0].image), delay: Delay{10, 100}}}
+	if !sameFrames(a, b) {
+		t.Error("identical frames with equal delays differ")
+	}
+
+	// The colour of fully transparent pixels can't be seen
+	hidden := copyNRGBA(a[0].image)
+	hidden.Pix[3], hidden.Pix[0] = 0, 0x7F
+	shown := copyNRGBA(hidden)
+	shown.Pix[0] = 0x01
+	if !sameFrames([]composedFrame{{image: hidden}}, []composedFrame{{image: shown}}) {
+		t.Error("frames differing only under full transparency differ")
+	}
+
+	tests := map[string][]composedFrame{
+		"fewer frames":   {},
+		"longer delay":   {{image: b[0].image, delay: Delay{11, 100}}},
+		"changed pixel":  {{image: testPattern(4, 4, 1), delay: b[0].delay}},
+		"different size": {{image: testPattern(4, 5, 0), delay: b[0].delay}},
+	}
+	for name, other := range tests {
+		if sameFrames(a, other) {
+			t.Errorf("%s: frames are reported the same", name)
+		}
+	}
+}
+
+func testPattern(width, height, seed int) *image.NRGBA {
+	// Makes a frame with every pixel different, including partially and fully transparent ones.
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			alpha := uint8((x*37 + y*11 + seed*13) % 256)
+			if (x+y+seed)%5 == 0 {
+				alpha = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x*29 + seed), uint8(y*31 + seed), uint8((x + y) * 17), alpha})
+		}
+	}
+	return img
+}
+
+func copyNRGBA(img *image.NRGBA) *image.NRGBA {
+	copied := image.NewNRGBA(img.Rect)
+	copy(copied.Pix, img.Pix)
+	return copied
+}
+
+func flattenForTest(img *image.NRGBA) *image.NRGBA {
+	// Makes every pixel of a copy of `img` opaque, for frames written without alpha.
+
+	flattened := copyNRGBA(img)
+	for i := 3; i < len(flattened.Pix); i += 4 {
+		flattened.Pix[i] = 0xFF
+	}
+	return flattened
+}
+
+func writeTestPNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestChunks(t *testing.T, path string) []pngChunk {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	chunks, err := readPNGChunks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
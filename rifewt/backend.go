@@ -0,0 +1,356 @@
+package rifewt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// backend is the external image tool used for whatever isn't done in Go:
+// reading sources that the Go decoders can't, and the occasional edit to a finished frame.
+type backend interface {
+	// name is how the backend is referred to in messages, e.g. "ImageMagick".
+	name() string
+
+	// program is the path of the backend's main program, for identifying its version.
+	program() string
+
+	// probe reads the delay of each frame of `source`, zero where unknown.
+	probe(ctx context.Context, source string) ([]Delay, error)
+
+	// extract writes each frame of `source` into `frameDir` as an opaque PNG, numbered from 0 by `paddingSpecifier`,
+	// with fully transparent pixels taking on the colour `background`, and its alpha into `alphaDir` as a grayscale PNG.
+	// With `flatten` set, every pixel is blended over `background` instead, and no alpha is written.
+	// `scratchDir` is an empty directory that may be used for intermediate files.
+	extract(ctx context.Context, source, frameDir, alphaDir, scratchDir, paddingSpecifier, background string, flatten bool) error
+
+	// crossfade writes the blend of the frame `from` with `weight` (0 to 1) of the frame `to` over it to `dest`,
+	// keeping the frames' colour type.
+	crossfade(ctx context.Context, from, to, dest string, weight float64) error
+
+	// resize writes the frame `frame` scaled to fit within a square of `size` pixels to `dest`.
+	resize(ctx context.Context, frame, dest string, size uint64) error
+
+	// export writes the frame `frame` to `dest`, in the format implied by its extension,
+	// blended over the colour `background` if `flatten` is set.
+	export(ctx context.Context, frame, dest, background string, flatten bool) error
+
+	// colour finds the RGB value of the colour named `colour`.
+	colour(ctx context.Context, colour string) (color.RGBA, error)
+}
+
+func findBackend(ctx context.Context, choice string) (backend, error) {
+	// Locates the backend `choice`, "magick" or "ffmpeg", or with "auto", ImageMagick if it's installed and otherwise ffmpeg.
+
+	// A path set for magick that can't be run is reported, rather than quietly passed over for ffmpeg
+	magick, magickErr := findMagick(ctx)
+	if choice == "magick" || (choice == "auto" && (magickErr == nil || programPathSet("magick"))) {
+		if magickErr != nil {
+			return nil, magickErr
+		}
+		return magick, nil
+	}
+
+	ffmpeg, err := findProgram("ffmpeg")
+	if err != nil {
+		if choice == "auto" {
+			return nil, errors.New("neither ImageMagick (magick, or convert and identify) nor ffmpeg could be found")
+		}
+		return nil, err
+	}
+	ffprobe, err := findProgram("ffprobe")
+	if err != nil {
+		return nil, err
+	}
+	return ffmpegBackend{ffmpeg, ffprobe}, nil
+}
+
+func resolveColour(ctx context.Context, b backend, colour string) (color.RGBA, error) {
+	// Finds the RGB value of the colour `colour`. Hex colours are read directly, and anything else is left to the backend.
+
+	if parsed, ok := parseHexColour(colour); ok {
+		return parsed, nil
+	}
+	parsed, err := b.colour(ctx, colour)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid colour %s: %s", colour, err)
+	}
+	return parsed, nil
+}
+
+// magickBackend runs ImageMagick. Each field is a command and any leading arguments,
+// which for ImageMagick 7 all run magick, and for ImageMagick 6 run its separate programs.
+type magickBackend struct {
+	// magick reads images, edits them, and writes them out, as ImageMagick 7's magick or ImageMagick 6's convert.
+	magick []string
+	// convert and identify work as ImageMagick 6's programs of the same names.
+	convert  []string
+	identify []string
+}
+
+func findMagick(ctx context.Context) (magickBackend, error) {
+	// Locates ImageMagick 7's magick, or failing that, ImageMagick 6's convert and identify, as Debian and Ubuntu still ship.
+
+	magick, err := findProgram("magick")
+	if err == nil {
+		return magickBackend{magick: []string{magick}, convert: []string{magick, "convert"}, identify: []string{magick, "identify"}}, nil
+	}
+	if programPathSet("magick") {
+		return magickBackend{}, err
+	}
+
+	convert, convertErr := findProgram("convert")
+	identify, identifyErr := findProgram("identify")
+	if convertErr != nil || identifyErr != nil {
+		return magickBackend{}, err
+	}
+	// Windows has an unrelated convert, for converting FAT volumes to NTFS
+	output, versionErr := command(ctx, convert, "-version").Output()
+	if versionErr != nil || !strings.Contains(string(output), "ImageMagick") {
+		return magickBackend{}, err
+	}
+	return magickBackend{magick: []string{convert}, convert: []string{convert}, identify: []string{identify}}, nil
+}
+
+func (b magickBackend) command(ctx context.Context, program []string, args ...string) process {
+	// Runs the ImageMagick command `program`, one of b's fields, with `args` following its leading arguments.
+
+	return command(ctx, program[0], append(program[1:len(program):len(program)], args...)...)
+}
+
+func (b magickBackend) name() string {
+	return "ImageMagick"
+}
+
+func (b magickBackend) program() string {
+	return b.magick[0]
+}
+
+func (b magickBackend) probe(ctx context.Context, source string) ([]Delay, error) {
+	output, err := b.command(ctx, b.identify, "-format", "%n %T ", source).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// The format is repeated for each frame, giving the frame count followed by that frame's delay
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return nil, errors.New("no frames found")
+	}
+	frameCount, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	delays := make([]Delay, frameCount)
+	for i := range delays {
+		if 2*i+1 >= len(fields) {
+			break
+		}
+		if centiseconds, err := strconv.ParseUint(fields[2*i+1], 10, 64); err == nil && centiseconds > 0 {
+			delays[i] = Delay{centiseconds, 100}
+		}
+	}
+	return delays, nil
+}
+
+func (b magickBackend) extract(ctx context.Context, source, frameDir, alphaDir, scratchDir, paddingSpecifier, background string, flatten bool) error {
+	matteMode := "Background"
+	if flatten {
+		matteMode = "Remove"
+	}
+
+	errChannel := make(chan error)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func(result chan error) {
+		localErr := b.command(ctx, b.convert, source, "-background", background, "-coalesce", "-alpha", matteMode, "-alpha", "Off", "-strip", "-interlace", "None", "-define", "png:color-type=2", filepath.Join(frameDir, paddingSpecifier)).Run()
+		if localErr != nil {
+			result <- fmt.Errorf("error extracting frames from source:\n  %w", localErr)
+			return
+		}
+		result <- nil
+	}(errChannel)
+
+	streams := uint64(1)
+	if !flatten {
+		streams++
+		go func(result chan error) {
+			localErr := b.command(ctx, b.convert, source, "-coalesce", "-alpha", "Extract", "-strip", "-interlace", "None", "-define", "png:color-type=0", filepath.Join(alphaDir, paddingSpecifier)).Run()
+			if localErr != nil {
+				result <- fmt.Errorf("error extracting alpha from source frames:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(errChannel)
+	}
+
+	if err := coalesce(streams, errChannel, cancel); err != nil {
+		return err
+	}
+	close(errChannel)
+	return nil
+}
+
+func (b magickBackend) crossfade(ctx context.Context, from, to, dest string, weight float64) error {
+	// ImageMagick writes PNGs with the fewest channels that fit, so pin the colour type to that of the frames
+	colorType := "png:color-type=2"
+	if decoded, err := decodePNG(from); err == nil {
+		if _, ok := decoded.(*image.Gray); ok {
+			colorType = "png:color-type=0"
+		}
+	}
+
+	// Percentage of `to` to blend over `from`
+	percentage := strconv.FormatFloat(weight*100, 'f', 2, 64)
+	return b.command(ctx, b.magick, from, to, "-compose", "Blend", "-define", "compose:args="+percentage, "-composite", "-define", colorType, dest).Run()
+}
+
+func (b magickBackend) resize(ctx context.Context, frame, dest string, size uint64) error {
+	return b.command(ctx, b.magick, frame, "-resize", fmt.Sprintf("%dx%d", size, size), "-interlace", "None", dest).Run()
+}
+
+func (b magickBackend) export(ctx context.Context, frame, dest, background string, flatten bool) error {
+	if flatten {
+		return b.command(ctx, b.magick, frame, "-background", background, "-alpha", "Remove", "-alpha", "Off", dest).Run()
+	}
+	return b.command(ctx, b.magick, frame, dest).Run()
+}
+
+func (b magickBackend) colour(ctx context.Context, colour string) (color.RGBA, error) {
+	// ImageMagick understands every colour format it accepts on the command line
+	output, err := b.command(ctx, b.magick, "xc:"+colour, "-alpha", "Off", "PNG24:-").Output()
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	img, err := png.Decode(bytes.NewReader(output))
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	red, green, blue, _ := img.At(img.Bounds().Min.X, img.Bounds().Min.Y).RGBA()
+	return color.RGBA{R: uint8(red >> 8), G: uint8(green >> 8), B: uint8(blue >> 8), A: 255}, nil
+}
+
+// ffmpegBackend runs ffmpeg and ffprobe, for systems without ImageMagick.
+// Frames are decoded by ffmpeg, and split and blended in Go.
+type ffmpegBackend struct {
+	ffmpeg  string
+	ffprobe string
+}
+
+func (b ffmpegBackend) name() string {
+	return "ffmpeg"
+}
+
+func (b ffmpegBackend) program() string {
+	return b.ffmpeg
+}
+
+func (b ffmpegBackend) probe(ctx context.Context, source string) ([]Delay, error) {
+	// Newer ffprobe builds name the duration duration_time, and older ones pkt_duration_time; whichever is missing is left out
+	output, err := command(ctx, b.ffprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "frame=duration_time,pkt_duration_time", "-of", "csv=p=0", source).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var delays []Delay
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		var frameDelay Delay
+		for _, field := range strings.Split(line, ",") {
+			if seconds, err := strconv.ParseFloat(field, 64); err == nil && seconds > 0 {
+				frameDelay = reducedDelay(uint64(math.Round(seconds*1000)), 1000)
+				break
+			}
+		}
+		delays = append(delays, frameDelay)
+	}
+	if len(delays) == 0 {
+		return nil, errors.New("no frames found")
+	}
+	return delays, nil
+}
+
+func (b ffmpegBackend) extract(ctx context.Context, source, frameDir, alphaDir, scratchDir, paddingSpecifier, background string, flatten bool) error {
+	// ffmpeg decodes the frames with their alpha, composed onto the full canvas, and then they're split in Go
+	err := command(ctx, b.ffmpeg, "-v", "error", "-i", source, "-map", "0:v:0", "-fps_mode", "passthrough",
+		"-pix_fmt", "rgba", filepath.Join(scratchDir, "%08d.png")).Run()
+	if err != nil {
+		return fmt.Errorf("error extracting frames from source:\n  %w", err)
+	}
+
+	matte, err := resolveColour(ctx, b, background)
+	if err != nil {
+		return fmt.Errorf("error reading matte colour:\n  %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(scratchDir, "*.png"))
+	if err != nil {
+		return fmt.Errorf("error extracting frames from source:\n  %w", err)
+	}
+	return splitFrameFiles(ctx, paths, frameDir, alphaDir, paddingSpecifier, matte, flatten)
+}
+
+func (b ffmpegBackend) crossfade(ctx context.Context, from, to, dest string, weight float64) error {
+	return blendFrames(from, to, dest, weight)
+}
+
+func (b ffmpegBackend) resize(ctx context.Context, frame, dest string, size uint64) error {
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:flags=lanczos", size, size)
+	return command(ctx, b.ffmpeg, "-v", "error", "-y", "-i", frame, "-vf", scale, "-frames:v", "1", "-update", "1", dest).Run()
+}
+
+func (b ffmpegBackend) export(ctx context.Context, frame, dest, background string, flatten bool) error {
+	if flatten {
+		// Flatten in Go, as ffmpeg's overlay filter needs a canvas of the right size to flatten onto
+		matte, err := resolveColour(ctx, b, background)
+		if err != nil {
+			return err
+		}
+		decoded, err := decodePNG(frame)
+		if err != nil {
+			return err
+		}
+		flattened := image.NewRGBA(decoded.Bounds())
+		draw.Draw(flattened, flattened.Bounds(), image.NewUniform(matte), image.Point{}, draw.Src)
+		draw.Draw(flattened, flattened.Bounds(), decoded, decoded.Bounds().Min, draw.Over)
+
+		tmp, err := os.CreateTemp(filepath.Dir(frame), "flattened-*.png")
+		if err != nil {
+			return err
+		}
+		_ = tmp.Close()
+		defer func(path string) { _ = os.Remove(path) }(tmp.Name())
+		if err = encodeIntermediate(flattened, tmp.Name()); err != nil {
+			return err
+		}
+		frame = tmp.Name()
+	}
+
+	return command(ctx, b.ffmpeg, "-v", "error", "-y", "-i", frame, "-frames:v", "1", "-update", "1", dest).Run()
+}
+
+func (b ffmpegBackend) colour(ctx context.Context, colour string) (color.RGBA, error) {
+	// Render a single pixel of the colour, which ffmpeg accepts by name as well as in hex
+	output, err := command(ctx, b.ffmpeg, "-v", "error", "-f", "lavfi", "-i", "color=c="+colour+":s=1x1",
+		"-frames:v", "1", "-f", "rawvideo", "-pix_fmt", "rgb24", "-").Output()
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	if len(output) < 3 {
+		return color.RGBA{}, errors.New("no colour rendered")
+	}
+	return color.RGBA{R: output[0], G: output[1], B: output[2], A: 255}, nil
+}
@@ -0,0 +1,261 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Dependency describes an external program that Interpolate may run.
+type Dependency struct {
+	// Name is the program as it's usually known, and Purpose says what it's used for.
+	Name    string
+	Purpose string
+
+	// Required is set if runs can't go ahead without the program, rather than only some inputs or outputs needing it.
+	Required bool
+
+	// Path is where the program was found, or empty if it wasn't,
+	// and Version is its version, or empty if it couldn't be determined.
+	Path    string
+	Version string
+
+	// Minimum is set to the oldest version that works, at least for some purposes, if Version is older.
+	Minimum string
+}
+
+// minimumVersion is the oldest version of a dependency that works for some purpose.
+type minimumVersion struct {
+	version string
+	// purpose says what needs the version, e.g. "for -lossy", or is empty if everything does
+	purpose string
+}
+
+// minimumVersions holds the oldest version of each dependency known to work, by the name it's known by in Dependencies.
+// Versions that can't be determined are let through, as rife's often can't.
+var minimumVersions = map[string]minimumVersion{
+	// Builds before this don't bundle the v4.6 model, or take -z, which the default -rife-compat passes
+	"rife-ncnn-vulkan": {"20221029", "for -rife-compat v4.6; use -rife-compat generic with older builds"},
+	// Distributions still ship ImageMagick 6, but nothing older than 6.9 is tested
+	"ImageMagick": {"6.9", ""},
+	"gifsicle":    {"1.92", "for -lossy"},
+}
+
+// Dependencies locates each external program Interpolate may run, the same way Interpolate does.
+// ImageMagick is only required if ffmpeg, which can stand in for it, isn't found either.
+func Dependencies(ctx context.Context) []Dependency {
+	dependencies := []Dependency{
+		{Name: "rife-ncnn-vulkan", Purpose: "interpolating frames", Required: true},
+		{Name: "ImageMagick", Purpose: "reading sources other than GIF, APNG, and video, and editing frames (the default -backend)"},
+		{Name: "img2webp", Purpose: "WebP output"},
+		{Name: "ffmpeg", Purpose: "video input, WebM output, and -backend=ffmpeg"},
+		{Name: "ffprobe", Purpose: "video input and -backend=ffmpeg"},
+		{Name: "gifsicle", Purpose: "-optimize with GIF output"},
+		{Name: "APNG optimizer", Purpose: "-optimize with APNG output, as apngopt, oxipng, or zopflipng"},
+		{Name: "Upscaler", Purpose: "-upscale, as realesrgan-ncnn-vulkan or waifu2x-ncnn-vulkan"},
+	}
+
+	for i := range dependencies {
+		d := &dependencies[i]
+		switch d.Name {
+		case "rife-ncnn-vulkan":
+			d.Path, _ = findProgram("rife", "rife-ncnn-vulkan")
+		case "APNG optimizer":
+			d.Path, _ = findProgram(pngOptimizers...)
+		case "Upscaler":
+			d.Path, _ = findProgram(upscalers...)
+		case "ImageMagick":
+			if magick, err := findMagick(ctx); err == nil {
+				d.Path = magick.magick[0]
+			}
+		default:
+			d.Path, _ = findProgram(d.Name)
+		}
+		if d.Path != "" {
+			d.Version = programVersion(ctx, d.Path)
+			if minimum, ok := minimumVersions[d.Name]; ok && d.Version != "" && !versionAtLeast(d.Version, minimum.version) {
+				d.Minimum = minimum.version
+			}
+		}
+	}
+
+	// Either backend will do
+	ffmpegFound := true
+	for _, d := range dependencies {
+		if (d.Name == "ffmpeg" || d.Name == "ffprobe") && d.Path == "" {
+			ffmpegFound = false
+		}
+	}
+	for i := range dependencies {
+		if dependencies[i].Name == "ImageMagick" {
+			dependencies[i].Required = !ffmpegFound
+		}
+	}
+	return dependencies
+}
+
+// InstalledModels lists the RIFE models installed beside the rife executable at path rife, such as rife-v4.6.
+func InstalledModels(rife string) []string {
+	return installedModels(rife)
+}
+
+// dependencies are the programs a run needs, as found by locateDependencies.
+// Programs the run can do without are left empty if they weren't found.
+type dependencies struct {
+	tools  backend
+	rife   string
+	compat rifeCompat
+
+	img2webp, ffmpeg, ffprobe, gifsicle, pngOptimizer, upscaler string
+}
+
+func (d dependencies) versions(ctx context.Context) map[string]string {
+	// Identifies the version of each program located, keyed by the name it's known by in Dependencies,
+	// or for optimizers and upscalers, by their own names. Versions that can't be determined are empty.
+
+	programs := map[string]string{
+		"rife-ncnn-vulkan": d.rife,
+		d.tools.name():     d.tools.program(),
+		"img2webp":         d.img2webp,
+		"ffmpeg":           d.ffmpeg,
+		"ffprobe":          d.ffprobe,
+		"gifsicle":         d.gifsicle,
+	}
+	for _, path := range []string{d.pngOptimizer, d.upscaler} {
+		if path != "" {
+			programs[strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))] = path
+		}
+	}
+
+	versions := make(map[string]string)
+	for name, path := range programs {
+		if path != "" {
+			versions[name] = programVersion(ctx, path)
+		}
+	}
+	return versions
+}
+
+func locateDependencies(ctx context.Context, opts Options, dest string) (dependencies, error) {
+	// Finds the programs needed to interpolate as `opts` asks, writing to `dest`, and the rife build's arguments,
+	// failing with ErrDependencyMissing if any are missing.
+
+	isWebP := strings.ToLower(filepath.Ext(dest)) == ".webp"
+	isWebM := strings.ToLower(filepath.Ext(dest)) == ".webm"
+	isGIF := strings.ToLower(filepath.Ext(dest)) == ".gif"
+
+	var deps dependencies
+	var err error
+	deps.tools, err = findBackend(ctx, opts.Backend)
+	if err != nil {
+		return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	if magick, ok := deps.tools.(magickBackend); ok {
+		if err = checkVersion(ctx, "ImageMagick", magick.program()); err != nil {
+			return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+	deps.rife, err = findProgram("rife", "rife-ncnn-vulkan")
+	if err != nil {
+		return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	if opts.RIFECompat == "v4.6" {
+		if err = checkVersion(ctx, "rife-ncnn-vulkan", deps.rife); err != nil {
+			return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+	deps.compat = rifeCompats[opts.RIFECompat]
+	if opts.TTA != "auto" {
+		deps.compat.tta = opts.TTA
+	}
+	deps.compat.uhd = opts.UHD
+	if opts.Model != "" {
+		if deps.compat.model, err = resolveModel(deps.rife, opts.Model); err != nil {
+			return dependencies{}, fmt.Errorf("error locating RIFE model:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+	deps.img2webp, err = findProgram("img2webp")
+	if err != nil && isWebP {
+		return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	if opts.Optimize && isGIF {
+		if deps.gifsicle, err = findProgram("gifsicle"); err != nil {
+			return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+		if opts.Lossy > 0 {
+			if err = checkVersion(ctx, "gifsicle", deps.gifsicle); err != nil {
+				return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+			}
+		}
+	}
+	// Everything but GIF, WebP, and WebM is assembled as an APNG
+	if opts.Optimize && !isGIF && !isWebP && !isWebM {
+		if deps.pngOptimizer, err = findProgram(pngOptimizers...); err != nil {
+			return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+	isVideoSource := isVideo(opts.Source)
+	deps.ffmpeg, err = findProgram("ffmpeg")
+	if err != nil && (isVideoSource || isWebM) {
+		return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	// Video presets are checked with ffprobe once they're encoded
+	deps.ffprobe, err = findProgram("ffprobe")
+	if err != nil && (isVideoSource || (isWebM && opts.Preset != "")) {
+		return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+
+	if opts.Upscale > 0 {
+		if deps.upscaler, err = findProgram(upscalers...); err != nil {
+			return dependencies{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+
+	return deps, nil
+}
+
+func checkVersion(ctx context.Context, name, program string) error {
+	// Checks that the dependency `name`, found at `program`, is at least its minimum version, if its version can be told.
+
+	minimum := minimumVersions[name]
+	version := programVersion(ctx, program)
+	if version == "" || versionAtLeast(version, minimum.version) {
+		return nil
+	}
+	if minimum.purpose != "" {
+		return fmt.Errorf("%s %s found at %s, but %s or later is required %s.", name, version, program, minimum.version, minimum.purpose)
+	}
+	return fmt.Errorf("%s %s found at %s, but %s or later is required.", name, version, program, minimum.version)
+}
+
+func versionAtLeast(version, minimum string) bool {
+	// Compares versions by their numbers in turn, so 7.1.1-21 is at least 6.9 and 1.92, and build dates compare as one number.
+
+	parts := versionNumbers(version)
+	for i, want := range versionNumbers(minimum) {
+		have := 0
+		if i < len(parts) {
+			have = parts[i]
+		}
+		if have != want {
+			return have > want
+		}
+	}
+	return true
+}
+
+func versionNumbers(version string) []int {
+	// Picks out the numbers in `version`, e.g. [7 1 1 21] from 7.1.1-21.
+
+	var numbers []int
+	for _, field := range strings.FieldsFunc(version, func(r rune) bool { return r < '0' || r > '9' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
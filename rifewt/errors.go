@@ -0,0 +1,115 @@
+package rifewt
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors returned by Interpolate match one of these with errors.Is, according to the cause of the failure,
+// except for invalid Options, cancellation, and failures setting up the temporary directory.
+var (
+	// ErrDependencyMissing means that an external program or RIFE model needed for the run couldn't be found,
+	// or that the program found is older than the run needs.
+	ErrDependencyMissing = errors.New("dependency missing")
+	// ErrOutputExists means that a file the run would write already exists, and overwriting wasn't allowed.
+	ErrOutputExists = errors.New("output exists")
+	// ErrInsufficientSpace means that the temporary directory doesn't have room for the run's frames.
+	ErrInsufficientSpace = errors.New("insufficient space")
+	// ErrExtraction means that reading the source, or splitting it into frames and alpha, failed.
+	ErrExtraction = errors.New("extraction failed")
+	// ErrInterpolation means that rife, the scene detection before it, or the upscaler, failed.
+	ErrInterpolation = errors.New("interpolation failed")
+	// ErrMerge means that reapplying alpha to the interpolated frames, or checking or exporting them, failed.
+	ErrMerge = errors.New("merge failed")
+	// ErrAssembly means that assembling the output, or a downscaled copy of it, failed.
+	ErrAssembly = errors.New("assembly failed")
+)
+
+// stageErrors maps each stage of the pipeline, as in StageTiming, to the error its failures match.
+var stageErrors = map[string]error{
+	"probe":           ErrExtraction,
+	"extraction":      ErrExtraction,
+	"scene detection": ErrInterpolation,
+	"upscaling":       ErrInterpolation,
+	"interpolation":   ErrInterpolation,
+	"merge":           ErrMerge,
+	"assembly":        ErrAssembly,
+	"resizing":        ErrAssembly,
+}
+
+// Error is returned by Interpolate when a stage of the pipeline fails.
+// Its message is that of Err, which says what was being done at the time.
+type Error struct {
+	// Stage names the stage that failed, as in StageTiming.
+	Stage string
+
+	// Command is the external program that failed, with its arguments, and Output is the end of what it wrote to stderr,
+	// if the failure was an external program's. Both are empty otherwise.
+	Command []string
+	Output  string
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error that failures of e.Stage match, such as ErrInterpolation.
+func (e *Error) Is(target error) bool {
+	kind, ok := stageErrors[e.Stage]
+	return ok && target == kind
+}
+
+func stageError(stage string, err error) error {
+	// Wraps `err`, from `stage`, in an Error, filling in the command that failed if one did.
+
+	stageErr := &Error{Stage: stage, Err: err}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		stageErr.Command, stageErr.Output = cmdErr.command, cmdErr.output
+	}
+	return stageErr
+}
+
+// commandError is returned when an external program fails, keeping what it was run with and what it wrote.
+type commandError struct {
+	command []string
+	output  string
+	err     error
+}
+
+func (e *commandError) Error() string {
+	// The exit status alone rarely says what went wrong, so the output follows it
+
+	if e.output == "" {
+		return e.err.Error()
+	}
+	return e.err.Error() + "\n  " + strings.ReplaceAll(e.output, "\n", "\n  ")
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// causedError marks an error as matching cause, such as ErrDependencyMissing, without changing its message.
+type causedError struct {
+	cause error
+	err   error
+}
+
+func (e causedError) Error() string {
+	return e.err.Error()
+}
+
+func (e causedError) Unwrap() error {
+	return e.err
+}
+
+func (e causedError) Is(target error) bool {
+	return target == e.cause
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package rifewt
+
+import "errors"
+
+// FreeSpace returns the number of bytes available on the filesystem holding path,
+// but this system has no way to check, so it always fails.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space can't be checked on this system")
+}
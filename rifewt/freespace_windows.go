@@ -0,0 +1,21 @@
+package rifewt
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// FreeSpace returns the number of bytes available to the current user on the volume holding path.
+func FreeSpace(path string) (uint64, error) {
+	pathPointer, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	ok, _, err := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW").Call(
+		uintptr(unsafe.Pointer(pathPointer)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if ok == 0 {
+		return 0, err
+	}
+	return free, nil
+}
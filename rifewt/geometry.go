@@ -0,0 +1,131 @@
+package rifewt
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+)
+
+func outputGeometry(size image.Point, crop image.Rectangle, scale float64, resize image.Point) (image.Rectangle, image.Point, error) {
+	// Works out the region of frames of `size` to keep, and the size to scale it to, from the `crop`, `scale`, and `resize`
+	// options, any of which may be zero to leave frames alone. `resize` may have a zero dimension, to keep the aspect ratio.
+
+	region := image.Rectangle{Max: size}
+	if !crop.Empty() {
+		if !crop.In(region) {
+			return image.Rectangle{}, image.Point{}, fmt.Errorf("The crop %dx%d+%d+%d doesn't fit within the %dx%d frames.",
+				crop.Dx(), crop.Dy(), crop.Min.X, crop.Min.Y, size.X, size.Y)
+		}
+		region = crop
+	}
+
+	scaled := region.Size()
+	switch {
+	case resize.X > 0 && resize.Y > 0:
+		scaled = resize
+	case resize.X > 0:
+		scaled = image.Pt(resize.X, roundSide(float64(scaled.Y)*float64(resize.X)/float64(scaled.X)))
+	case resize.Y > 0:
+		scaled = image.Pt(roundSide(float64(scaled.X)*float64(resize.Y)/float64(scaled.Y)), resize.Y)
+	case scale > 0:
+		scaled = image.Pt(roundSide(float64(scaled.X)*scale), roundSide(float64(scaled.Y)*scale))
+	}
+	return region, scaled, nil
+}
+
+func roundSide(length float64) int {
+	// Rounds a scaled side length to whole pixels, keeping at least one.
+
+	if rounded := int(math.Round(length)); rounded > 1 {
+		return rounded
+	}
+	return 1
+}
+
+func transformFrame(path string, region image.Rectangle, size image.Point) error {
+	// Crops the frame at path `path`, opaque or grayscale alpha, to `region`, and scales it to `size`, in place.
+	// Whole-number enlargements repeat each pixel, keeping pixel art crisp, while anything else averages
+	// the source pixels each output pixel covers.
+
+	decoded, err := decodePNG(path)
+	if err != nil {
+		return err
+	}
+	if !region.In(decoded.Bounds()) {
+		return fmt.Errorf("%s is %v, too small to crop to %v", filepath.Base(path), decoded.Bounds().Size(), region)
+	}
+
+	var transformed image.Image
+	if gray, ok := decoded.(*image.Gray); ok {
+		cropped := gray.SubImage(region).(*image.Gray)
+		scaled := image.NewGray(image.Rectangle{Max: size})
+		scalePixels(scaled.Pix, size, cropped.Pix, cropped.Stride, region.Size(), 1)
+		transformed = scaled
+	} else {
+		cropped := toRGBA(decoded).SubImage(region).(*image.RGBA)
+		scaled := image.NewRGBA(image.Rectangle{Max: size})
+		scalePixels(scaled.Pix, size, cropped.Pix, cropped.Stride, region.Size(), 4)
+		transformed = scaled
+	}
+	return encodeIntermediate(transformed, path)
+}
+
+// pixelWeight is how much of one source pixel, along one axis, goes into an output pixel.
+type pixelWeight struct {
+	index  int
+	weight float64
+}
+
+func scaleWeights(from, to int) [][]pixelWeight {
+	// Lists the source pixels along an axis of length `from` that each of `to` output pixels covers, and by how much.
+
+	weights := make([][]pixelWeight, to)
+	if to%from == 0 {
+		// Whole-number enlargements copy each source pixel
+		for i := range weights {
+			weights[i] = []pixelWeight{{i * from / to, 1}}
+		}
+		return weights
+	}
+
+	ratio := float64(from) / float64(to)
+	for i := range weights {
+		start, end := float64(i)*ratio, float64(i+1)*ratio
+		for j := int(start); j < from && float64(j) < end; j++ {
+			overlap := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if overlap > 0 {
+				weights[i] = append(weights[i], pixelWeight{j, overlap / ratio})
+			}
+		}
+	}
+	return weights
+}
+
+func scalePixels(dst []uint8, size image.Point, src []uint8, stride int, srcSize image.Point, channels int) {
+	// Scales the `srcSize` pixels in `src`, rows `stride` bytes apart, to the `size` pixels of `dst`,
+	// with `channels` bytes per pixel in both.
+
+	columns, rows := scaleWeights(srcSize.X, size.X), scaleWeights(srcSize.Y, size.Y)
+	sums := make([]float64, channels)
+	for y, rowWeights := range rows {
+		for x, columnWeights := range columns {
+			for c := range sums {
+				sums[c] = 0
+			}
+			for _, row := range rowWeights {
+				for _, column := range columnWeights {
+					weight := row.weight * column.weight
+					offset := row.index*stride + column.index*channels
+					for c := range sums {
+						sums[c] += float64(src[offset+c]) * weight
+					}
+				}
+			}
+			offset := (y*size.X + x) * channels
+			for c, sum := range sums {
+				dst[offset+c] = uint8(math.Min(math.Round(sum), 255))
+			}
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package rifewt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// errNotGIF is returned by readGIFLoops for files that aren't GIFs.
+var errNotGIF = errors.New("not a GIF")
+
+func readGIFLoops(path string) (uint64, error) {
+	// Reads the number of times the GIF at path `path` plays from its NETSCAPE2.0 application extension, or 0 if it loops forever.
+	// Without the extension, a GIF plays once.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	r := bufio.NewReader(file)
+
+	// Header (6 bytes), then the logical screen descriptor (7 bytes), whose packed field says if a global colour table follows
+	var header [13]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil || (!bytes.Equal(header[0:6], []byte("GIF87a")) && !bytes.Equal(header[0:6], []byte("GIF89a"))) {
+		return 0, errNotGIF
+	}
+	if err = skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("truncated GIF: %s", err)
+		}
+
+		switch introducer {
+		case 0x21:
+			label, err := r.ReadByte()
+			if err != nil {
+				return 0, fmt.Errorf("truncated GIF: %s", err)
+			}
+			blocks, err := readGIFSubBlocks(r, label == 0xFF)
+			if err != nil {
+				return 0, err
+			}
+			// The application identifier is followed by a sub-block of 1, then the little-endian loop count
+			if label == 0xFF && len(blocks) >= 2 && string(blocks[0]) == "NETSCAPE2.0" && len(blocks[1]) >= 3 && blocks[1][0] == 1 {
+				repeats := uint64(blocks[1][1]) | uint64(blocks[1][2])<<8
+				if repeats == 0 {
+					return 0, nil
+				}
+				// The count is of repeats, after the first play
+				return repeats + 1, nil
+			}
+		case 0x2C:
+			// Image descriptor (9 bytes) with its own packed field, then the LZW code size, then the image data
+			var descriptor [9]byte
+			if _, err = io.ReadFull(r, descriptor[:]); err != nil {
+				return 0, fmt.Errorf("truncated GIF: %s", err)
+			}
+			if err = skipColorTable(r, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err = r.ReadByte(); err != nil {
+				return 0, fmt.Errorf("truncated GIF: %s", err)
+			}
+			if _, err = readGIFSubBlocks(r, false); err != nil {
+				return 0, err
+			}
+		case 0x3B:
+			// The loop extension must come before the first image, but some encoders put it later,
+			// so only the trailer is conclusive
+			return 1, nil
+		default:
+			return 0, fmt.Errorf("invalid GIF block 0x%02X", introducer)
+		}
+	}
+}
+
+func skipColorTable(r *bufio.Reader, packed byte) error {
+	// Skips the colour table described by the packed field `packed` of a GIF descriptor, if there is one.
+
+	if packed&0x80 == 0 {
+		return nil
+	}
+	if _, err := r.Discard(3 << ((packed & 0x07) + 1)); err != nil {
+		return fmt.Errorf("truncated GIF: %s", err)
+	}
+	return nil
+}
+
+func readGIFSubBlocks(r *bufio.Reader, keep bool) ([][]byte, error) {
+	// Reads a sequence of GIF data sub-blocks, returning their contents if `keep` is set, or otherwise skipping them.
+
+	var blocks [][]byte
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("truncated GIF: %s", err)
+		}
+		if size == 0 {
+			return blocks, nil
+		}
+		if !keep {
+			if _, err = r.Discard(int(size)); err != nil {
+				return nil, fmt.Errorf("truncated GIF: %s", err)
+			}
+			continue
+		}
+		block := make([]byte, size)
+		if _, err = io.ReadFull(r, block); err != nil {
+			return nil, fmt.Errorf("truncated GIF: %s", err)
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func decodeGIF(path string) ([]composedFrame, uint64, error) {
+	// Decodes every frame of the GIF at path `path`, composed onto the full canvas as they would be displayed,
+	// along with the number of times the animation plays, or 0 if it loops forever.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	var signature [6]byte
+	if _, err = io.ReadFull(file, signature[:]); err != nil || (string(signature[:]) != "GIF87a" && string(signature[:]) != "GIF89a") {
+		return nil, 0, errNotGIF
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	animation, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	canvasBounds := image.Rect(0, 0, animation.Config.Width, animation.Config.Height)
+	canvas := image.NewNRGBA(canvasBounds)
+	frames := make([]composedFrame, 0, len(animation.Image))
+	for i, frameImage := range animation.Image {
+		bounds := frameImage.Bounds().Intersect(canvasBounds)
+
+		var disposal byte
+		if i < len(animation.Disposal) {
+			disposal = animation.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewNRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		// Transparent pixels leave what's underneath showing
+		draw.Draw(canvas, bounds, frameImage, bounds.Min, draw.Over)
+
+		composed := image.NewNRGBA(canvasBounds)
+		copy(composed.Pix, canvas.Pix)
+		var frameDelay Delay
+		if i < len(animation.Delay) && animation.Delay[i] > 0 {
+			frameDelay = Delay{uint64(animation.Delay[i]), 100}
+		}
+		frames = append(frames, composedFrame{image: composed, delay: frameDelay})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// Browsers clear to transparency rather than the background colour, and so do most GIF tools
+			draw.Draw(canvas, bounds, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, bounds, previous, bounds.Min, draw.Src)
+		}
+	}
+
+	// image/gif counts repeats after the first play, with -1 for none
+	switch {
+	case animation.LoopCount == 0:
+		return frames, 0, nil
+	case animation.LoopCount < 0:
+		return frames, 1, nil
+	default:
+		return frames, uint64(animation.LoopCount) + 1, nil
+	}
+}
+
+func writeGIF(ctx context.Context, dest string, framePaths []string, delays []Delay, loops uint64, alphaThreshold uint8, progress func(done uint64)) error {
+	// Encodes the PNG frames at `framePaths` into a GIF at path `dest`, each lasting roughly the corresponding entry of `delays`,
+	// except for those dropped by gifDelays, playing `loops` times, or forever if 0. Each frame gets its own palette of up to 255 colours,
+	// plus one fully transparent entry, as GIF can't store partial transparency; pixels with less than `alphaThreshold` alpha use it.
+	// If set, `progress` is called with the number of frames quantized after each one.
+
+	// Frames too short to show are dropped, and count as done from the start
+	centiseconds := gifDelays(delays)
+	var shownPaths []string
+	var shownDelays []int
+	for i, path := range framePaths {
+		if centiseconds[i] > 0 {
+			shownPaths = append(shownPaths, path)
+			shownDelays = append(shownDelays, centiseconds[i])
+		}
+	}
+	framePaths = shownPaths
+
+	frames := make([]*image.Paletted, len(framePaths))
+	var progressLock sync.Mutex
+	quantized := uint64(len(centiseconds) - len(shownPaths))
+	errChannel := make(chan error)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// As when merging, each frame takes a slot like an external program, to stay within the job limit
+	for i, path := range framePaths {
+		go func(i int, path string, result chan error) {
+			release, localErr := acquire(ctx)
+			if localErr != nil {
+				result <- localErr
+				return
+			}
+			defer release()
+
+			decoded, localErr := decodePNG(path)
+			if localErr != nil {
+				result <- localErr
+				return
+			}
+			frames[i] = quantize(toNRGBA(decoded), alphaThreshold)
+			if progress != nil {
+				progressLock.Lock()
+				quantized++
+				progress(quantized)
+				progressLock.Unlock()
+			}
+			result <- nil
+		}(i, path, errChannel)
+	}
+	if err := coalesce(uint64(len(framePaths)), errChannel, cancel); err != nil {
+		return err
+	}
+	close(errChannel)
+
+	animation := &gif.GIF{
+		Image:    frames,
+		Delay:    shownDelays,
+		Disposal: make([]byte, len(frames)),
+	}
+	for i, frame := range frames {
+		if frame.Bounds() != frames[0].Bounds() {
+			return fmt.Errorf("%s is %v, but the first frame is %v", filepath.Base(framePaths[i]), frame.Bounds().Size(), frames[0].Bounds().Size())
+		}
+		// Every frame covers the whole canvas, so clear it between frames to keep transparent areas transparent
+		animation.Disposal[i] = gif.DisposalBackground
+	}
+
+	// image/gif counts repeats after the first play, with -1 for none
+	switch loops {
+	case 0:
+		animation.LoopCount = 0
+	case 1:
+		animation.LoopCount = -1
+	default:
+		animation.LoopCount = int(loops - 1)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	w := bufio.NewWriter(file)
+	if err = gif.EncodeAll(w, animation); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func gifFrameCount(delays []Delay) uint64 {
+	// Counts the frames with `delays` that a GIF shows, without those gifDelays drops.
+
+	var count uint64
+	for _, centiseconds := range gifDelays(delays) {
+		if centiseconds > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func gifDelays(delays []Delay) []int {
+	// Converts `delays` to GIF's whole centiseconds.
+	// Browsers slow down frames shorter than 2 centiseconds to 10, so no frame is made shorter than 2.
+	// Frames that would be are dropped, left at 0, with their time going to the next frame shown,
+	// or for the last frame, the one before it, so high frame rates play at their own speed with fewer frames.
+
+	// Round the running total rather than each delay, so rounding errors don't accumulate
+	centiseconds := make([]int, len(delays))
+	var elapsed float64
+	var elapsedCentiseconds int
+	lastShown := -1
+	for i, d := range delays {
+		elapsed += d.seconds() * 100
+		delay := int(math.Round(elapsed)) - elapsedCentiseconds
+		switch {
+		case delay >= 2:
+			centiseconds[i] = delay
+			lastShown = i
+		case i < len(delays)-1:
+			continue
+		case lastShown >= 0:
+			centiseconds[lastShown] += delay
+		default:
+			// Frames too short to show even together are shown for as short a time as they can be
+			centiseconds[i] = 2
+		}
+		elapsedCentiseconds += delay
+	}
+	return centiseconds
+}
+
+// gifColour is a colour appearing in a frame, with the number of pixels using it.
+type gifColour struct {
+	rgb   [3]uint8
+	count int
+}
+
+func quantize(frame *image.NRGBA, alphaThreshold uint8) *image.Paletted {
+	// Reduces `frame` to a palette of at most 255 colours chosen by median cut, plus a transparent colour at index 0.
+	// Pixels with at least `alphaThreshold` alpha become fully opaque, and the rest fully transparent.
+
+	counts := make(map[[3]uint8]int)
+	bounds := frame.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := frame.Pix[frame.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			if pixel := row[x*4 : x*4+4]; pixel[3] >= alphaThreshold {
+				counts[[3]uint8{pixel[0], pixel[1], pixel[2]}]++
+			}
+		}
+	}
+	colours := make([]gifColour, 0, len(counts))
+	for rgb, count := range counts {
+		colours = append(colours, gifColour{rgb, count})
+	}
+
+	palette := color.Palette{color.RGBA{}}
+	for _, box := range medianCut(colours, 255) {
+		var sums [3]int
+		var total int
+		for _, c := range box {
+			for channel := range sums {
+				sums[channel] += int(c.rgb[channel]) * c.count
+			}
+			total += c.count
+		}
+		palette = append(palette, color.RGBA{uint8(sums[0] / total), uint8(sums[1] / total), uint8(sums[2] / total), 0xFF})
+	}
+
+	// Frames tend to reuse few colours many times, so only search the palette once per colour
+	nearest := make(map[[3]uint8]uint8, len(counts))
+	quantized := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := frame.Pix[frame.PixOffset(bounds.Min.X, y):]
+		quantizedRow := quantized.Pix[quantized.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			pixel := row[x*4 : x*4+4]
+			if pixel[3] < alphaThreshold {
+				continue
+			}
+			rgb := [3]uint8{pixel[0], pixel[1], pixel[2]}
+			index, ok := nearest[rgb]
+			if !ok {
+				index = uint8(palette[1:].Index(color.RGBA{rgb[0], rgb[1], rgb[2], 0xFF}) + 1)
+				nearest[rgb] = index
+			}
+			quantizedRow[x] = index
+		}
+	}
+	return quantized
+}
+
+func medianCut(colours []gifColour, limit int) [][]gifColour {
+	// Splits `colours` into at most `limit` groups of similar colours, each to be represented by its average.
+	// The group spanning the widest range along any channel is repeatedly split at its median pixel along that channel.
+
+	if len(colours) == 0 {
+		return nil
+	}
+	boxes := [][]gifColour{colours}
+	for len(boxes) < limit {
+		widest, widestChannel, widestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for channel := 0; channel < 3; channel++ {
+				low, high := box[0].rgb[channel], box[0].rgb[channel]
+				for _, c := range box[1:] {
+					if c.rgb[channel] < low {
+						low = c.rgb[channel]
+					}
+					if c.rgb[channel] > high {
+						high = c.rgb[channel]
+					}
+				}
+				if int(high-low) > widestRange {
+					widest, widestChannel, widestRange = i, channel, int(high-low)
+				}
+			}
+		}
+		if widest < 0 {
+			// Every colour already has a group of its own
+			break
+		}
+
+		box := boxes[widest]
+		sort.Slice(box, func(i, j int) bool { return box[i].rgb[widestChannel] < box[j].rgb[widestChannel] })
+		var total int
+		for _, c := range box {
+			total += c.count
+		}
+		// Split after the median pixel, keeping at least one colour on each side
+		split, seen := 1, box[0].count
+		for split < len(box)-1 && seen < total/2 {
+			seen += box[split].count
+			split++
+		}
+		boxes[widest] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+	return boxes
+}
@@ -0,0 +1,175 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func repeatedDelays(delay Delay, count int) []Delay {
+	delays := make([]Delay, count)
+	for i := range delays {
+		delays[i] = delay
+	}
+	return delays
+}
+
+func TestGIFDelays(t *testing.T) {
+	tests := []struct {
+		name   string
+		delays []Delay
+		want   []int
+	}{
+		{"whole centiseconds", []Delay{{1, 10}, {7, 100}, {1, 2}}, []int{10, 7, 50}},
+		// 3⅓ centiseconds each, rounded as a running total so the thirds add up
+		{"running total", repeatedDelays(Delay{1, 30}, 6), []int{3, 4, 3, 3, 4, 3}},
+		{"running total of uneven delays", []Delay{{1, 40}, {1, 40}, {1, 40}, {1, 40}}, []int{3, 2, 3, 2}},
+		// At 200fps, only every fourth frame can be shown, for 2 centiseconds each
+		{"too short to show", repeatedDelays(Delay{1, 200}, 8), []int{0, 0, 2, 0, 0, 0, 2, 0}},
+		// 50fps at -x 4 gives frames of half a centisecond, which would otherwise play 4× slow
+		{"dropped in between", []Delay{{1, 20}, {1, 200}, {1, 200}, {1, 200}, {1, 200}, {1, 20}}, []int{5, 0, 0, 2, 0, 5}},
+		{"short last frame", []Delay{{3, 100}, {1, 100}}, []int{4, 0}},
+		{"single short frame", []Delay{{1, 100}}, []int{2}},
+		{"none", nil, []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := gifDelays(test.delays)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("gifDelays(%v) = %v, want %v", test.delays, got, test.want)
+			}
+			if count := gifFrameCount(test.delays); count != uint64(len(test.want))-uint64(countZeros(test.want)) {
+				t.Errorf("gifFrameCount(%v) = %d, want the %d frames gifDelays keeps", test.delays, count, len(test.want)-countZeros(test.want))
+			}
+		})
+	}
+}
+
+func countZeros(values []int) int {
+	zeros := 0
+	for _, value := range values {
+		if value == 0 {
+			zeros++
+		}
+	}
+	return zeros
+}
+
+func TestWriteGIFDropsShortFrames(t *testing.T) {
+	// Frames too short for GIF are left out, keeping the animation's length.
+
+	dir := t.TempDir()
+	paths := make([]string, 8)
+	for i := range paths {
+		frame := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		frame.SetNRGBA(i%4, i/4, color.NRGBA{0xFF, 0, 0, 0xFF})
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%d.png", i+1))
+		writeTestPNG(t, paths[i], frame)
+	}
+	dest := filepath.Join(dir, "animation.gif")
+	var progress uint64
+	if err := writeGIF(context.Background(), dest, paths, repeatedDelays(Delay{1, 200}, 8), 0, 128, func(done uint64) { progress = done }); err != nil {
+		t.Fatal(err)
+	}
+	if progress != 8 {
+		t.Errorf("progress reached %d of 8 frames", progress)
+	}
+
+	file, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	animation, err := gif.DecodeAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(animation.Delay, []int{2, 2}) {
+		t.Errorf("GIF has delays %v, want [2 2]", animation.Delay)
+	}
+	// The frames shown are the third and seventh, each with a single red pixel
+	for i, pixel := range []image.Point{{2, 0}, {2, 1}} {
+		if index := animation.Image[i].ColorIndexAt(pixel.X, pixel.Y); index == 0 {
+			t.Errorf("frame %d: pixel %v is transparent, want red", i, pixel)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	frame := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	frame.SetNRGBA(0, 0, color.NRGBA{0xFF, 0, 0, 0xFF})
+	// Either side of the default alpha threshold of 128
+	frame.SetNRGBA(1, 0, color.NRGBA{0, 0xFF, 0, 127})
+	frame.SetNRGBA(2, 0, color.NRGBA{0, 0, 0xFF, 128})
+	frame.SetNRGBA(3, 0, color.NRGBA{0xFF, 0xFF, 0xFF, 0})
+
+	tests := []struct {
+		threshold uint8
+		// visible lists which pixels should be opaque, and the rest transparent
+		visible []bool
+	}{
+		{128, []bool{true, false, true, false}},
+		{129, []bool{true, false, false, false}},
+		{127, []bool{true, true, true, false}},
+		{1, []bool{true, true, true, false}},
+		{255, []bool{true, false, false, false}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("threshold %d", test.threshold), func(t *testing.T) {
+			quantized := quantize(frame, test.threshold)
+			if len(quantized.Palette) > 256 {
+				t.Fatalf("palette has %d colours", len(quantized.Palette))
+			}
+			if _, _, _, a := quantized.Palette[0].RGBA(); a != 0 {
+				t.Fatalf("palette index 0 isn't transparent")
+			}
+			for x, visible := range test.visible {
+				index := quantized.ColorIndexAt(x, 0)
+				if (index != 0) != visible {
+					t.Errorf("pixel %d: palette index %d, want visible %v", x, index, visible)
+					continue
+				}
+				if !visible {
+					continue
+				}
+				// With so few colours, each keeps its own, fully opaque
+				want := frame.NRGBAAt(x, 0)
+				want.A = 0xFF
+				if got := color.NRGBAModel.Convert(quantized.Palette[index]); got != want {
+					t.Errorf("pixel %d: colour %v, want %v", x, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantizeManyColours(t *testing.T) {
+	// Frames with more colours than fit are reduced to 255, plus the transparent one.
+
+	frame := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			frame.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8((x + y) * 2), 0xFF})
+		}
+	}
+	quantized := quantize(frame, 128)
+	if len(quantized.Palette) != 256 {
+		t.Errorf("palette has %d colours, want 256", len(quantized.Palette))
+	}
+	for i, c := range quantized.Palette[1:] {
+		if _, _, _, a := c.RGBA(); a != 0xFFFF {
+			t.Errorf("palette index %d isn't opaque", i+1)
+		}
+	}
+	for _, index := range quantized.Pix {
+		if index == 0 {
+			t.Fatal("an opaque pixel was made transparent")
+		}
+	}
+}
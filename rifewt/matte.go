@@ -0,0 +1,97 @@
+package rifewt
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+)
+
+// defaultMatte is the matte colour used when none is given, and when "auto" finds no edges to sample.
+const defaultMatte = "#36393F"
+
+// matteSamples is the most frames sampled by autoMatte, spread evenly through the animation.
+const matteSamples = 16
+
+func autoMatte(frames []*image.NRGBA) (color.RGBA, bool) {
+	// Averages the colour of the visible pixels bordering fully transparent ones across `frames`, weighted by their alpha,
+	// which is the colour interpolation blends the matte with, so a matte close to it leaves the least fringing.
+	// Returns false if no frame has any such edges.
+
+	var r, g, b, total uint64
+	for _, frame := range frames {
+		bounds := frame.Bounds()
+		transparent := func(x, y int) bool {
+			return image.Pt(x, y).In(bounds) && frame.Pix[frame.PixOffset(x, y)+3] == 0
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := frame.PixOffset(x, y)
+				a := uint64(frame.Pix[i+3])
+				if a == 0 || !(transparent(x-1, y) || transparent(x+1, y) || transparent(x, y-1) || transparent(x, y+1)) {
+					continue
+				}
+				r += uint64(frame.Pix[i]) * a
+				g += uint64(frame.Pix[i+1]) * a
+				b += uint64(frame.Pix[i+2]) * a
+				total += a
+			}
+		}
+	}
+	if total == 0 {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{uint8((r + total/2) / total), uint8((g + total/2) / total), uint8((b + total/2) / total), 255}, true
+}
+
+func matteFrames(source, sourceDir string, composedFrames []composedFrame) []*image.NRGBA {
+	// Gathers up to matteSamples frames of the source to choose a matte from: frames already decoded, or extracted into
+	// `sourceDir`, or otherwise the first frame of the source, if it's in a format Go can decode.
+
+	if len(composedFrames) > 0 {
+		frames := make([]*image.NRGBA, 0, matteSamples)
+		for _, i := range sampleIndices(len(composedFrames), matteSamples) {
+			frames = append(frames, composedFrames[i].image)
+		}
+		return frames
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(sourceDir, "*.png")); len(paths) > 0 {
+		var frames []*image.NRGBA
+		for _, i := range sampleIndices(len(paths), matteSamples) {
+			if decoded, err := decodePNG(paths[i]); err == nil {
+				frames = append(frames, toNRGBA(decoded))
+			}
+		}
+		return frames
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	decoded, _, err := image.Decode(file)
+	if err != nil {
+		return nil
+	}
+	return []*image.NRGBA{toNRGBA(decoded)}
+}
+
+func sampleIndices(count, samples int) []int {
+	// Spreads up to `samples` indices evenly through `count` items, starting with the first.
+
+	if count <= samples {
+		samples = count
+	}
+	indices := make([]int, samples)
+	for i := range indices {
+		indices[i] = i * count / samples
+	}
+	return indices
+}
+
+func hexColour(c color.RGBA) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
@@ -0,0 +1,461 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// intermediateEncoder writes frames that are only read back by the rest of the pipeline,
+// so it favours speed over size.
+var intermediateEncoder = png.Encoder{CompressionLevel: png.BestSpeed}
+
+func mergeFrame(framePath, alphaPath, mergedPath string, matte color.RGBA, fuzz, decontaminate float64, backdrop *image.RGBA) error {
+	// Applies the grayscale alpha frame at path `alphaPath` to the opaque frame at path `framePath`, saving the result at path `mergedPath`.
+	// With a nonzero `fuzz`, pixels within that percentage of the `matte` colour are also made transparent, measured as
+	// ImageMagick does, by distance in RGB space. With a nonzero `decontaminate`, that fraction of the matte colour blended
+	// into semi-transparent pixels by interpolation is taken back out. If `backdrop` is set, the result is then composited
+	// over it, leaving an opaque frame.
+
+	frameImage, err := decodePNG(framePath)
+	if err != nil {
+		return err
+	}
+	alphaImage, err := decodePNG(alphaPath)
+	if err != nil {
+		return err
+	}
+	if frameImage.Bounds().Size() != alphaImage.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but its alpha is %v", framePath, frameImage.Bounds().Size(), alphaImage.Bounds().Size())
+	}
+	frame, alpha := toRGBA(frameImage), toGray(alphaImage)
+	if backdrop != nil && backdrop.Bounds().Size() != frame.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but the backdrop is %v", framePath, frame.Bounds().Size(), backdrop.Bounds().Size())
+	}
+
+	// Compare squared distances, in 8-bit units
+	fuzzDistance := fuzz / 100 * 255
+	fuzzDistance *= fuzzDistance
+
+	bounds := frame.Bounds()
+	merged := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		frameRow := frame.Pix[y*frame.Stride : y*frame.Stride+4*bounds.Dx()]
+		alphaRow := alpha.Pix[y*alpha.Stride : y*alpha.Stride+bounds.Dx()]
+		mergedRow := merged.Pix[y*merged.Stride : y*merged.Stride+4*bounds.Dx()]
+		for x, a := range alphaRow {
+			r, g, b := frameRow[4*x], frameRow[4*x+1], frameRow[4*x+2]
+			if fuzz > 0 {
+				dr, dg, db := float64(r)-float64(matte.R), float64(g)-float64(matte.G), float64(b)-float64(matte.B)
+				if dr*dr+dg*dg+db*db <= fuzzDistance {
+					a = 0
+				}
+			}
+			if decontaminate > 0 && a > 0 && a < 255 {
+				r, g, b = unblend(r, matte.R, a, decontaminate), unblend(g, matte.G, a, decontaminate), unblend(b, matte.B, a, decontaminate)
+			}
+			mergedRow[4*x], mergedRow[4*x+1], mergedRow[4*x+2], mergedRow[4*x+3] = r, g, b, a
+		}
+	}
+
+	// Opaque images are written without an alpha channel
+	return encodeIntermediate(flattenOnto(merged, backdrop), mergedPath)
+}
+
+func unblend(mixed, background, alpha uint8, strength float64) uint8 {
+	// Moves `mixed`, taken to be a foreground colour blended over `background` by `alpha`, `strength` (0 to 1) of the way
+	// back to that foreground colour, clamping where the blend can't be undone exactly.
+
+	a := float64(alpha) / 255
+	foreground := (float64(mixed) - float64(background)*(1-a)) / a
+	unblended := math.Round(float64(mixed) + strength*(foreground-float64(mixed)))
+	return uint8(math.Max(0, math.Min(255, unblended)))
+}
+
+func splitDualMattes(framePath, alphaPath, blackPath, whitePath string) error {
+	// Composites the opaque frame at path `framePath` with the grayscale alpha frame at path `alphaPath`
+	// over black, saving it at path `blackPath`, and over white, saving it at path `whitePath`.
+	// Either may be one of the frames read.
+
+	frameImage, err := decodePNG(framePath)
+	if err != nil {
+		return err
+	}
+	alphaImage, err := decodePNG(alphaPath)
+	if err != nil {
+		return err
+	}
+	if frameImage.Bounds().Size() != alphaImage.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but its alpha is %v", framePath, frameImage.Bounds().Size(), alphaImage.Bounds().Size())
+	}
+	frame, alpha := toRGBA(frameImage), toGray(alphaImage)
+
+	bounds := frame.Bounds()
+	black := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	white := image.NewRGBA(black.Rect)
+	for y := 0; y < bounds.Dy(); y++ {
+		frameRow := frame.Pix[y*frame.Stride : y*frame.Stride+4*bounds.Dx()]
+		alphaRow := alpha.Pix[y*alpha.Stride : y*alpha.Stride+bounds.Dx()]
+		blackRow := black.Pix[y*black.Stride : y*black.Stride+4*bounds.Dx()]
+		whiteRow := white.Pix[y*white.Stride : y*white.Stride+4*bounds.Dx()]
+		for x, a := range alphaRow {
+			for c := 0; c < 3; c++ {
+				blackRow[4*x+c] = blend(frameRow[4*x+c], 0, a)
+				whiteRow[4*x+c] = blend(frameRow[4*x+c], 255, a)
+			}
+			blackRow[4*x+3], whiteRow[4*x+3] = 255, 255
+		}
+	}
+
+	if err = encodeIntermediate(black, blackPath); err != nil {
+		return err
+	}
+	return encodeIntermediate(white, whitePath)
+}
+
+func unmatteFrame(blackPath, whitePath, mergedPath string, backdrop *image.RGBA) error {
+	// Recovers the colour and alpha of a frame from its composites over black, at path `blackPath`, and over white,
+	// at path `whitePath`, saving the result at path `mergedPath`, composited over `backdrop` if it's set.
+	// The white composite is lighter than the black by 255 - alpha in every channel, and the black composite
+	// is the colour premultiplied by alpha.
+
+	blackImage, err := decodePNG(blackPath)
+	if err != nil {
+		return err
+	}
+	whiteImage, err := decodePNG(whitePath)
+	if err != nil {
+		return err
+	}
+	if blackImage.Bounds().Size() != whiteImage.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but %s is %v", filepath.Base(blackPath), blackImage.Bounds().Size(), filepath.Base(whitePath), whiteImage.Bounds().Size())
+	}
+	black, white := toRGBA(blackImage), toRGBA(whiteImage)
+	if backdrop != nil && backdrop.Bounds().Size() != black.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but the backdrop is %v", filepath.Base(blackPath), black.Bounds().Size(), backdrop.Bounds().Size())
+	}
+
+	bounds := black.Bounds()
+	merged := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		blackRow := black.Pix[y*black.Stride : y*black.Stride+4*bounds.Dx()]
+		whiteRow := white.Pix[y*white.Stride : y*white.Stride+4*bounds.Dx()]
+		mergedRow := merged.Pix[y*merged.Stride : y*merged.Stride+4*bounds.Dx()]
+		for x := 0; x < bounds.Dx(); x++ {
+			// Interpolation can leave the composites slightly out of step, so the channels' differences are averaged
+			difference := 0
+			for c := 0; c < 3; c++ {
+				difference += int(whiteRow[4*x+c]) - int(blackRow[4*x+c])
+			}
+			alpha := 255 - (difference+1)/3
+			if alpha <= 0 {
+				continue
+			}
+			if alpha > 255 {
+				alpha = 255
+			}
+			for c := 0; c < 3; c++ {
+				colour := (int(blackRow[4*x+c])*255 + alpha/2) / alpha
+				if colour > 255 {
+					colour = 255
+				}
+				mergedRow[4*x+c] = uint8(colour)
+			}
+			mergedRow[4*x+3] = uint8(alpha)
+		}
+	}
+
+	return encodeIntermediate(flattenOnto(merged, backdrop), mergedPath)
+}
+
+func flattenOnto(frame *image.NRGBA, backdrop *image.RGBA) image.Image {
+	// Composites `frame` over `backdrop`, which must be the same size, returning `frame` itself if `backdrop` is nil.
+
+	if backdrop == nil {
+		return frame
+	}
+	flattened := image.NewRGBA(frame.Rect)
+	for i := 0; i < len(frame.Pix); i += 4 {
+		a := frame.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			flattened.Pix[i+c] = blend(frame.Pix[i+c], backdrop.Pix[i+c], a)
+		}
+		flattened.Pix[i+3] = 255
+	}
+	return flattened
+}
+
+func loadBackdrop(ctx context.Context, b backend, backdrop string, size image.Point) (*image.RGBA, error) {
+	// Produces a backdrop of `size` to flatten frames onto from `backdrop`, which is either the path of an image,
+	// scaled to cover it and cropped to the middle, or a colour.
+
+	flat := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	if _, err := os.Stat(backdrop); err != nil {
+		colour, err := resolveColour(ctx, b, backdrop)
+		if err != nil {
+			return nil, err
+		}
+		draw.Draw(flat, flat.Rect, image.NewUniform(colour), image.Point{}, draw.Src)
+		return flat, nil
+	}
+
+	file, err := os.Open(backdrop)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	decoded, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sample the image at whichever scale makes it just cover the frame
+	bounds := decoded.Bounds()
+	scale := math.Max(float64(size.X)/float64(bounds.Dx()), float64(size.Y)/float64(bounds.Dy()))
+	offsetX := (float64(bounds.Dx())*scale - float64(size.X)) / 2
+	offsetY := (float64(bounds.Dy())*scale - float64(size.Y)) / 2
+	for y := 0; y < size.Y; y++ {
+		sourceY := bounds.Min.Y + int((float64(y)+offsetY+0.5)/scale)
+		for x := 0; x < size.X; x++ {
+			sourceX := bounds.Min.X + int((float64(x)+offsetX+0.5)/scale)
+			flat.Set(x, y, decoded.At(sourceX, sourceY))
+		}
+	}
+	// Any transparency in the image is dropped, as the result has to be opaque
+	for i := 3; i < len(flat.Pix); i += 4 {
+		flat.Pix[i] = 255
+	}
+	return flat, nil
+}
+
+func blend(foreground, background, alpha uint8) uint8 {
+	return uint8((uint32(foreground)*uint32(alpha) + uint32(background)*uint32(255-alpha) + 127) / 255)
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+func keyFrame(framePath, alphaPath string, key, matte color.RGBA, tolerance float64) error {
+	// Makes the pixels of the opaque frame at path `framePath` within `tolerance` percent of the `key` colour transparent,
+	// in the grayscale alpha frame at path `alphaPath`, fading back to the existing alpha at twice that distance.
+	// Distance is measured as for -fuzz. Fully keyed pixels take on the `matte` colour in the frame, as in any other.
+
+	frameImage, err := decodePNG(framePath)
+	if err != nil {
+		return err
+	}
+	alphaImage, err := decodePNG(alphaPath)
+	if err != nil {
+		return err
+	}
+	if frameImage.Bounds().Size() != alphaImage.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but its alpha is %v", framePath, frameImage.Bounds().Size(), alphaImage.Bounds().Size())
+	}
+	frame, alpha := toRGBA(frameImage), toGray(alphaImage)
+
+	inner := tolerance / 100 * 255
+	bounds := frame.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		frameRow := frame.Pix[y*frame.Stride : y*frame.Stride+4*bounds.Dx()]
+		alphaRow := alpha.Pix[y*alpha.Stride : y*alpha.Stride+bounds.Dx()]
+		for x, a := range alphaRow {
+			pixel := frameRow[4*x : 4*x+3]
+			dr, dg, db := float64(pixel[0])-float64(key.R), float64(pixel[1])-float64(key.G), float64(pixel[2])-float64(key.B)
+			distance := math.Sqrt(dr*dr + dg*dg + db*db)
+			switch {
+			case distance <= inner:
+				alphaRow[x] = 0
+				pixel[0], pixel[1], pixel[2] = matte.R, matte.G, matte.B
+			case distance < 2*inner:
+				alphaRow[x] = uint8(math.Round(float64(a) * (distance - inner) / inner))
+			}
+		}
+	}
+
+	if err = encodeIntermediate(frame, framePath); err != nil {
+		return err
+	}
+	return encodeIntermediate(alpha, alphaPath)
+}
+
+func allOpaque(dir string) (bool, error) {
+	// Reports whether every pixel of every grayscale alpha frame in `dir` is fully opaque.
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		alphaImage, err := decodePNG(path)
+		if err != nil {
+			return false, err
+		}
+		for _, a := range toGray(alphaImage).Pix {
+			if a != 255 {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func toGray(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok {
+		return gray
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return gray
+}
+
+func splitFrame(frame *image.NRGBA, framePath, alphaPath string, matte color.RGBA, flatten bool) error {
+	// Splits `frame` into an opaque frame at path `framePath` and a grayscale alpha frame at path `alphaPath`,
+	// as ImageMagick does for sources it reads. Fully transparent pixels take on the `matte` colour,
+	// or with `flatten` set, every pixel is blended over it, and no alpha frame is written.
+
+	bounds := frame.Bounds()
+	opaque := image.NewRGBA(bounds)
+	alpha := image.NewGray(bounds)
+	for y := 0; y < bounds.Dy(); y++ {
+		frameRow := frame.Pix[y*frame.Stride : y*frame.Stride+4*bounds.Dx()]
+		opaqueRow := opaque.Pix[y*opaque.Stride : y*opaque.Stride+4*bounds.Dx()]
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, a := frameRow[4*x], frameRow[4*x+1], frameRow[4*x+2], frameRow[4*x+3]
+			switch {
+			case flatten:
+				r, g, b = blend(r, matte.R, a), blend(g, matte.G, a), blend(b, matte.B, a)
+			case a == 0:
+				r, g, b = matte.R, matte.G, matte.B
+			}
+			opaqueRow[4*x], opaqueRow[4*x+1], opaqueRow[4*x+2], opaqueRow[4*x+3] = r, g, b, 255
+			alpha.Pix[y*alpha.Stride+x] = a
+		}
+	}
+
+	if err := encodeIntermediate(opaque, framePath); err != nil {
+		return err
+	}
+	if flatten {
+		return nil
+	}
+	return encodeIntermediate(alpha, alphaPath)
+}
+
+func splitFrameFiles(ctx context.Context, paths []string, frameDir, alphaDir, paddingSpecifier string, matte color.RGBA, flatten bool) error {
+	// Splits each of the PNG frames at `paths` with splitFrame, numbering them from 0 by `paddingSpecifier`.
+
+	errChannel := make(chan error)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// As when merging, each frame takes a slot like an external program, to stay within the job limit
+	for i, path := range paths {
+		go func(i int, path string, result chan error) {
+			release, localErr := acquire(ctx)
+			if localErr != nil {
+				result <- localErr
+				return
+			}
+			defer release()
+
+			decoded, localErr := decodePNG(path)
+			if localErr != nil {
+				result <- fmt.Errorf("error extracting frames from source:\n  %w", localErr)
+				return
+			}
+			name := fmt.Sprintf(paddingSpecifier, i)
+			if localErr = splitFrame(toNRGBA(decoded), filepath.Join(frameDir, name), filepath.Join(alphaDir, name), matte, flatten); localErr != nil {
+				result <- fmt.Errorf("error extracting frames from source:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(i, path, errChannel)
+	}
+
+	if err := coalesce(uint64(len(paths)), errChannel, cancel); err != nil {
+		return err
+	}
+	close(errChannel)
+	return nil
+}
+
+func blendFrames(from, to, dest string, weight float64) error {
+	// Writes the blend of the opaque or grayscale frame at path `from` with `weight` (0 to 1) of the frame at path `to` over it
+	// to path `dest`, as the same kind of frame as `from`.
+
+	fromImage, err := decodePNG(from)
+	if err != nil {
+		return err
+	}
+	toImage, err := decodePNG(to)
+	if err != nil {
+		return err
+	}
+	if fromImage.Bounds().Size() != toImage.Bounds().Size() {
+		return fmt.Errorf("%s is %v, but %s is %v", filepath.Base(from), fromImage.Bounds().Size(), filepath.Base(to), toImage.Bounds().Size())
+	}
+
+	alpha := uint8(math.Round(weight * 255))
+	if fromGray, ok := fromImage.(*image.Gray); ok {
+		toGray := toGray(toImage)
+		blended := image.NewGray(fromGray.Rect)
+		for i := range blended.Pix {
+			blended.Pix[i] = blend(toGray.Pix[i], fromGray.Pix[i], alpha)
+		}
+		return encodeIntermediate(blended, dest)
+	}
+
+	fromRGBA, toRGBA := toRGBA(fromImage), toRGBA(toImage)
+	blended := image.NewRGBA(fromRGBA.Rect)
+	for i := range blended.Pix {
+		blended.Pix[i] = blend(toRGBA.Pix[i], fromRGBA.Pix[i], alpha)
+	}
+	return encodeIntermediate(blended, dest)
+}
+
+func encodeIntermediate(img image.Image, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = intermediateEncoder.Encode(file, img); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func parseHexColour(colour string) (color.RGBA, bool) {
+	// Parses `colour` as #RGB, #RRGGBB, or #RRGGBBAA, ignoring any alpha.
+
+	digits := strings.TrimPrefix(colour, "#")
+	if len(digits) == len(colour) {
+		return color.RGBA{}, false
+	}
+	if len(digits) == 3 {
+		digits = string([]byte{digits[0], digits[0], digits[1], digits[1], digits[2], digits[2]})
+	}
+	if len(digits) != 6 && len(digits) != 8 {
+		return color.RGBA{}, false
+	}
+	value, err := strconv.ParseUint(digits[:6], 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 255}, true
+}
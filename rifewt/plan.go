@@ -0,0 +1,350 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Plan describes what Interpolate would do with a set of options, as worked out by PlanInterpolation.
+type Plan struct {
+	// Dest is where the output would be saved, which Options.Preset may change the extension of.
+	Dest string
+
+	// SourceFrames is the number of frames in the source, RIFEFrames the number rife would produce for each stream,
+	// and OutputFrames the number the output would have. Frames collapsed by Options.Dedupe aren't known in advance,
+	// so all three count them as if they were interpolated.
+	SourceFrames uint64
+	Factor       uint64
+	RIFEFrames   uint64
+	OutputFrames uint64
+
+	// Alpha is set if the alpha would be interpolated alongside the colour.
+	// Sources read by the backend are taken to have alpha, as only extracting their frames would tell.
+	Alpha bool
+
+	// Delays holds the delay of each output frame, and Loops the number of times it would play, or 0 for forever.
+	Delays []Delay
+	Loops  uint64
+
+	// TempBytes is roughly how much space the run's temporary frames would take, or 0 if the source's size is unknown.
+	TempBytes uint64
+
+	// TempDir stands in for the temporary directory the run would create, within Options.TempDir or the system's.
+	TempDir string
+
+	Steps []PlanStep
+}
+
+// PlanStep is one step of a planned run.
+type PlanStep struct {
+	// Stage is the stage of the pipeline the step belongs to, as named in StageTiming.
+	Stage       string
+	Description string
+
+	// Command is the program and arguments the step would run, with temporary paths within Plan.TempDir
+	// and output written straight to its destination, or nil if the step is done in Go.
+	Command []string
+}
+
+// PlanInterpolation locates the programs Interpolate would run with opts and reads the source,
+// working out the frame counts, timing, and commands of the run without running rife or writing any frames.
+// Videos aren't decoded, so their frame count is estimated from their length and frame rate.
+// Errors are an *Error, as for Interpolate.
+func PlanInterpolation(ctx context.Context, opts Options) (plan Plan, err error) {
+	if err = opts.Validate(); err != nil {
+		return Plan{}, err
+	}
+	opts = opts.withDefaults()
+
+	stage := "setup"
+	defer func() {
+		if err != nil {
+			err = stageError(stage, err)
+		}
+	}()
+
+	source := opts.Source
+	plan.Dest, _ = presetDest(opts.Dest, opts.Preset)
+	if !opts.Overwrite {
+		if err = checkOutputs(opts.outputPaths(plan.Dest)...); err != nil {
+			return Plan{}, err
+		}
+	}
+	deps, err := locateDependencies(ctx, opts, plan.Dest)
+	if err != nil {
+		return Plan{}, err
+	}
+	step := func(description string, command ...string) {
+		plan.Steps = append(plan.Steps, PlanStep{stage, description, command})
+	}
+	tempRoot := opts.TempDir
+	if tempRoot == "" {
+		tempRoot = os.TempDir()
+	}
+	plan.TempDir = filepath.Join(tempRoot, "rife-interpolation-*")
+	frameDir, alphaDir, whiteDir := filepath.Join(plan.TempDir, "Frames"), filepath.Join(plan.TempDir, "Alpha"), filepath.Join(plan.TempDir, "White")
+	interpolatedFrameDir, interpolatedAlphaDir := filepath.Join(plan.TempDir, "IFrames"), filepath.Join(plan.TempDir, "IAlpha")
+	interpolatedWhiteDir, mergedDir := filepath.Join(plan.TempDir, "IWhite"), filepath.Join(plan.TempDir, "Merged")
+
+	stage = "probe"
+
+	src, err := probeSource(ctx, deps.tools, deps.ffmpeg, deps.ffprobe, source, "", opts.Warnings)
+	if err != nil {
+		return Plan{}, err
+	}
+	frameCount := src.count
+	if frameCount <= 1 {
+		return Plan{}, fmt.Errorf("error reading source frames:\n  Found 1 or fewer frames in source; nothing to interpolate.")
+	}
+	plan.SourceFrames = frameCount
+	switch {
+	case src.format == "video":
+		step(fmt.Sprintf("read the video's codec, frame rate, and size with ffprobe, estimating %d frames", frameCount))
+	case src.frames != nil:
+		step(fmt.Sprintf("decode the %s's %d frames in Go", src.format, frameCount))
+	default:
+		step(fmt.Sprintf("read the timing of the %s source's %d frames with %s", src.format, frameCount, deps.tools.name()))
+	}
+
+	once := opts.Once || (src.loops == 1 && opts.LoopCrossfade == 0)
+	sourceDelays := src.delays
+	if opts.Delays != nil {
+		if uint64(len(opts.Delays)) != frameCount {
+			return Plan{}, fmt.Errorf("error applying frame delays:\n  %d delays given, but the source has %d frames.", len(opts.Delays), frameCount)
+		}
+		copy(sourceDelays, opts.Delays)
+	}
+	loopFrameCount := frameCount + opts.LoopCrossfade
+
+	stage = "extraction"
+
+	noAlpha := opts.NoAlpha || (src.format == "video" && !src.video.alpha && opts.Key == "")
+	// Only decoded frames can be checked for transparency without writing them out
+	if !noAlpha && opts.Key == "" && (src.frames != nil || src.format == "video") {
+		transparent, err := src.transparent(ctx, deps.tools, source, "")
+		if err != nil {
+			return Plan{}, fmt.Errorf("error checking source for transparency:\n  %w", err)
+		}
+		noAlpha = !transparent
+	}
+	plan.Alpha = !noAlpha
+	streams := []string{frameDir, alphaDir}
+	if noAlpha {
+		streams = streams[:1]
+	}
+
+	split := "split the frames into opaque colour in Frames and grayscale alpha in Alpha"
+	if noAlpha {
+		split = "flatten the frames against the matte colour into Frames"
+	}
+	switch {
+	case src.format == "video":
+		step("decode the video's frames into Source", append([]string{deps.ffmpeg}, videoFrameArgs(src.video, source, filepath.Join(plan.TempDir, "Source"))...)...)
+		step(split + " in Go")
+	case src.frames != nil:
+		step(split + " in Go")
+	default:
+		step(split + " with " + deps.tools.name())
+	}
+
+	size, sizeKnown := image.Point{X: src.video.width, Y: src.video.height}, src.format == "video"
+	if !sizeKnown {
+		size, sizeKnown = sourceSize(source, "", src.frames)
+	}
+	if opts.Crop != (image.Rectangle{}) || opts.Scale > 0 || opts.Resize != (image.Point{}) {
+		description := "crop and scale the frames in Go"
+		if sizeKnown {
+			region, scaled, err := outputGeometry(size, opts.Crop, opts.Scale, opts.Resize)
+			if err != nil {
+				return Plan{}, fmt.Errorf("error cropping and scaling frames:\n  %w", err)
+			}
+			description = fmt.Sprintf("crop the frames to %dx%d+%d+%d and scale them to %dx%d in Go",
+				region.Dx(), region.Dy(), region.Min.X, region.Min.Y, scaled.X, scaled.Y)
+			size = scaled
+		}
+		step(description)
+	}
+	if opts.Key != "" && !noAlpha {
+		step(fmt.Sprintf("key out %s, within %g%%, into the alpha in Go", opts.Key, opts.KeyTolerance))
+	}
+	if !noAlpha && src.frames == nil && src.format != "video" {
+		step("skip the alpha in Go if it turns out to be fully opaque")
+	}
+	if opts.Dedupe {
+		step("collapse runs of identical frames in Go")
+	}
+	if opts.LoopCrossfade > 0 {
+		step(fmt.Sprintf("blend %d loop crossfade frames from the last frame into the first with %s", opts.LoopCrossfade, deps.tools.name()))
+	}
+	if !once {
+		step("link the first frame to the end, to interpolate across the loop seam")
+	}
+	interpolatedDirs := []string{interpolatedFrameDir, interpolatedAlphaDir}[:len(streams)]
+	dual := opts.MergeMode == "dual" && !noAlpha
+	if dual {
+		step("composite the frames over black into Frames, and over white into White, in Go")
+		streams = []string{frameDir, whiteDir}
+		interpolatedDirs = []string{interpolatedFrameDir, interpolatedWhiteDir}
+	}
+
+	stage = "interpolation"
+
+	factor := opts.Factor
+	if factor == 0 {
+		factor = autoFactor(sourceDelays, opts.FPS, slowdownFactor(opts, sourceDelays))
+	}
+	plan.Factor = factor
+	rifeInputCount, finalFrameCount := rifeFrameCounts(frameCount, loopFrameCount, factor, once)
+	plan.RIFEFrames = rifeInputCount * factor
+	outputPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(finalFrameCount, 10)))
+
+	if sizeKnown {
+		spaceSize := size
+		if opts.Upscale > 0 {
+			spaceSize = size.Mul(int(opts.Upscale))
+		}
+		plan.TempBytes = tempSpaceNeeded(spaceSize, loopFrameCount+1, factor, uint64(len(streams)), opts.Sizes)
+	}
+
+	if opts.SceneThreshold > 0 {
+		stage = "scene detection"
+		step(fmt.Sprintf("find cuts between frames differing by more than %g in Go, to hold rather than interpolate across", opts.SceneThreshold))
+		stage = "interpolation"
+	}
+	if opts.Upscale > 0 && !opts.UpscaleAfter {
+		stage = "upscaling"
+		for i, gpus := range assignGPUs(opts.GPUs, len(streams)) {
+			step(fmt.Sprintf("upscale the frames in %s by %d", filepath.Base(streams[i]), opts.Upscale),
+				upscaleCommand(ctx, deps.upscaler, streams[i], streams[i]+"Upscaled", opts.Upscale, gpus).Args...)
+		}
+		stage = "interpolation"
+	}
+
+	gpus := assignGPUs(opts.GPUs, len(streams))
+	threads := splitRIFEThreads(opts.RIFEThreads, len(streams))
+	for i, inputDir := range streams {
+		step(fmt.Sprintf("interpolate the %d frames in %s into %d", rifeInputCount, filepath.Base(inputDir), plan.RIFEFrames),
+			deps.compat.command(ctx, deps.rife, inputDir, interpolatedDirs[i], outputPaddingSpecifier, plan.RIFEFrames, gpus[i], threads[i]).Args...)
+	}
+	if !once {
+		step(fmt.Sprintf("keep the first %d frames, dropping those interpolated past the copy of the first frame", finalFrameCount))
+	}
+
+	if opts.Upscale > 0 && opts.UpscaleAfter {
+		stage = "upscaling"
+		for i, gpus := range assignGPUs(opts.GPUs, len(interpolatedDirs)) {
+			step(fmt.Sprintf("upscale the frames in %s by %d", filepath.Base(interpolatedDirs[i]), opts.Upscale),
+				upscaleCommand(ctx, deps.upscaler, interpolatedDirs[i], interpolatedDirs[i]+"Upscaled", opts.Upscale, gpus).Args...)
+		}
+	}
+
+	stage = "merge"
+
+	finishedDir := mergedDir
+	switch {
+	case noAlpha:
+		finishedDir = interpolatedFrameDir
+	case dual:
+		step("recover the colour and alpha of each frame from the frames over black and white into Merged in Go")
+	default:
+		step("apply the interpolated alpha to the interpolated frames into Merged in Go")
+	}
+	if opts.VerifyAlpha && !noAlpha {
+		step("check the original frames' alpha is unchanged in Go")
+	}
+	stage = "assembly"
+
+	plan.Delays = interpolatedDelays(sourceDelays, factor, frameCount, loopFrameCount, finalFrameCount, once, opts)
+	if fps := outputFPS(opts, plan.Delays); fps > 0 {
+		finalFrameCount = uint64(len(resampleFrames(plan.Delays, fps)))
+		outputPaddingSpecifier = fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(finalFrameCount, 10)))
+		plan.Delays = make([]Delay, finalFrameCount)
+		for i := range plan.Delays {
+			plan.Delays[i] = fpsToDelay(fps)
+		}
+		finishedDir = filepath.Join(plan.TempDir, "Resampled")
+		step(fmt.Sprintf("resample the frames to %g fps, into %d frames in Resampled", fps, finalFrameCount))
+	}
+	if opts.Reverse {
+		for i, j := 0, len(plan.Delays)-1; i < j; i, j = i+1, j-1 {
+			plan.Delays[i], plan.Delays[j] = plan.Delays[j], plan.Delays[i]
+		}
+		finishedDir = filepath.Join(plan.TempDir, "Reversed")
+		step("link the frames into Reversed in reverse order")
+	}
+	if opts.Poster != "" {
+		step("export a still frame to " + opts.Poster + " with " + deps.tools.name())
+	}
+	plan.OutputFrames = finalFrameCount
+	if strings.ToLower(filepath.Ext(plan.Dest)) == ".gif" {
+		// As when writing the GIF, frames too short for it to show are dropped
+		plan.OutputFrames = gifFrameCount(plan.Delays)
+	}
+	plan.Loops = src.loops
+	if once {
+		plan.Loops = 1
+	}
+
+	asm := assembler{
+		img2webp:         deps.img2webp,
+		ffmpeg:           deps.ffmpeg,
+		gifsicle:         deps.gifsicle,
+		lossy:            opts.Lossy,
+		pngOptimizer:     deps.pngOptimizer,
+		argumentFile:     useArgumentFile(opts.Img2webpArgs, finalFrameCount),
+		paddingSpecifier: outputPaddingSpecifier,
+		frameCount:       finalFrameCount,
+		delays:           plan.Delays,
+		opaque:           noAlpha || opts.MergeMode == "matte" || opts.Flatten != "",
+		loops:            plan.Loops,
+		alphaThreshold:   opts.AlphaThreshold,
+	}
+	assemble := func(frameDir, dest string) {
+		switch strings.ToLower(filepath.Ext(dest)) {
+		case ".webp":
+			description := "assemble the WebP"
+			if asm.argumentFile {
+				description += ", passing these arguments in img2webp.txt"
+			}
+			step(description, append([]string{asm.img2webp}, asm.img2webpArgs()...)...)
+		case ".webm":
+			step("encode the WebM", append([]string{asm.ffmpeg}, asm.webmArgs(filepath.Join(frameDir, "ffmpeg.txt"), dest)...)...)
+		case ".gif":
+			step("assemble the GIF in Go")
+			if asm.gifsicle != "" {
+				step("optimize the GIF", append([]string{asm.gifsicle}, asm.gifsicleArgs(dest)...)...)
+			}
+		default:
+			step("assemble the APNG in Go")
+			if asm.pngOptimizer != "" {
+				optimized := strings.TrimSuffix(dest, filepath.Ext(dest)) + "-optimized.png"
+				step("optimize the APNG, keeping the result only if it's smaller and unchanged",
+					append([]string{asm.pngOptimizer}, apngOptimizerArgs(asm.pngOptimizer, dest, optimized)...)...)
+			}
+		}
+	}
+	switch {
+	case opts.Preset != "":
+		step("fit the output to " + opts.Preset + ", reassembling it at lower quality, with fewer frames, or smaller, until it's within the limit")
+		assemble(finishedDir, plan.Dest)
+	case opts.MaxSize > 0:
+		step(fmt.Sprintf("fit the output within %d bytes, reassembling it with fewer colours, frames, or pixels until it is", opts.MaxSize))
+		assemble(finishedDir, plan.Dest)
+	default:
+		assemble(finishedDir, plan.Dest)
+	}
+
+	for _, size := range opts.Sizes {
+		stage = "resizing"
+		sizeDir := filepath.Join(plan.TempDir, fmt.Sprintf("Size%d", size))
+		step(fmt.Sprintf("resize the frames to fit within %d pixels into %s with %s", size, filepath.Base(sizeDir), deps.tools.name()))
+		ext := filepath.Ext(plan.Dest)
+		assemble(sizeDir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(plan.Dest, ext), size, ext))
+	}
+	return plan, nil
+}
@@ -0,0 +1,490 @@
+package rifewt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preset describes the output a site or app requires for a particular kind of upload.
+type preset struct {
+	// size is the width and height of the square canvas the frames are fitted into, centred,
+	// or 0 to keep the frames as they are, only scaling them down within their own size if shrinking.
+	size uint64
+
+	// variants, if set, lists sizes to produce instead of size, each saved with its size appended to the name, as for Options.Sizes.
+	variants []uint64
+
+	// limit is the largest file accepted, in bytes.
+	limit int64
+
+	// ext is the extension of the format accepted.
+	ext string
+
+	// shrink lets the canvas be made smaller than size to fit within limit, for uploads that are scaled down anyway.
+	shrink bool
+
+	// maxDuration, if nonzero, is the longest the animation may last; longer ones are cut short.
+	maxDuration time.Duration
+
+	// maxFPS, if nonzero, is the highest frame rate allowed; faster animations are resampled to it.
+	maxFPS float64
+}
+
+// presetSettings are the settings an attempt at meeting a preset's size limit is assembled with.
+type presetSettings struct {
+	// colours is the number of colours each frame is reduced to, or 0 to leave them as they are.
+	colours int
+	// crf is the VP9 quality of WebM output, as for assembler.
+	crf int
+	// stride is how many frames are merged into each one kept.
+	stride uint64
+	// size is the width and height of the canvas, or the bound the frames are scaled down within without one,
+	// and scale is the fraction of the full size it is.
+	size  uint64
+	scale float64
+	// canvas is set if the frames are fitted to a square canvas.
+	canvas bool
+}
+
+// presets maps the names accepted by Options.Preset to what they require.
+// Limits given in KB are taken as thousands of bytes, which is the stricter reading.
+var presets = map[string]preset{
+	"discord-emoji":    {size: 128, limit: 256 * 1000, ext: ".gif", shrink: true},
+	"discord-sticker":  {size: 320, limit: 512 * 1000, ext: ".png"},
+	"telegram-sticker": {size: 512, limit: 256 * 1000, ext: ".webm", maxDuration: 3 * time.Second, maxFPS: 30},
+	"slack-emoji":      {size: 128, limit: 128 * 1000, ext: ".gif", shrink: true},
+	"twitch-emote":     {variants: []uint64{28, 56, 112}, limit: 1000 * 1000, ext: ".gif"},
+}
+
+// The settings tried in turn to bring an animation within a preset's limit, from best to worst.
+var (
+	// presetColours are the numbers of colours each frame is reduced to, with 0 leaving them as they are.
+	presetColours = []int{0, 128, 64, 32, 16}
+	// presetCRFs are the VP9 qualities video is encoded at instead, from 0 to 63, lower being better.
+	presetCRFs = []int{30, 38, 46, 54, 63}
+	// presetStrides keep every frame, then every second frame, and so on, each lasting as long as those it replaces.
+	presetStrides = []uint64{1, 2, 3, 4}
+	// presetScales are fractions of the preset's size, tried only if it allows shrinking.
+	presetScales = []float64{1, 0.875, 0.75, 0.625, 0.5}
+)
+
+// PresetExtension returns the extension of the format required by the preset called `name`, such as ".gif",
+// or an empty string if there's no such preset.
+func PresetExtension(name string) string {
+	return presets[name].ext
+}
+
+func presetDest(dest, name string) (string, bool) {
+	// Changes the extension of `dest` to that of the format the preset called `name` requires, if it differs,
+	// reporting whether it did.
+
+	if p, ok := presets[name]; ok && !strings.EqualFold(filepath.Ext(dest), p.ext) {
+		return strings.TrimSuffix(dest, filepath.Ext(dest)) + p.ext, true
+	}
+	return dest, false
+}
+
+func presetNames() string {
+	// Lists the names of the presets, for error messages.
+
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (p preset) write(ctx context.Context, a assembler, tools backend, ffprobe, frameDir, workDir, dest string, warnings *log.Logger) error {
+	// Saves the frames in `frameDir` as the preset requires, at `dest`, or for presets with variants,
+	// at `dest` with each variant's size appended to the name. `workDir` holds the frames of each attempt.
+
+	if len(p.variants) == 0 {
+		return p.fit(ctx, a, tools, ffprobe, frameDir, workDir, dest, warnings)
+	}
+
+	ext := filepath.Ext(dest)
+	for _, size := range p.variants {
+		variant := p
+		variant.size, variant.variants = size, nil
+		variantDir := filepath.Join(workDir, fmt.Sprintf("Variant%d", size))
+		if err := os.Mkdir(variantDir, 0600); err != nil {
+			return fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+		variantDest := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dest, ext), size, ext)
+		if err := variant.fit(ctx, a, tools, ffprobe, frameDir, variantDir, variantDest, warnings); err != nil {
+			return err
+		}
+		_ = os.RemoveAll(variantDir)
+	}
+	return nil
+}
+
+func (p preset) fit(ctx context.Context, a assembler, tools backend, ffprobe, frameDir, workDir, dest string, warnings *log.Logger) error {
+	// Assembles the frames in `frameDir` into `dest`, fitted to the preset's canvas and trimmed to its longest duration.
+	// If the result is over its limit, it's assembled again at a lower quality, then with fewer frames,
+	// then with a smaller canvas if allowed, taking turns, until it fits. Videos are then checked with `ffprobe`.
+	// `dest` is left untouched if the result never fits. `workDir` holds the frames of each attempt.
+
+	if p.maxDuration > 0 {
+		if trimmed := trimDelays(a.delays, p.maxDuration); trimmed != nil {
+			warnings.Printf("trimmed %s from %.3gs to %gs, the longest allowed; use -duration to speed it up to fit instead",
+				filepath.Base(dest), totalSeconds(a.delays), p.maxDuration.Seconds())
+			a.delays, a.frameCount = trimmed, uint64(len(trimmed))
+		}
+	}
+
+	qualityCount := len(presetColours)
+	if p.ext == ".webm" {
+		qualityCount = len(presetCRFs)
+	}
+	levels := [3]int{}
+	levelCounts := [3]int{qualityCount, len(presetStrides), 1}
+	if p.shrink {
+		levelCounts[2] = len(presetScales)
+	}
+
+	// Without a canvas, frames are scaled down within their longest side
+	fullSize := p.size
+	if fullSize == 0 {
+		first, err := decodePNG(filepath.Join(frameDir, fmt.Sprintf(a.paddingSpecifier, 1)))
+		if err != nil {
+			return fmt.Errorf("error reading frames:\n  %w", err)
+		}
+		fullSize = uint64(first.Bounds().Dx())
+		if height := uint64(first.Bounds().Dy()); height > fullSize {
+			fullSize = height
+		}
+	}
+
+	fittedDirs := make(map[uint64]string)
+	progress := a.progress
+	a.progress = nil
+	for attempt := 0; ; attempt++ {
+		settings := presetSettings{
+			stride: presetStrides[levels[1]],
+			size:   uint64(math.Round(float64(fullSize) * presetScales[levels[2]])),
+			scale:  presetScales[levels[2]],
+			canvas: p.size > 0,
+		}
+		// Video quality is set by the encoder, while every other format stores colours as they are
+		if p.ext == ".webm" {
+			settings.crf = presetCRFs[levels[0]]
+		} else {
+			settings.colours = presetColours[levels[0]]
+		}
+
+		// Frames are only fitted to each canvas size once, and the other settings work from those
+		fittedDir, ok := fittedDirs[settings.size]
+		if !ok && !settings.canvas && settings.scale == 1 {
+			fittedDir = frameDir
+		} else if !ok {
+			fittedDir = filepath.Join(workDir, fmt.Sprintf("Fitted%d", settings.size))
+			if err := fitFrames(ctx, a, tools, frameDir, fittedDir, settings.size, settings.canvas); err != nil {
+				return fmt.Errorf("error fitting frames to %dx%d:\n  %w", settings.size, settings.size, err)
+			}
+			fittedDirs[settings.size] = fittedDir
+		}
+
+		attemptDir := filepath.Join(workDir, fmt.Sprintf("Attempt%d", attempt))
+		reduced, err := reduceFrames(a, fittedDir, attemptDir, settings.colours, settings.stride)
+		if err != nil {
+			return fmt.Errorf("error reducing frames to fit the size limit:\n  %w", err)
+		}
+		reduced.crf = settings.crf
+		// Canvases padded with transparency can't be stored without alpha
+		reduced.opaque = a.opaque && (!settings.canvas || squareFrames(a, frameDir))
+
+		attemptPath := filepath.Join(workDir, fmt.Sprintf("attempt%d%s", attempt, p.ext))
+		if err = reduced.assemble(ctx, attemptDir, attemptPath); err != nil {
+			return err
+		}
+		info, err := os.Stat(attemptPath)
+		if err != nil {
+			return fmt.Errorf("error checking output size:\n  %w", err)
+		}
+		_ = os.RemoveAll(attemptDir)
+		fps := float64(reduced.frameCount) / totalSeconds(reduced.delays)
+
+		if info.Size() <= p.limit {
+			if attempt > 0 {
+				warnings.Printf("reduced %s to %s to fit within %s", filepath.Base(dest), settings.describe(fps), p.limitText())
+			}
+			if p.ext == ".webm" && settings.canvas {
+				if err = p.checkVideo(ctx, ffprobe, attemptPath, settings.size, !reduced.opaque); err != nil {
+					return fmt.Errorf("error validating output:\n  %w", err)
+				}
+			}
+			err = writeAtomically(dest, func(path string) error {
+				_, err := copyFile(attemptPath, path)
+				return err
+			})
+			if err == nil && progress != nil {
+				progress(a.frameCount)
+			}
+			return err
+		}
+		_ = os.Remove(attemptPath)
+
+		// Each setting is lowered in turn, skipping those already at their lowest
+		advanced := false
+		for i := 0; i < len(levels) && !advanced; i++ {
+			setting := (attempt + i) % len(levels)
+			if levels[setting] < levelCounts[setting]-1 {
+				levels[setting]++
+				advanced = true
+			}
+		}
+		if !advanced {
+			return fmt.Errorf("error fitting output within %s:\n  It's still %d KB reduced to %s.",
+				p.limitText(), (info.Size()+999)/1000, settings.describe(fps))
+		}
+	}
+}
+
+func (p preset) checkVideo(ctx context.Context, ffprobe, path string, size uint64, alpha bool) error {
+	// Checks that the video at path `path` is VP9, `size` pixels square, no longer than the preset allows,
+	// and has an alpha channel if `alpha` is set, as sites reject uploads that don't meet their requirements.
+
+	info, err := probeVideo(ctx, ffprobe, path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.codec != "vp9":
+		return fmt.Errorf("The video was encoded as %s rather than VP9.", info.codec)
+	case uint64(info.width) != size || uint64(info.height) != size:
+		return fmt.Errorf("The video is %dx%d rather than %dx%d.", info.width, info.height, size, size)
+	case alpha && !info.alpha:
+		return errors.New("The video has no alpha channel; ffmpeg's libvpx-vp9 may have been built without alpha support.")
+	// WebM stores times to the millisecond
+	case p.maxDuration > 0 && info.duration > p.maxDuration.Seconds()+0.0005:
+		return fmt.Errorf("The video lasts %.3gs, longer than the %gs allowed.", info.duration, p.maxDuration.Seconds())
+	}
+	return nil
+}
+
+func (p preset) limitText() string {
+	// Describes the size limit in KB, as sites do.
+
+	return fmt.Sprintf("%g KB", float64(p.limit)/1000)
+}
+
+func fitFrames(ctx context.Context, a assembler, tools backend, frameDir, fittedDir string, size uint64, canvas bool) error {
+	// Scales each frame in `frameDir` to fit within `size` pixels, into `fittedDir`,
+	// then if `canvas` is set, centres it on a transparent canvas of exactly that size.
+
+	if err := os.Mkdir(fittedDir, 0600); err != nil {
+		return err
+	}
+
+	errChannel := make(chan error)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for frame := uint64(1); frame <= a.frameCount; frame++ {
+		go func(i uint64, result chan error) {
+			name := fmt.Sprintf(a.paddingSpecifier, i)
+			fittedPath := filepath.Join(fittedDir, name)
+			if localErr := tools.resize(ctx, filepath.Join(frameDir, name), fittedPath, size); localErr != nil {
+				result <- localErr
+				return
+			}
+			if !canvas {
+				result <- nil
+				return
+			}
+			result <- padFrame(fittedPath, size)
+		}(frame, errChannel)
+	}
+	if err := coalesce(a.frameCount, errChannel, cancel); err != nil {
+		return err
+	}
+	close(errChannel)
+	return nil
+}
+
+func squareFrames(a assembler, frameDir string) bool {
+	// Reports whether the frames in `frameDir` are square, and so fill a square canvas once fitted to it.
+
+	first, err := decodePNG(filepath.Join(frameDir, fmt.Sprintf(a.paddingSpecifier, 1)))
+	if err != nil {
+		return false
+	}
+	return first.Bounds().Dx() == first.Bounds().Dy()
+}
+
+func padFrame(path string, size uint64) error {
+	// Centres the frame at path `path` on a transparent square canvas of `size` pixels, in place.
+	// Frames that already fill the canvas are left alone.
+
+	decoded, err := decodePNG(path)
+	if err != nil {
+		return err
+	}
+	bounds := decoded.Bounds()
+	if uint64(bounds.Dx()) == size && uint64(bounds.Dy()) == size {
+		return nil
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, int(size), int(size)))
+	offset := image.Pt((int(size)-bounds.Dx())/2, (int(size)-bounds.Dy())/2)
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(offset), decoded, bounds.Min, draw.Src)
+	return encodeIntermediate(canvas, path)
+}
+
+func reduceFrames(a assembler, frameDir, reducedDir string, colours int, stride uint64) (assembler, error) {
+	// Copies every `stride`th frame from `frameDir` into `reducedDir`, each reduced to `colours` colours unless that's 0,
+	// and returns an assembler for them, with each frame lasting as long as those it replaces.
+
+	if err := os.Mkdir(reducedDir, 0600); err != nil {
+		return assembler{}, err
+	}
+
+	count := (a.frameCount + stride - 1) / stride
+	reduced := a
+	reduced.frameCount = count
+	reduced.paddingSpecifier = fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(count, 10)))
+	reduced.delays = make([]Delay, count)
+	for i := uint64(0); i < count; i++ {
+		first := i * stride
+		reduced.delays[i] = a.delays[first]
+		for j := first + 1; j < first+stride && j < a.frameCount; j++ {
+			reduced.delays[i] = reduced.delays[i].add(a.delays[j])
+		}
+
+		framePath := filepath.Join(frameDir, fmt.Sprintf(a.paddingSpecifier, first+1))
+		reducedPath := filepath.Join(reducedDir, fmt.Sprintf(reduced.paddingSpecifier, i+1))
+		if colours == 0 {
+			if _, err := copyFile(framePath, reducedPath); err != nil {
+				return assembler{}, err
+			}
+			continue
+		}
+		decoded, err := decodePNG(framePath)
+		if err != nil {
+			return assembler{}, err
+		}
+		if err = encodeIntermediate(reduceColours(toNRGBA(decoded), colours), reducedPath); err != nil {
+			return assembler{}, err
+		}
+	}
+	return reduced, nil
+}
+
+func reduceColours(frame *image.NRGBA, colours int) *image.NRGBA {
+	// Maps the colour of each visible pixel of `frame` to the nearest of at most `colours` colours chosen by median cut,
+	// as for GIFs, leaving alpha as it is.
+
+	counts := make(map[[3]uint8]int)
+	for i := 0; i < len(frame.Pix); i += 4 {
+		if frame.Pix[i+3] > 0 {
+			counts[[3]uint8{frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2]}]++
+		}
+	}
+	if len(counts) <= colours {
+		return frame
+	}
+	gifColours := make([]gifColour, 0, len(counts))
+	for rgb, count := range counts {
+		gifColours = append(gifColours, gifColour{rgb, count})
+	}
+
+	var palette color.Palette
+	for _, box := range medianCut(gifColours, colours) {
+		var sums [3]int
+		var total int
+		for _, c := range box {
+			for channel := range sums {
+				sums[channel] += int(c.rgb[channel]) * c.count
+			}
+			total += c.count
+		}
+		palette = append(palette, color.RGBA{uint8(sums[0] / total), uint8(sums[1] / total), uint8(sums[2] / total), 0xFF})
+	}
+
+	reduced := image.NewNRGBA(frame.Rect)
+	nearest := make(map[[3]uint8]color.RGBA, len(counts))
+	for i := 0; i < len(frame.Pix); i += 4 {
+		if frame.Pix[i+3] == 0 {
+			continue
+		}
+		rgb := [3]uint8{frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2]}
+		c, ok := nearest[rgb]
+		if !ok {
+			c = palette[palette.Index(color.RGBA{rgb[0], rgb[1], rgb[2], 0xFF})].(color.RGBA)
+			nearest[rgb] = c
+		}
+		reduced.Pix[i], reduced.Pix[i+1], reduced.Pix[i+2], reduced.Pix[i+3] = c.R, c.G, c.B, frame.Pix[i+3]
+	}
+	return reduced
+}
+
+func (s presetSettings) describe(fps float64) string {
+	// Describes the settings, such as "64 colours, 12.5 fps, and 112x112", leaving out those left at their best.
+
+	var parts []string
+	if s.colours > 0 {
+		parts = append(parts, fmt.Sprintf("%d colours", s.colours))
+	}
+	if s.crf > presetCRFs[0] {
+		parts = append(parts, fmt.Sprintf("VP9 CRF %d", s.crf))
+	}
+	if s.stride > 1 {
+		parts = append(parts, fmt.Sprintf("%.3g fps", fps))
+	}
+	if s.canvas {
+		parts = append(parts, fmt.Sprintf("%dx%d", s.size, s.size))
+	} else if s.scale < 1 {
+		parts = append(parts, fmt.Sprintf("%g%% of the size", s.scale*100))
+	}
+	switch len(parts) {
+	case 0:
+		return "its full quality"
+	case 1:
+		return parts[0]
+	case 2:
+		return parts[0] + " and " + parts[1]
+	default:
+		return strings.Join(parts[:len(parts)-1], ", ") + ", and " + parts[len(parts)-1]
+	}
+}
+
+func trimDelays(delays []Delay, limit time.Duration) []Delay {
+	// Cuts `delays` short where they pass `limit`, shortening the last frame kept to end exactly there.
+	// Returns nil if they're no longer than `limit` already.
+
+	var elapsed float64
+	for i, d := range delays {
+		elapsed += d.seconds()
+		if elapsed <= limit.Seconds() {
+			continue
+		}
+		trimmed := append([]Delay(nil), delays[:i+1]...)
+		remaining := uint64(math.Round((limit.Seconds() - (elapsed - d.seconds())) * 1000))
+		if remaining == 0 {
+			return trimmed[:i]
+		}
+		trimmed[i] = reducedDelay(remaining, 1000)
+		return trimmed
+	}
+	return nil
+}
+
+func totalSeconds(delays []Delay) float64 {
+	var total float64
+	for _, d := range delays {
+		total += d.seconds()
+	}
+	return total
+}
@@ -0,0 +1,177 @@
+package rifewt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// processSlots caps how many external programs run at once across the whole program,
+// whichever stage launches them. Each running program holds one slot.
+var processSlots = make(chan struct{}, runtime.NumCPU())
+
+// processSlotsLock guards processSlots being replaced by SetProcessLimit.
+var processSlotsLock sync.Mutex
+
+// SetProcessLimit sets how many external programs, and in-process workers that stand in for them, may run at once
+// across every interpolation, which is the number of CPUs by default. It should be called before any Interpolate;
+// programs already running when it's called count against the old limit, not the new one, until they finish.
+func SetProcessLimit(limit int) {
+	processSlotsLock.Lock()
+	defer processSlotsLock.Unlock()
+	processSlots = make(chan struct{}, limit)
+}
+
+// process is an external program invocation that waits for a free slot in processSlots before starting.
+type process struct {
+	*exec.Cmd
+	ctx context.Context
+}
+
+func command(ctx context.Context, name string, args ...string) process {
+	return process{exec.CommandContext(ctx, name, args...), ctx}
+}
+
+func acquire(ctx context.Context) (release func(), err error) {
+	// Waits for a free slot in processSlots, unless `ctx` is done first, returning a function that frees it again.
+	// The slot is freed in the channel it was taken from, even if SetProcessLimit has replaced it since.
+
+	processSlotsLock.Lock()
+	slots := processSlots
+	processSlotsLock.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// verboseKey is the context key under which Interpolate stores Options.Verbose, for processes to relay their output to.
+type verboseKey struct{}
+
+// stderrTailLines is how many of the last lines a failed program wrote to stderr are included in its error.
+const stderrTailLines = 20
+
+func (p process) prepare(relayStdout bool) (stderr *bytes.Buffer, finish func()) {
+	// Captures the program's stderr, if nothing else is set to receive it, and relays it, and its stdout if `relayStdout` is set,
+	// to the verbose log if there is one. `finish` must be called once the program exits.
+
+	verbose, _ := p.ctx.Value(verboseKey{}).(*log.Logger)
+	if verbose != nil {
+		verbose.Printf("$ %s", strings.Join(p.Args, " "))
+	}
+
+	stderr = &bytes.Buffer{}
+	var relays []*lineRelay
+	if p.Stderr == nil {
+		p.Stderr = stderr
+		if verbose != nil {
+			relay := &lineRelay{log: verbose, prefix: filepath.Base(p.Path) + ": "}
+			relays = append(relays, relay)
+			p.Stderr = io.MultiWriter(stderr, relay)
+		}
+	}
+	if relayStdout && p.Stdout == nil && verbose != nil {
+		relay := &lineRelay{log: verbose, prefix: filepath.Base(p.Path) + ": "}
+		relays = append(relays, relay)
+		p.Stdout = relay
+	}
+
+	return stderr, func() {
+		for _, relay := range relays {
+			relay.flush()
+		}
+	}
+}
+
+func (p process) failure(err error, output []byte) error {
+	// Wraps `err` from running the program in a commandError, along with the last lines of its `output`.
+
+	if err == nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) > stderrTailLines {
+		lines = lines[len(lines)-stderrTailLines:]
+	}
+	return &commandError{p.Args, strings.Join(lines, "\n"), err}
+}
+
+func (p process) Run() error {
+	release, err := acquire(p.ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	stderr, finish := p.prepare(true)
+	err = p.Cmd.Run()
+	finish()
+	return p.failure(err, stderr.Bytes())
+}
+
+func (p process) Output() ([]byte, error) {
+	release, err := acquire(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Output captures stdout itself, so only stderr is relayed
+	stderr, finish := p.prepare(false)
+	output, err := p.Cmd.Output()
+	finish()
+	return output, p.failure(err, stderr.Bytes())
+}
+
+func (p process) CombinedOutput() ([]byte, error) {
+	release, err := acquire(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	output, err := p.Cmd.CombinedOutput()
+	if verbose, _ := p.ctx.Value(verboseKey{}).(*log.Logger); verbose != nil {
+		verbose.Printf("$ %s", strings.Join(p.Args, " "))
+		relay := &lineRelay{log: verbose, prefix: filepath.Base(p.Path) + ": "}
+		_, _ = relay.Write(output)
+		relay.flush()
+	}
+	return output, p.failure(err, output)
+}
+
+// lineRelay copies a program's output to a log a line at a time, each prefixed to say which program wrote it.
+type lineRelay struct {
+	log     *log.Logger
+	prefix  string
+	partial []byte
+}
+
+func (r *lineRelay) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+	for {
+		end := bytes.IndexAny(r.partial, "\r\n")
+		if end < 0 {
+			return len(p), nil
+		}
+		if line := strings.TrimSpace(string(r.partial[:end])); line != "" {
+			r.log.Print(r.prefix + line)
+		}
+		r.partial = r.partial[end+1:]
+	}
+}
+
+func (r *lineRelay) flush() {
+	if line := strings.TrimSpace(string(r.partial)); line != "" {
+		r.log.Print(r.prefix + line)
+	}
+	r.partial = nil
+}
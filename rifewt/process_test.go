@@ -0,0 +1,42 @@
+package rifewt
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSetProcessLimitWhileHeld(t *testing.T) {
+	// A slot taken before the limit changes is freed in the channel it was taken from,
+	// neither blocking nor freeing a slot taken under the new limit.
+
+	defer SetProcessLimit(runtime.NumCPU())
+	SetProcessLimit(1)
+	releaseOld, err := acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSlots := processSlots
+
+	SetProcessLimit(1)
+	releaseNew, err := acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOld()
+	if len(oldSlots) != 0 || len(processSlots) != 1 {
+		t.Fatalf("after freeing the old slot, %d old and %d new slots are taken, want 0 and 1", len(oldSlots), len(processSlots))
+	}
+
+	// The new limit still holds
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = acquire(ctx); err == nil {
+		t.Fatal("a second slot was taken under a limit of 1")
+	}
+	releaseNew()
+	if len(processSlots) != 0 {
+		t.Errorf("%d slots are still taken", len(processSlots))
+	}
+}
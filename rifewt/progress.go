@@ -0,0 +1,80 @@
+package rifewt
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress reports how far a run has got through one stage of the pipeline.
+type Progress struct {
+	// Stage names the stage, as in StageTiming.
+	Stage string
+
+	// Done of Total units of work are complete, which for every stage is frames written, counting colour and alpha separately.
+	Done  uint64
+	Total uint64
+}
+
+// progressInterval is how often directories are checked for new frames while external programs write them.
+const progressInterval = 250 * time.Millisecond
+
+// progressReporter passes updates to Options.Progress, and does nothing if that's nil.
+type progressReporter func(Progress)
+
+func (report progressReporter) update(stage string, done, total uint64) {
+	if report != nil {
+		report(Progress{stage, done, total})
+	}
+}
+
+func (report progressReporter) watch(stage string, total uint64, dirs ...string) (stop func()) {
+	// Reports progress through `stage` as frames appear in `dirs`, out of `total`, until `stop` is called,
+	// for stages where external programs write the frames. `stop` makes a final report, and may be called more than once.
+
+	if report == nil {
+		return func() {}
+	}
+
+	count := func() uint64 {
+		var done uint64
+		for _, dir := range dirs {
+			frames, _ := countFrames(dir)
+			done += frames
+		}
+		if done > total {
+			done = total
+		}
+		return done
+	}
+
+	report.update(stage, 0, total)
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		var last uint64
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+				if done := count(); done != last {
+					report.update(stage, done, total)
+					last = done
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopped)
+			<-finished
+			report.update(stage, count(), total)
+		})
+	}
+}
@@ -0,0 +1,2270 @@
+// Package rifewt interpolates frame animations with transparency using RIFE,
+// reapplying the interpolated transparency and reassembling the frames into an animation.
+package rifewt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options holds the settings for a single interpolation run.
+// Zero values select the same defaults as the command line tool.
+type Options struct {
+	// Source and Dest are the paths of the input and output animations,
+	// and Background is the matte colour that transparent pixels take on during interpolation, as hex or in any format the backend accepts,
+	// or "auto" to use the average colour of the visible pixels at the edges of transparent areas, which fringes them least.
+	Source     string
+	Dest       string
+	Background string
+
+	// Factor is the number of output frames to produce for each source frame,
+	// or 0 to choose one based on FPS, or 2 if FPS is also 0, raised in proportion for slow motion with Speed or Duration.
+	Factor uint64
+
+	// FPS, if nonzero, is a constant frame rate to resample the output to.
+	FPS float64
+
+	// Img2webpArgs selects how img2webp is given its arguments, which list every frame, for WebP output: "inline"
+	// on its command line, "file" in an argument file, or "auto", inline unless there are too many frames to fit.
+	Img2webpArgs string
+
+	// Poster, if set, is a path to export a single still frame to, chosen by PosterFrame (numbered from 1).
+	// A PosterFrame of 0 selects the middle frame. Frames are numbered as they're played, among those assembled
+	// into the output after resampling to FPS and reversing, before any GIF output drops as too short to show.
+	Poster      string
+	PosterFrame uint64
+
+	// DefaultFPS is the output frame rate used when the source has no frame delays to go by.
+	DefaultFPS float64
+
+	// Crop, if not empty, is the region of the source's frames to keep, which must lie within them.
+	// The frames are then scaled to Resize, or by Scale, before they're interpolated: enlarging small sources gives rife
+	// more to work with, while shrinking large ones saves time and output size. Resize may leave one dimension zero
+	// to keep the aspect ratio, and overrides Scale. Zero values leave the frames as they are.
+	Crop   image.Rectangle
+	Scale  float64
+	Resize image.Point
+
+	// Upscale, if nonzero, is a factor of 2 or 4 to enlarge the frames by with realesrgan-ncnn-vulkan or waifu2x-ncnn-vulkan,
+	// whichever is found first, which keeps small sprites sharp where plain scaling would blur or block them.
+	// The frames are upscaled before they're interpolated, giving rife more detail to work with,
+	// or with UpscaleAfter, once they're interpolated, which keeps rife's work small but upscales every interpolated frame.
+	Upscale      uint64
+	UpscaleAfter bool
+
+	// NoAlpha flattens the source against the matte colour and skips the alpha channel entirely, producing opaque output.
+	NoAlpha bool
+
+	// LoopCrossfade is the number of frames blending the last frame into the first to insert before the loop seam.
+	LoopCrossfade uint64
+
+	// Fuzz is the percentage distance from the matte colour within which pixels are made transparent when merging.
+	Fuzz float64
+
+	// Key, if set, is a colour to make transparent, such as the green of a green screen, for sources without real alpha,
+	// and KeyTolerance is the percentage distance from it, measured as for Fuzz, within which pixels are fully transparent,
+	// fading back to opaque at twice the distance. A KeyTolerance of 0 selects the default of 10.
+	Key          string
+	KeyTolerance float64
+
+	// Decontaminate, from 0 to 1, is how much of the matte colour to remove from semi-transparent edge pixels when merging,
+	// where interpolation blends it in as fringes. 1 removes all of it, by undoing the blend implied by the pixel's alpha.
+	Decontaminate float64
+
+	// MergeMode is "alpha" to reapply the interpolated alpha as transparency,
+	// "matte" to instead use it to blend the frames over the matte colour, producing opaque output,
+	// or "dual" to interpolate the frames composited over black and over white instead of their colour and alpha,
+	// recovering both from the difference, which keeps soft edges free of matte colour halos.
+	MergeMode string
+
+	// Flatten, if set, is a colour or the path of an image to composite the merged frames over, producing opaque output
+	// for places that don't support transparency. Images are scaled to cover the frames, and cropped to their middle.
+	Flatten string
+
+	// Preset, if set, names a site's requirements to meet: "discord-emoji", "discord-sticker", "telegram-sticker",
+	// "slack-emoji", or "twitch-emote". The output is fitted to the required size, format, duration, and frame rate,
+	// with Dest's extension changed to suit if need be, then reassembled at lower quality, with fewer frames,
+	// or with smaller frames where allowed, until it's within the size limit.
+	// Presets needing several sizes, like "twitch-emote", save each separately, named as for Sizes.
+	Preset string
+
+	// MaxSize, if nonzero, is the largest the output may be, in bytes. Larger output is reassembled with fewer colours
+	// (or at a lower quality, for WebM), then fewer frames, then smaller frames, taking turns until it fits,
+	// with a warning saying what was given up.
+	MaxSize int64
+
+	// Optimize runs GIF output through gifsicle's -O3 optimization once it's assembled, which often halves its size,
+	// and Lossy, if nonzero, also allows gifsicle that level of lossy compression (its --lossy), typically 20 to 200,
+	// shrinking it further at some cost in quality. APNG output is recompressed by apngopt, oxipng, or zopflipng,
+	// whichever is found first, keeping the result only if it displays exactly the same.
+	Optimize bool
+	Lossy    uint
+
+	// VerifyAlpha checks that the alpha of the original frames is unchanged in the output,
+	// failing if any pixel differs by more than VerifyAlphaTolerance out of 255.
+	VerifyAlpha          bool
+	VerifyAlphaTolerance uint8
+
+	// AlphaThreshold is the least alpha, out of 255, that a pixel needs to stay visible in GIF output,
+	// which only has on-or-off transparency. Soft edges below it are cut away. 0 selects the default of 128.
+	AlphaThreshold uint8
+
+	// Once produces a clip that plays through once, with no frames interpolated across the loop seam.
+	// Sources that only play once are treated this way regardless.
+	Once bool
+
+	// Model, if set, is the RIFE model to use instead of the one chosen by RIFECompat:
+	// either the name of a model installed beside rife, or the path to a model directory.
+	Model string
+
+	// RIFECompat names the family of rife builds to invoke arguments for, "v4.6" or "generic".
+	RIFECompat string
+
+	// GPUs lists the devices for rife to run on, numbered as by rife's -g, with -1 for the CPU; if empty, rife picks one.
+	// Given two or more, the colour and alpha frames are interpolated on separate devices at the same time.
+	GPUs []int
+
+	// TTA selects rife's test-time augmentation, trading speed for quality: "none", "spatial", "temporal", "both",
+	// or "auto" for whatever RIFECompat uses.
+	TTA string
+
+	// UHD enables rife's UHD mode, which suits frames larger than about 1080p.
+	UHD bool
+
+	// RIFEThreads, if set, is passed to rife's -j as "load:proc:save" thread counts, such as "1:2:2",
+	// with a comma-separated processing count for each of GPUs if there are several. Fewer processing threads use less VRAM.
+	RIFEThreads string
+
+	// Backend selects the image tool used to read sources that aren't decoded in Go and to edit frames:
+	// "magick" for ImageMagick, "ffmpeg", or "auto" for ImageMagick if it's installed and otherwise ffmpeg.
+	Backend string
+
+	// Duration, if nonzero, is the exact length to stretch or squeeze the output animation to.
+	Duration time.Duration
+
+	// Speed, if nonzero, multiplies how fast the output plays, such as 0.5 for slow motion at half speed, or 2 for double.
+	// Slowing down spreads the frames further apart, so when Factor is chosen automatically it rises to fill the gaps,
+	// as it does for a Duration longer than the source's.
+	Speed float64
+
+	// Reverse plays the finished animation backwards, reversing the order of its frames and their delays.
+	Reverse bool
+
+	// SlowWarn, if nonzero, is how long a stage of the pipeline may take before a warning is logged.
+	SlowWarn time.Duration
+
+	// Delays, if set, overrides the source's frame delays, with one entry per source frame.
+	Delays []Delay
+
+	// Dedupe collapses runs of identical consecutive frames into single frames lasting the whole run before interpolating.
+	Dedupe bool
+
+	// SceneThreshold, if nonzero, is the mean difference between consecutive frames, as a fraction from 0 to 1,
+	// beyond which they're taken to be a hard cut, and held rather than interpolated between.
+	SceneThreshold float64
+
+	// Sizes lists extra square bounding boxes, in pixels, to produce downscaled copies of the output within.
+	Sizes []uint64
+
+	// Warnings reports problems that don't stop the run. If nil, they're discarded.
+	Warnings *log.Logger
+
+	// Verbose, if set, logs every external program run and everything it prints, each line prefixed with the program's name.
+	// Whether or not it's set, errors from failed programs include the last lines they wrote to stderr.
+	Verbose *log.Logger
+
+	// TempDir is the directory to create the temporary directory in, or empty for the system's, such as TMPDIR.
+	// Every frame is written there several times over, so it's worth pointing at a fast disk with plenty of space.
+	TempDir string
+
+	// Force goes ahead even if there looks to be too little space in the temporary directory for the run's frames,
+	// logging a warning instead of failing with ErrInsufficientSpace.
+	Force bool
+
+	// Overwrite replaces the output, and any poster, downscaled copies, or preset variants, if they already exist.
+	// Otherwise the run fails with ErrOutputExists before doing anything.
+	Overwrite bool
+
+	// KeepTemp leaves the temporary directory of extracted, interpolated, and merged frames in place for inspection,
+	// logging its path to Warnings as soon as it's created.
+	KeepTemp bool
+
+	// Progress, if set, is called as each stage of the pipeline makes progress, from whichever goroutine notices it,
+	// though never from more than one at once.
+	Progress func(Progress)
+}
+
+func (o Options) withDefaults() Options {
+	// Fills in the defaults for any unset options in `o`.
+
+	if o.Background == "" {
+		o.Background = defaultMatte
+	}
+	if o.Factor == 0 && o.FPS == 0 && o.Speed == 0 && o.Duration == 0 {
+		o.Factor = 2
+	}
+	if o.Img2webpArgs == "" {
+		o.Img2webpArgs = "auto"
+	}
+	if o.DefaultFPS == 0 {
+		o.DefaultFPS = 10
+	}
+	if o.KeyTolerance == 0 {
+		o.KeyTolerance = 10
+	}
+	if o.AlphaThreshold == 0 {
+		o.AlphaThreshold = 128
+	}
+	if o.MergeMode == "" {
+		o.MergeMode = "alpha"
+	}
+	if o.RIFECompat == "" {
+		o.RIFECompat = "v4.6"
+	}
+	if o.Backend == "" {
+		o.Backend = "auto"
+	}
+	if o.TTA == "" {
+		o.TTA = "auto"
+	}
+	if o.Warnings == nil {
+		o.Warnings = log.New(io.Discard, "", 0)
+	}
+	return o
+}
+
+// Validate reports the first invalid setting in the options, if any, after filling in defaults.
+func (o Options) Validate() error {
+	o = o.withDefaults()
+
+	if o.Factor == 1 {
+		return errors.New("interpolation factor must be at least 2")
+	}
+	if o.FPS < 0 {
+		return errors.New("frame rate must be positive")
+	}
+	switch o.Img2webpArgs {
+	case "auto", "inline", "file":
+	default:
+		return errors.New("unrecognized way of passing img2webp arguments: " + o.Img2webpArgs)
+	}
+	if o.DefaultFPS < 0 {
+		return errors.New("default frame rate must be positive")
+	}
+	if _, ok := rifeCompats[o.RIFECompat]; !ok {
+		return errors.New("unrecognized rife build family: " + o.RIFECompat)
+	}
+	if o.Duration < 0 {
+		return errors.New("duration must be positive")
+	}
+	if o.Speed < 0 {
+		return errors.New("speed must be positive")
+	}
+	if o.Speed > 0 && o.Duration > 0 {
+		return errors.New("-speed can't be combined with -duration, which sets the speed itself")
+	}
+	if o.Once && o.LoopCrossfade > 0 {
+		return errors.New("-loop-crossfade has no effect with -once")
+	}
+	for _, gpu := range o.GPUs {
+		if gpu < -1 || (gpu == -1 && len(o.GPUs) > 1) {
+			return errors.New("GPUs must be numbered from 0, or be -1 alone for the CPU")
+		}
+	}
+	if _, ok := ttaArgs[o.TTA]; !ok && o.TTA != "auto" {
+		return errors.New("unrecognized TTA mode: " + o.TTA)
+	}
+	if o.RIFEThreads != "" {
+		match := rifeThreadsPattern.FindStringSubmatch(o.RIFEThreads)
+		if match == nil {
+			return errors.New("rife thread counts must be given as load:proc:save, e.g. 1:2:2")
+		}
+		if procs := strings.Count(match[2], ",") + 1; procs > 1 && procs != len(o.GPUs) {
+			return fmt.Errorf("rife thread counts list %d processing counts, but need one for each selected GPU, of which there are %d", procs, len(o.GPUs))
+		}
+	}
+	switch o.Backend {
+	case "auto", "magick", "ffmpeg":
+	default:
+		return errors.New("unrecognized backend: " + o.Backend)
+	}
+	if o.MergeMode != "alpha" && o.MergeMode != "matte" && o.MergeMode != "dual" {
+		return errors.New("unrecognized merge mode: " + o.MergeMode)
+	}
+	if o.MergeMode == "dual" && (o.Fuzz > 0 || o.Decontaminate > 0) {
+		return errors.New("-fuzz and -decontaminate have no effect with -merge-mode dual, which uses no matte colour")
+	}
+	if _, ok := presets[o.Preset]; !ok && o.Preset != "" {
+		return fmt.Errorf("unrecognized preset: %s (choose from %s)", o.Preset, presetNames())
+	}
+	if o.Preset != "" && o.MaxSize > 0 {
+		return errors.New("-max-size can't be combined with -preset, which has its own size limit")
+	}
+	if o.Scale < 0 {
+		return errors.New("scale must be positive")
+	}
+	if o.Scale > 0 && o.Resize != (image.Point{}) {
+		return errors.New("-scale has no effect with -resize, which sets the size itself")
+	}
+	if o.Resize.X < 0 || o.Resize.Y < 0 {
+		return errors.New("resized dimensions must be positive")
+	}
+	if o.Crop.Min.X < 0 || o.Crop.Min.Y < 0 || (o.Crop != (image.Rectangle{}) && o.Crop.Empty()) {
+		return errors.New("crop must be a non-empty region with a non-negative offset")
+	}
+	if o.Upscale != 0 && !upscaleFactors[o.Upscale] {
+		return errors.New("upscale factor must be 2 or 4")
+	}
+	if o.UpscaleAfter && o.Upscale == 0 {
+		return errors.New("-upscale-after only has an effect with -upscale")
+	}
+	if o.Upscale > 0 && o.VerifyAlpha {
+		return errors.New("-verify-alpha can't be combined with -upscale, as the output's alpha is redrawn by the upscaler")
+	}
+	if o.Lossy > 0 && !o.Optimize {
+		return errors.New("-lossy only has an effect with -optimize")
+	}
+	if o.MaxSize < 0 {
+		return errors.New("maximum output size must be positive")
+	}
+	if o.Preset != "" && len(o.Sizes) > 0 {
+		return errors.New("-sizes can't be combined with -preset, which chooses the output's size itself")
+	}
+	if o.Flatten != "" && (o.NoAlpha || o.MergeMode == "matte") {
+		return errors.New("-flatten can't be combined with -no-alpha or -merge-mode matte, which flatten against the matte colour instead")
+	}
+	if o.Key != "" && o.NoAlpha {
+		return errors.New("-key has no effect with -no-alpha, which discards the alpha it produces")
+	}
+	if o.KeyTolerance < 0 || o.KeyTolerance > 100 {
+		return errors.New("key tolerance must be a percentage between 0 and 100")
+	}
+	if o.Decontaminate < 0 || o.Decontaminate > 1 {
+		return errors.New("decontamination strength must be between 0 and 1")
+	}
+	if o.Fuzz < 0 || o.Fuzz > 100 {
+		return errors.New("fuzz must be a percentage between 0 and 100")
+	}
+	if o.SceneThreshold < 0 || o.SceneThreshold > 1 {
+		return errors.New("scene change threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// Result describes a finished interpolation run.
+type Result struct {
+	SourceFrames uint64
+	OutputFrames uint64
+
+	// Dest is where the output was saved, which Options.Preset may have changed the extension of,
+	// and Duration is how long it plays for, once through.
+	Dest     string
+	Duration time.Duration
+
+	// Matte is the matte colour used, which is worth checking when Options.Background was "auto".
+	Matte string
+
+	// Model is the RIFE model the frames were interpolated with, and RIFEVersion is
+	// the version of the rife binary used, or empty if it couldn't be determined.
+	Model       string
+	RIFEVersion string
+
+	// Versions holds the version of each external program located for the run, keyed by name, as for Dependencies,
+	// such as "rife-ncnn-vulkan" or "ImageMagick", with an empty string where it couldn't be determined.
+	Versions map[string]string
+
+	// AlphaVerified is set if the output's alpha was checked against the source's,
+	// in which case AlphaDeviation is the largest difference found, out of 255.
+	AlphaVerified  bool
+	AlphaDeviation uint8
+
+	// DuplicateFrames is the number of source frames collapsed into the frames before them by Options.Dedupe.
+	DuplicateFrames uint64
+
+	// SceneCuts is the number of hard cuts found with Options.SceneThreshold, which were held rather than interpolated across.
+	SceneCuts uint64
+
+	// OpaqueSource is set if the source turned out to have no transparency, so only its colour was interpolated.
+	OpaqueSource bool
+
+	// Timings lists how long each stage of the pipeline took, in order.
+	Timings []StageTiming
+
+	// TempDir is the temporary directory left in place by Options.KeepTemp, or empty if it was removed.
+	TempDir string
+}
+
+// StageTiming records how long a stage of the pipeline took.
+type StageTiming struct {
+	Stage    string
+	Duration time.Duration
+}
+
+// slowStageHints suggests likely causes for each stage of the pipeline running slowly.
+var slowStageHints = map[string]string{
+	"setup":           "locating dependencies or creating the temporary directory is slow; check for a slow or full temporary disk",
+	"probe":           "the backend is slow to read the source; it may be very large, or limited by ImageMagick's resource policy",
+	"extraction":      "extracting frames is slow; check ImageMagick's resource policy (policy.xml) and the temporary disk's speed",
+	"scene detection": "comparing frames for -scene-threshold is slow; it grows with the frame size and count",
+	"upscaling":       "the upscaler is slow; check that it is running on a GPU, and upscale before interpolating rather than after, so fewer frames are upscaled",
+	"interpolation":   "rife is slow; check that it is running on a GPU rather than falling back to the CPU, and that nothing else is using the GPU",
+	"merge":           "merging alpha is slow; consider more -jobs, or a faster temporary disk",
+	"assembly":        "APNG assembly is slow; compression time grows with the frame count and size, and GIF output adds palette selection",
+	"resizing":        "producing -sizes copies is slow; consider fewer sizes, or fewer -jobs if the machine is overloaded",
+}
+
+// rifeCompat is a known-good way of invoking a family of rife builds.
+type rifeCompat struct {
+	// model is passed to rife with -m, unless empty, in which case rife uses its own default.
+	model string
+	// tta is the test-time augmentation to enable, one of the keys of ttaArgs, or empty for none.
+	tta string
+	// uhd enables rife's UHD mode, for large frames.
+	uhd bool
+}
+
+// ttaArgs holds the rife arguments enabling each kind of test-time augmentation, selected with -tta.
+var ttaArgs = map[string][]string{
+	"none":     nil,
+	"spatial":  {"-x"},
+	"temporal": {"-z"},
+	"both":     {"-x", "-z"},
+}
+
+// rifeCompats holds the supported rife build families, selected with -rife-compat.
+var rifeCompats = map[string]rifeCompat{
+	// rife-ncnn-vulkan builds from 20221029 on, which bundle the v4.6 model
+	// and support spatial (-x) and temporal (-z) TTA with it
+	"v4.6": {model: "rife-v4.6", tta: "both"},
+	// Any other build, using only the arguments every version understands
+	"generic": {},
+}
+
+func (c rifeCompat) command(ctx context.Context, rife, inputDir, outputDir, paddingSpecifier string, outputFrames uint64, gpus []int, threads string) process {
+	// Produces a rife command interpolating the frames in `inputDir` into `outputFrames` frames in `outputDir`,
+	// on the devices `gpus`, or the one rife picks if empty, with the thread counts `threads`, or rife's defaults if empty.
+
+	args := []string{"-i", inputDir, "-o", outputDir, "-f", paddingSpecifier, "-n", strconv.FormatUint(outputFrames, 10)}
+	if c.model != "" {
+		args = append(args, "-m", c.model)
+	}
+	if len(gpus) > 0 {
+		ids := make([]string, len(gpus))
+		for i, gpu := range gpus {
+			ids[i] = strconv.Itoa(gpu)
+		}
+		args = append(args, "-g", strings.Join(ids, ","))
+	}
+	if threads != "" {
+		args = append(args, "-j", threads)
+	}
+	args = append(args, ttaArgs[c.tta]...)
+	if c.uhd {
+		args = append(args, "-u")
+	}
+	return command(ctx, rife, args...)
+}
+
+func assignGPUs[T any](gpus []T, streams int) [][]T {
+	// Shares the devices `gpus`, or anything listed per device, between `streams` rife runs that happen at once,
+	// each getting a list to pass to rife. With fewer devices than runs, every run shares them all.
+
+	assigned := make([][]T, streams)
+	if len(gpus) < streams {
+		for i := range assigned {
+			assigned[i] = gpus
+		}
+		return assigned
+	}
+	// Earlier runs take any spare device
+	start := 0
+	for i := range assigned {
+		end := start + (len(gpus)-start+(streams-i)-1)/(streams-i)
+		assigned[i] = gpus[start:end]
+		start = end
+	}
+	return assigned
+}
+
+// rifeThreadsPattern matches rife's -j argument: load, processing, and save thread counts,
+// with a processing count for each GPU when there are several.
+var rifeThreadsPattern = regexp.MustCompile(`^([0-9]+):([0-9]+(?:,[0-9]+)*):([0-9]+)$`)
+
+func splitRIFEThreads(threads string, streams int) []string {
+	// Produces the -j argument for each of `streams` rife runs sharing GPUs as assignGPUs does,
+	// giving each only the processing thread counts of its own GPUs. Empty if `threads` is.
+
+	split := make([]string, streams)
+	match := rifeThreadsPattern.FindStringSubmatch(threads)
+	if match == nil {
+		return split
+	}
+	procs := assignGPUs(strings.Split(match[2], ","), streams)
+	for i := range split {
+		split[i] = match[1] + ":" + strings.Join(procs[i], ",") + ":" + match[3]
+	}
+	return split
+}
+
+// programPaths holds the programs set by SetProgramPath, by the name they're searched for by.
+var programPaths = make(map[string]string)
+
+// SetProgramPath has the program searched for by `name`, such as magick, rife, or ffmpeg, run from `path` instead,
+// ahead of the RIFEWT_ environment variable for it and the PATH. An empty path clears it.
+// It should be called before anything is interpolated, as it isn't safe to call while programs are being looked for.
+func SetProgramPath(name, path string) {
+	if path == "" {
+		delete(programPaths, name)
+		return
+	}
+	programPaths[name] = path
+}
+
+func programEnvVar(name string) string {
+	// Names the environment variable that sets the path of the program `name`, e.g. RIFEWT_RIFE_NCNN_VULKAN.
+
+	return "RIFEWT_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func programPathSet(name string) bool {
+	// Reports whether a path is set for the program `name`, by SetProgramPath or the environment.
+
+	return programPaths[name] != "" || os.Getenv(programEnvVar(name)) != ""
+}
+
+func findProgram(names ...string) (string, error) {
+	// Locates the first of the programs `names` to be found, trying the paths set for any of them first,
+	// by SetProgramPath and then the environment, then searching the PATH and the Dependencies directory for each in turn.
+	// A path set for a program that can't be run is an error, rather than being passed over for another.
+
+	for _, name := range names {
+		path, source := programPaths[name], "the path set for "+name
+		if path == "" {
+			env := programEnvVar(name)
+			path, source = os.Getenv(env), env
+		}
+		if path == "" {
+			continue
+		}
+		program, err := exec.LookPath(path)
+		if err != nil {
+			return "", fmt.Errorf("%s, from %s, can't be run:\n  %w", path, source, err)
+		}
+		return program, nil
+	}
+
+	var lastErr error
+	for _, name := range names {
+		// Try searching the PATH
+		program, err := exec.LookPath(name)
+		if err == nil {
+			return program, nil
+		}
+		lastErr = err
+
+		// Try searching a dependencies directory
+		here := filepath.Dir(os.Args[0])
+		program, err = exec.LookPath(filepath.Join(here, "Dependencies", name))
+		if err == nil {
+			return program, nil
+		}
+	}
+
+	return "", lastErr
+}
+
+var (
+	// ImageMagick's banner reads "Version: ImageMagick 7.1.1-21 Q16-HDRI ..."
+	magickVersionPattern = regexp.MustCompile(`\bImageMagick ([0-9]+\.[0-9][0-9.\-]*)`)
+	versionPattern       = regexp.MustCompile(`(?i)\bversion\b[\s:]*v?([0-9][0-9A-Za-z.\-]*)`)
+	// Others' --version starts with their name and version, e.g. "LCDF Gifsicle 1.93"
+	bannerVersionPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9 ._\-]*? v?([0-9]+\.[0-9]+(?:\.[0-9]+)*)\b`)
+	buildDatePattern     = regexp.MustCompile(`\b(20[0-9]{6})\b`)
+)
+
+func installedModels(rife string) []string {
+	// Lists the RIFE models installed beside the rife executable, as directories named like rife-v4.6 containing a flownet.
+
+	if resolved, err := filepath.EvalSymlinks(rife); err == nil {
+		rife = resolved
+	}
+	params, _ := filepath.Glob(filepath.Join(filepath.Dir(rife), "rife*", "flownet.param"))
+
+	models := make([]string, 0, len(params))
+	for _, param := range params {
+		models = append(models, filepath.Base(filepath.Dir(param)))
+	}
+	return models
+}
+
+func resolveModel(rife, model string) (string, error) {
+	// Checks that `model` names either a model installed beside `rife` or a model directory,
+	// returning the value to pass to rife with -m.
+
+	installed := installedModels(rife)
+	for _, name := range installed {
+		if name == model {
+			// rife looks up relative model paths beside itself
+			return model, nil
+		}
+	}
+
+	if info, err := os.Stat(model); err == nil && info.IsDir() {
+		return filepath.Abs(model)
+	}
+
+	if len(installed) == 0 {
+		return "", fmt.Errorf("%s is neither a model directory nor a model installed beside %s.", model, rife)
+	}
+	return "", fmt.Errorf("%s is neither a model directory nor a model installed beside %s.\n  Installed models: %s", model, rife, strings.Join(installed, ", "))
+}
+
+func programVersion(ctx context.Context, program string) string {
+	// Makes a best-effort attempt to identify the version of `program`, returning an empty string if it can't.
+
+	// Many tools print a version banner along with their usage information
+	output, _ := command(ctx, program, "-h").CombinedOutput()
+	if match := magickVersionPattern.FindSubmatch(output); match != nil {
+		return string(match[1])
+	}
+	if match := versionPattern.FindSubmatch(output); match != nil {
+		return string(match[1])
+	}
+	// Others, such as gifsicle, only print it for --version
+	output, _ = command(ctx, program, "--version").CombinedOutput()
+	if match := versionPattern.FindSubmatch(output); match != nil {
+		return string(match[1])
+	}
+	banner, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	if match := bannerVersionPattern.FindStringSubmatch(banner); match != nil {
+		return match[1]
+	}
+
+	// rife-ncnn-vulkan doesn't report its version, but its release archives are named by build date,
+	// e.g. rife-ncnn-vulkan-20221029-windows, and are often extracted as-is
+	if resolved, err := filepath.EvalSymlinks(program); err == nil {
+		program = resolved
+	}
+	if match := buildDatePattern.FindStringSubmatch(filepath.Base(filepath.Dir(program))); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// Interpolate interpolates the animation at path opts.Source, outputting at path opts.Dest,
+// with an intermediate matting colour specified by opts.Background.
+// External programs are stopped and temporary files removed if ctx is cancelled,
+// in which case the error wraps ctx.Err(). Otherwise, errors after opts is validated are an *Error,
+// saying which stage failed, and match ErrDependencyMissing, ErrExtraction, and so on with errors.Is.
+func Interpolate(ctx context.Context, opts Options) (res Result, err error) {
+	if err = opts.Validate(); err != nil {
+		return Result{}, err
+	}
+	opts = opts.withDefaults()
+	report := progressReporter(opts.Progress)
+	if opts.Verbose != nil {
+		ctx = context.WithValue(ctx, verboseKey{}, opts.Verbose)
+	}
+
+	// stage is the stage of the pipeline in progress, which any error is attributed to
+	stage := "setup"
+
+	// Programs killed by the context fail with unhelpful errors, so report the cancellation itself
+	parent := ctx
+	defer func() {
+		if err != nil && parent.Err() != nil {
+			err = fmt.Errorf("error interpolating %s:\n  Stopped early: %w", filepath.Base(opts.Source), parent.Err())
+		} else if err != nil {
+			err = stageError(stage, err)
+		}
+	}()
+
+	// Stop every other program still running as soon as one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source, background := opts.Source, opts.Background
+	dest, changed := presetDest(opts.Dest, opts.Preset)
+	if changed {
+		opts.Warnings.Printf("%s needs a %s file, so the output is being saved as %s", opts.Preset, presets[opts.Preset].ext, filepath.Base(dest))
+	}
+
+	var timings []StageTiming
+	stageStart := time.Now()
+	nextStage := func(next string) {
+		// Records how long the stage in progress took, and moves on to `next`
+		timing := StageTiming{stage, time.Since(stageStart)}
+		timings = append(timings, timing)
+		if opts.SlowWarn > 0 && timing.Duration > opts.SlowWarn {
+			opts.Warnings.Printf("%s took %s, over the %s threshold; %s", stage, timing.Duration.Round(time.Millisecond), opts.SlowWarn, slowStageHints[stage])
+		}
+		stage, stageStart = next, time.Now()
+	}
+
+	if !opts.Overwrite {
+		if err = checkOutputs(opts.outputPaths(dest)...); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// Locate dependencies
+	deps, err := locateDependencies(ctx, opts, dest)
+	if err != nil {
+		return Result{}, err
+	}
+	tools, rife, compat, upscaler := deps.tools, deps.rife, deps.compat, deps.upscaler
+	img2webp, ffmpeg, ffprobe, gifsicle, pngOptimizer := deps.img2webp, deps.ffmpeg, deps.ffprobe, deps.gifsicle, deps.pngOptimizer
+
+	// Set up temporary directory structure
+
+	dir, err := os.MkdirTemp(opts.TempDir, "rife-interpolation-*")
+	if err != nil {
+		return Result{}, fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	if opts.KeepTemp {
+		opts.Warnings.Printf("keeping temporary files for %s in %s", filepath.Base(source), dir)
+	} else {
+		defer func(path string) { _ = os.RemoveAll(path) }(dir)
+	}
+
+	if err != nil {
+		return Result{}, fmt.Errorf("error opening temporary directory:\n  %w", err)
+	}
+
+	frameDir := filepath.Join(dir, "Frames")
+	alphaDir := filepath.Join(dir, "Alpha")
+	interpolatedFrameDir := filepath.Join(dir, "IFrames")
+	interpolatedAlphaDir := filepath.Join(dir, "IAlpha")
+	// With -merge-mode dual, the frames are composited over white here, and over black in frameDir, in place of the alpha
+	whiteDir := filepath.Join(dir, "White")
+	interpolatedWhiteDir := filepath.Join(dir, "IWhite")
+	mergedDir := filepath.Join(dir, "Merged")
+	// Sources that ImageMagick can't read in full are decoded here first
+	sourceDir := filepath.Join(dir, "Source")
+
+	for _, childDir := range []string{frameDir, alphaDir, interpolatedFrameDir, interpolatedAlphaDir, whiteDir, interpolatedWhiteDir, mergedDir, sourceDir} {
+		err = os.Mkdir(childDir, 0600)
+		if err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+	}
+
+	nextStage("probe")
+
+	// Get information about the source animation
+
+	src, err := probeSource(ctx, tools, ffmpeg, ffprobe, source, sourceDir, opts.Warnings)
+	if err != nil {
+		return Result{}, err
+	}
+	frameCount, sourceLoops := src.count, src.loops
+
+	if frameCount <= 1 {
+		return Result{}, fmt.Errorf("error reading source frames:\n  Found 1 or fewer frames in source; nothing to interpolate.")
+	}
+
+	// A source that plays only once has no loop seam to smooth over, unless a crossfade was asked for to add one
+	if sourceLoops == 1 && opts.LoopCrossfade == 0 {
+		opts.Once = true
+	}
+
+	// Frame delays, or zero where unknown
+	sourceDelays := src.delays
+	if opts.Delays != nil {
+		if uint64(len(opts.Delays)) != frameCount {
+			return Result{}, fmt.Errorf("error applying frame delays:\n  %d delays given, but the source has %d frames.", len(opts.Delays), frameCount)
+		}
+		copy(sourceDelays, opts.Delays)
+	}
+
+	slowdown := slowdownFactor(opts, sourceDelays)
+
+	// Frames fed to RIFE, excluding the copy of the first frame appended for looping
+	loopFrameCount := frameCount + opts.LoopCrossfade
+
+	inputPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(loopFrameCount, 10))) // E.g. %02d.png
+
+	// Match the matte to the colours bordering transparent areas, as those are what it's blended with
+	if background == "auto" {
+		if matte, ok := autoMatte(matteFrames(source, sourceDir, src.frames)); ok {
+			background = hexColour(matte)
+		} else {
+			background = defaultMatte
+		}
+	}
+
+	nextStage("extraction")
+
+	// Extract frames and frame alpha
+
+	errChannel := make(chan error)
+
+	// Without alpha, only the opaque frames are processed, and they are fully flattened against the matte colour
+	streams := []string{frameDir, alphaDir}
+	// Most videos have no alpha channel to begin with, unless it's to be keyed out
+	noAlpha := opts.NoAlpha || (src.format == "video" && !src.video.alpha && opts.Key == "")
+	if noAlpha {
+		streams = streams[:1]
+	}
+
+	// Check there's room for every frame before writing them, counting any duplicates Dedupe will collapse
+	if size, ok := sourceSize(source, sourceDir, src.frames); ok {
+		// Frames are cropped and scaled before anything's interpolated, so it's their final size that counts
+		if _, scaled, err := outputGeometry(size, opts.Crop, opts.Scale, opts.Resize); err == nil {
+			size = scaled
+		}
+		// Upscaled frames are counted at their larger size throughout, which is only true of upscaling before interpolating
+		if opts.Upscale > 0 {
+			size = size.Mul(int(opts.Upscale))
+		}
+		factor := opts.Factor
+		if factor == 0 {
+			factor = autoFactor(sourceDelays, opts.FPS, slowdown)
+		}
+		needed := tempSpaceNeeded(size, loopFrameCount+1, factor, uint64(len(streams)), opts.Sizes)
+		if err = checkTempSpace(dir, needed); err != nil && opts.Force {
+			opts.Warnings.Printf("continuing as forced, though the run may fail partway: %s", err)
+		} else if err != nil {
+			return Result{}, fmt.Errorf("error checking free space:\n  %w\n  Free some space, choose a bigger disk with -tmpdir or TMPDIR, or use -force to try anyway.", err)
+		}
+	}
+
+	// Intermediate frames are always written non-interlaced, whatever the source's interlacing,
+	// as interlaced PNGs are slower to decode and gain nothing here.
+
+	stopWatching := report.watch("extraction", frameCount*uint64(len(streams)), streams...)
+	defer stopWatching()
+
+	if err = extractSource(ctx, tools, &src, source, frameDir, alphaDir, sourceDir, inputPaddingSpecifier, background, noAlpha, errChannel, cancel); err != nil {
+		return Result{}, err
+	}
+
+	stopWatching()
+
+	// Catch extraction quirks here, rather than as confusing failures when merging
+	extractedAlphaDir := alphaDir
+	if noAlpha {
+		extractedAlphaDir = ""
+	}
+	noExtractedAlpha, err := checkExtracted(frameDir, extractedAlphaDir, frameCount)
+	if err != nil {
+		return Result{}, err
+	}
+	if noExtractedAlpha {
+		opts.Warnings.Println("no alpha could be extracted from the source; treating it as opaque")
+		noAlpha = true
+		streams = streams[:1]
+	}
+
+	// Optionally crop and scale the frames, and their alpha to match
+
+	if opts.Crop != (image.Rectangle{}) || opts.Scale > 0 || opts.Resize != (image.Point{}) {
+		first, err := decodePNG(filepath.Join(frameDir, fmt.Sprintf(inputPaddingSpecifier, 0)))
+		if err != nil {
+			return Result{}, fmt.Errorf("error reading extracted frames:\n  %w", err)
+		}
+		region, size, err := outputGeometry(first.Bounds().Size(), opts.Crop, opts.Scale, opts.Resize)
+		if err != nil {
+			return Result{}, fmt.Errorf("error cropping and scaling frames:\n  %w", err)
+		}
+		if region.Min != (image.Point{}) || region.Size() != size || size != first.Bounds().Size() {
+			for i := uint64(0); i < frameCount; i++ {
+				go func(i uint64, result chan error) {
+					release, localErr := acquire(ctx)
+					if localErr != nil {
+						result <- localErr
+						return
+					}
+					defer release()
+
+					name := fmt.Sprintf(inputPaddingSpecifier, i)
+					for _, streamDir := range streams {
+						if localErr := transformFrame(filepath.Join(streamDir, name), region, size); localErr != nil {
+							result <- fmt.Errorf("error cropping and scaling frames:\n  %w", localErr)
+							return
+						}
+					}
+					result <- nil
+				}(i, errChannel)
+			}
+			if err = coalesce(frameCount, errChannel, cancel); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	// Optionally key out a background colour, such as a green screen, adding it to the alpha
+
+	if opts.Key != "" && !noAlpha {
+		key, err := resolveColour(ctx, tools, opts.Key)
+		if err != nil {
+			return Result{}, fmt.Errorf("error reading key colour:\n  %w", err)
+		}
+		matte, err := resolveColour(ctx, tools, background)
+		if err != nil {
+			return Result{}, fmt.Errorf("error reading matte colour:\n  %w", err)
+		}
+		for i := uint64(0); i < frameCount; i++ {
+			go func(i uint64, result chan error) {
+				release, localErr := acquire(ctx)
+				if localErr != nil {
+					result <- localErr
+					return
+				}
+				defer release()
+
+				name := fmt.Sprintf(inputPaddingSpecifier, i)
+				if localErr := keyFrame(filepath.Join(frameDir, name), filepath.Join(alphaDir, name), key, matte, opts.KeyTolerance); localErr != nil {
+					result <- fmt.Errorf("error keying frames:\n  %w", localErr)
+					return
+				}
+				result <- nil
+			}(i, errChannel)
+		}
+		if err = coalesce(frameCount, errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// Sources without any transparency only need their colour interpolated, halving rife's work
+	opaqueSource := false
+	if !noAlpha {
+		if opaqueSource, err = allOpaque(alphaDir); err != nil {
+			return Result{}, fmt.Errorf("error checking extracted alpha:\n  %w", err)
+		} else if opaqueSource {
+			noAlpha = true
+			streams = streams[:1]
+		}
+	}
+
+	// Optionally collapse holds into single longer frames, so they cost nothing to interpolate
+
+	sourceFrameCount := frameCount
+	if opts.Dedupe {
+		if sourceDelays, err = collapseDuplicates(streams, inputPaddingSpecifier, sourceDelays); err != nil {
+			return Result{}, fmt.Errorf("error collapsing duplicate frames:\n  %w", err)
+		}
+		frameCount = uint64(len(sourceDelays))
+		loopFrameCount = frameCount + opts.LoopCrossfade
+	}
+
+	// Optionally ease the loop seam with frames blending from the last frame back to the first
+
+	if opts.LoopCrossfade > 0 {
+		for _, childDir := range streams {
+			for step := uint64(1); step <= opts.LoopCrossfade; step++ {
+				go func(childDir string, step uint64, result chan error) {
+					firstFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, 0))
+					lastFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, frameCount-1))
+					// Fraction of the first frame to blend over the last
+					weight := float64(step) / float64(opts.LoopCrossfade+1)
+					localErr := tools.crossfade(ctx, lastFrame, firstFrame, filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, frameCount-1+step)), weight)
+					if localErr != nil {
+						result <- fmt.Errorf("error blending loop crossfade frames:\n  %w", localErr)
+						return
+					}
+					result <- nil
+				}(childDir, step, errChannel)
+			}
+		}
+
+		if err = coalesce(uint64(len(streams))*opts.LoopCrossfade, errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// Copy the first frame to the end, for smoother looping
+
+	for _, childDir := range streams {
+		if opts.Once {
+			break
+		}
+		firstFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, 0))
+		lastFrame := filepath.Join(childDir, fmt.Sprintf(inputPaddingSpecifier, loopFrameCount))
+		err = os.Link(firstFrame, lastFrame)
+		if err != nil {
+			// Maybe hardlinking just isn't supported
+			_, err = copyFile(firstFrame, lastFrame)
+			if err != nil {
+				return Result{}, fmt.Errorf("error duplicating first frame:\n  %w", err)
+			}
+		}
+	}
+
+	// Optionally replace the colour and alpha with composites over black and white, interpolated in their place.
+	// The alpha is kept for -verify-alpha.
+
+	dual := opts.MergeMode == "dual" && !noAlpha
+	interpolatedDirs := []string{interpolatedFrameDir, interpolatedAlphaDir}[:len(streams)]
+	if dual {
+		paths, err := filepath.Glob(filepath.Join(frameDir, "*.png"))
+		if err != nil {
+			return Result{}, fmt.Errorf("error compositing frames over black and white:\n  %w", err)
+		}
+		for _, path := range paths {
+			go func(name string, result chan error) {
+				release, localErr := acquire(ctx)
+				if localErr != nil {
+					result <- localErr
+					return
+				}
+				defer release()
+
+				framePath := filepath.Join(frameDir, name)
+				localErr = splitDualMattes(framePath, filepath.Join(alphaDir, name), framePath, filepath.Join(whiteDir, name))
+				if localErr != nil {
+					result <- fmt.Errorf("error compositing frames over black and white:\n  %w", localErr)
+					return
+				}
+				result <- nil
+			}(filepath.Base(path), errChannel)
+		}
+		if err = coalesce(uint64(len(paths)), errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+		streams = []string{frameDir, whiteDir}
+		interpolatedDirs = []string{interpolatedFrameDir, interpolatedWhiteDir}
+	}
+
+	nextStage("interpolation")
+
+	// Perform interpolation
+
+	model := compat.model
+	if model == "" {
+		model = "default model"
+	}
+
+	// When aiming for a frame rate, interpolate enough frames to cover the typical gap between source frames
+	factor := opts.Factor
+	if factor == 0 {
+		factor = autoFactor(sourceDelays, opts.FPS, slowdown)
+	}
+
+	rifeInputCount, finalFrameCount := rifeFrameCounts(frameCount, loopFrameCount, factor, opts.Once)
+	rifeOutputCount := rifeInputCount * factor
+	outputPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(finalFrameCount, 10)))
+
+	// Find hard cuts between the frames fed to RIFE, where interpolating would only blend two unrelated images
+	var cuts []uint64
+	if opts.SceneThreshold > 0 {
+		stage = "scene detection"
+		if cuts, err = findSceneCuts(frameDir, inputPaddingSpecifier, rifeInputCount, opts.SceneThreshold); err != nil {
+			return Result{}, fmt.Errorf("error detecting scene changes:\n  %w", err)
+		}
+		nextStage("interpolation")
+	}
+
+	// Optionally upscale the frames first, so rife interpolates the detail the upscaler adds
+
+	if opts.Upscale > 0 && !opts.UpscaleAfter {
+		stage = "upscaling"
+		if err = upscaleFrames(ctx, report, upscaler, opts.Upscale, streams, assignGPUs(opts.GPUs, len(streams)), errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+		nextStage("interpolation")
+	}
+
+	// With several GPUs, the colour and alpha frames are interpolated on different ones rather than contending for one
+	gpus := assignGPUs(opts.GPUs, len(streams))
+	threads := splitRIFEThreads(opts.RIFEThreads, len(streams))
+
+	stopWatching = report.watch("interpolation", rifeOutputCount*uint64(len(streams)), interpolatedDirs...)
+	defer stopWatching()
+
+	go func(result chan error) {
+		localErr := compat.command(ctx, rife, frameDir, interpolatedFrameDir, outputPaddingSpecifier, rifeOutputCount, gpus[0], threads[0]).Run()
+		if localErr != nil {
+			result <- fmt.Errorf("error interpolating frames:\n  %w", localErr)
+			return
+		}
+		result <- nil
+	}(errChannel)
+
+	if !noAlpha {
+		go func(result chan error) {
+			localErr := compat.command(ctx, rife, streams[1], interpolatedDirs[1], outputPaddingSpecifier, rifeOutputCount, gpus[1], threads[1]).Run()
+			if localErr != nil {
+				result <- fmt.Errorf("error interpolating alpha:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(errChannel)
+	}
+
+	if err = coalesce(uint64(len(streams)), errChannel, cancel); err != nil {
+		return Result{}, err
+	}
+
+	stopWatching()
+
+	// The naming of RIFE's output is controlled by -f, which not every rife build treats as a
+	// printf-style pattern, so make sure every frame is where it's expected before going further
+	for _, childDir := range interpolatedDirs {
+		if err = checkFrames(childDir, outputPaddingSpecifier, finalFrameCount); err != nil {
+			return Result{}, fmt.Errorf("error reading interpolated frames:\n  %w", err)
+		}
+	}
+
+	// Across each cut, hold the frame before it in place of RIFE's blend
+	for _, cut := range cuts {
+		held := cut*factor + 1
+		for _, childDir := range interpolatedDirs {
+			for i := held + 1; i < held+factor; i++ {
+				if _, err = copyFile(filepath.Join(childDir, fmt.Sprintf(outputPaddingSpecifier, held)), filepath.Join(childDir, fmt.Sprintf(outputPaddingSpecifier, i))); err != nil {
+					return Result{}, fmt.Errorf("error holding frames across scene change:\n  %w", err)
+				}
+			}
+		}
+	}
+
+	// Optionally upscale the interpolated frames instead
+
+	if opts.Upscale > 0 && opts.UpscaleAfter {
+		nextStage("upscaling")
+		if err = upscaleFrames(ctx, report, upscaler, opts.Upscale, interpolatedDirs, assignGPUs(opts.GPUs, len(interpolatedDirs)), errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+	}
+
+	nextStage("merge")
+
+	// Merge alpha channel with opaque frames
+
+	// The directory holding the finished frames, ready for assembly
+	finishedDir := mergedDir
+	if noAlpha {
+		finishedDir = interpolatedFrameDir
+	} else {
+		stopWatching = report.watch("merge", finalFrameCount, mergedDir)
+		defer stopWatching()
+
+		// The matte colour is only needed to compare or blend against
+		var matte color.RGBA
+		if opts.Fuzz > 0 || opts.Decontaminate > 0 {
+			if matte, err = resolveColour(ctx, tools, background); err != nil {
+				return Result{}, fmt.Errorf("error reading matte colour:\n  %w", err)
+			}
+		}
+
+		// Flattened frames are composited over a backdrop made once at their size, which in matte mode is the matte colour
+		flatten := opts.Flatten
+		if opts.MergeMode == "matte" {
+			flatten = background
+		}
+		var backdrop *image.RGBA
+		if flatten != "" {
+			first, err := decodePNG(filepath.Join(interpolatedFrameDir, fmt.Sprintf(outputPaddingSpecifier, 1)))
+			if err != nil {
+				return Result{}, fmt.Errorf("error reading interpolated frames:\n  %w", err)
+			}
+			if backdrop, err = loadBackdrop(ctx, tools, flatten, first.Bounds().Size()); err != nil {
+				return Result{}, fmt.Errorf("error reading backdrop to flatten onto:\n  %w", err)
+			}
+		}
+
+		// Each frame takes a slot like an external program, to stay within the job limit
+		for frame := uint64(1); frame <= finalFrameCount; frame++ {
+			// RIFE output is numbered starting from 1
+			go func(name string, result chan error) {
+				release, localErr := acquire(ctx)
+				if localErr != nil {
+					result <- localErr
+					return
+				}
+				defer release()
+
+				if dual {
+					localErr = unmatteFrame(filepath.Join(interpolatedFrameDir, name), filepath.Join(interpolatedWhiteDir, name), filepath.Join(mergedDir, name), backdrop)
+				} else {
+					localErr = mergeFrame(filepath.Join(interpolatedFrameDir, name), filepath.Join(interpolatedAlphaDir, name), filepath.Join(mergedDir, name), matte, opts.Fuzz, opts.Decontaminate, backdrop)
+				}
+				if localErr != nil {
+					result <- fmt.Errorf("error applying transparency to frames:\n  %w", localErr)
+					return
+				}
+				result <- nil
+			}(fmt.Sprintf(outputPaddingSpecifier, frame), errChannel)
+		}
+
+		if err = coalesce(finalFrameCount, errChannel, cancel); err != nil {
+			return Result{}, err
+		}
+		stopWatching()
+	}
+
+	close(errChannel)
+
+	// Optionally check that the alpha of each original frame survived the round trip
+
+	// Opaque sources come through opaque, so there's nothing to compare
+	opaque := noAlpha || opts.MergeMode == "matte" || opts.Flatten != ""
+	var alphaDeviation uint8
+	if opts.VerifyAlpha && !opaqueSource {
+		if opaque {
+			return Result{}, fmt.Errorf("error verifying alpha:\n  The output is opaque, so it has no alpha to compare.")
+		}
+		if alphaDeviation, err = sourceAlphaDeviation(alphaDir, mergedDir, inputPaddingSpecifier, outputPaddingSpecifier, frameCount, factor); err != nil {
+			return Result{}, fmt.Errorf("error verifying alpha:\n  %w", err)
+		}
+		if alphaDeviation > opts.VerifyAlphaTolerance {
+			return Result{}, fmt.Errorf("error verifying alpha:\n  Output alpha deviates from the source by up to %d/255, more than the tolerance of %d/255.", alphaDeviation, opts.VerifyAlphaTolerance)
+		}
+	}
+
+	nextStage("assembly")
+
+	// Assemble into the output format
+
+	frameDelays := interpolatedDelays(sourceDelays, factor, frameCount, loopFrameCount, finalFrameCount, opts.Once, opts)
+
+	// Optionally resample to a constant frame rate, dropping or repeating frames as needed
+
+	fps := outputFPS(opts, frameDelays)
+	if fps > 0 {
+		resampledDir := filepath.Join(dir, "Resampled")
+		if err = os.Mkdir(resampledDir, 0600); err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+
+		frames := resampleFrames(frameDelays, fps)
+		resampledPaddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(uint64(len(frames)), 10)))
+		for i, frame := range frames {
+			sourceFrame := filepath.Join(finishedDir, fmt.Sprintf(outputPaddingSpecifier, frame+1))
+			resampledFrame := filepath.Join(resampledDir, fmt.Sprintf(resampledPaddingSpecifier, i+1))
+			if err = os.Link(sourceFrame, resampledFrame); err != nil {
+				// Maybe hardlinking just isn't supported
+				if _, err = copyFile(sourceFrame, resampledFrame); err != nil {
+					return Result{}, fmt.Errorf("error resampling frames:\n  %w", err)
+				}
+			}
+		}
+
+		finishedDir = resampledDir
+		outputPaddingSpecifier = resampledPaddingSpecifier
+		finalFrameCount = uint64(len(frames))
+		frameDelays = make([]Delay, finalFrameCount)
+		for i := range frameDelays {
+			frameDelays[i] = fpsToDelay(fps)
+		}
+	}
+
+	// Optionally play the frames backwards, each keeping its own delay
+
+	if opts.Reverse {
+		reversedDir := filepath.Join(dir, "Reversed")
+		if err = os.Mkdir(reversedDir, 0600); err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+		for i := uint64(1); i <= finalFrameCount; i++ {
+			sourceFrame := filepath.Join(finishedDir, fmt.Sprintf(outputPaddingSpecifier, finalFrameCount+1-i))
+			reversedFrame := filepath.Join(reversedDir, fmt.Sprintf(outputPaddingSpecifier, i))
+			if err = os.Link(sourceFrame, reversedFrame); err != nil {
+				// Maybe hardlinking just isn't supported
+				if _, err = copyFile(sourceFrame, reversedFrame); err != nil {
+					return Result{}, fmt.Errorf("error reversing frames:\n  %w", err)
+				}
+			}
+		}
+		for i, j := 0, len(frameDelays)-1; i < j; i, j = i+1, j-1 {
+			frameDelays[i], frameDelays[j] = frameDelays[j], frameDelays[i]
+		}
+		finishedDir = reversedDir
+	}
+
+	// Optionally export a still frame, numbered among the frames as they're played, once resampled and reversed
+
+	if opts.Poster != "" {
+		posterFrame := opts.PosterFrame
+		if posterFrame == 0 {
+			posterFrame = (finalFrameCount + 1) / 2
+		} else if posterFrame > finalFrameCount {
+			return Result{}, fmt.Errorf("error exporting poster frame:\n  Frame %d requested, but the output only has %d frames.", posterFrame, finalFrameCount)
+		}
+		err = exportPoster(ctx, tools, filepath.Join(finishedDir, fmt.Sprintf(outputPaddingSpecifier, posterFrame)), opts.Poster, background)
+		if err != nil {
+			return Result{}, fmt.Errorf("error exporting poster frame:\n  %w", err)
+		}
+	}
+
+	asm := assembler{
+		img2webp:         img2webp,
+		ffmpeg:           ffmpeg,
+		gifsicle:         gifsicle,
+		lossy:            opts.Lossy,
+		pngOptimizer:     pngOptimizer,
+		warnings:         opts.Warnings,
+		argumentFile:     useArgumentFile(opts.Img2webpArgs, finalFrameCount),
+		paddingSpecifier: outputPaddingSpecifier,
+		frameCount:       finalFrameCount,
+		delays:           frameDelays,
+		opaque:           opaque,
+		loops:            sourceLoops,
+		alphaThreshold:   opts.AlphaThreshold,
+	}
+	if opts.Once {
+		asm.loops = 1
+	}
+	report.update("assembly", 0, finalFrameCount)
+	asm.progress = func(done uint64) { report.update("assembly", done, finalFrameCount) }
+	if p, ok := presets[opts.Preset]; ok {
+		presetDir := filepath.Join(dir, "Preset")
+		if err = os.Mkdir(presetDir, 0600); err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+		err = p.write(ctx, asm, tools, ffprobe, finishedDir, presetDir, dest, opts.Warnings)
+	} else if opts.MaxSize > 0 {
+		// A size limit alone works like a preset that keeps the format and the frames' shape
+		limitDir := filepath.Join(dir, "MaxSize")
+		if err = os.Mkdir(limitDir, 0600); err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+		limit := preset{limit: opts.MaxSize, ext: strings.ToLower(filepath.Ext(dest)), shrink: true}
+		err = limit.fit(ctx, asm, tools, ffprobe, finishedDir, limitDir, dest, opts.Warnings)
+	} else {
+		err = asm.assemble(ctx, finishedDir, dest)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	// Downscaled copies report their progress through resizing instead
+	asm.progress = nil
+
+	// GIF can't show frames as briefly as high frame rates need, so some may have been dropped to keep their speed
+	outputFrames := finalFrameCount
+	if strings.ToLower(filepath.Ext(dest)) == ".gif" {
+		if shown := gifFrameCount(frameDelays); shown < finalFrameCount {
+			opts.Warnings.Printf("GIF frames last at least 2 hundredths of a second, so %d of the %d frames were dropped to keep the output's speed; APNG and WebP output keep them all",
+				finalFrameCount-shown, finalFrameCount)
+			outputFrames = shown
+		}
+	}
+
+	if len(opts.Sizes) > 0 {
+		nextStage("resizing")
+	}
+
+	// Optionally produce downscaled copies
+
+	for _, size := range opts.Sizes {
+		sizeDir := filepath.Join(dir, fmt.Sprintf("Size%d", size))
+		if err = os.Mkdir(sizeDir, 0600); err != nil {
+			return Result{}, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+
+		stopWatching = report.watch("resizing", finalFrameCount, sizeDir)
+		errChannel = make(chan error)
+		for frame := uint64(1); frame <= finalFrameCount; frame++ {
+			go func(i uint64, result chan error) {
+				frameName := fmt.Sprintf(outputPaddingSpecifier, i)
+				localErr := tools.resize(ctx, filepath.Join(finishedDir, frameName), filepath.Join(sizeDir, frameName), size)
+				if localErr != nil {
+					result <- fmt.Errorf("error resizing frames to %d pixels:\n  %w", size, localErr)
+					return
+				}
+				result <- nil
+			}(frame, errChannel)
+		}
+		err = coalesce(finalFrameCount, errChannel, cancel)
+		stopWatching()
+		if err != nil {
+			return Result{}, err
+		}
+		close(errChannel)
+
+		ext := filepath.Ext(dest)
+		if err = asm.assemble(ctx, sizeDir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dest, ext), size, ext)); err != nil {
+			return Result{}, err
+		}
+	}
+
+	nextStage("")
+
+	var tempDir string
+	if opts.KeepTemp {
+		tempDir = dir
+	}
+	versions := deps.versions(ctx)
+
+	return Result{
+		SourceFrames: sourceFrameCount,
+		OutputFrames: outputFrames,
+		Dest:         dest,
+		Duration:     time.Duration(totalSeconds(frameDelays) * float64(time.Second)),
+		Matte:        background,
+		Model:        model,
+		RIFEVersion:  versions["rife-ncnn-vulkan"],
+		Versions:     versions,
+
+		AlphaVerified:  opts.VerifyAlpha,
+		AlphaDeviation: alphaDeviation,
+
+		DuplicateFrames: sourceFrameCount - frameCount,
+		SceneCuts:       uint64(len(cuts)),
+		OpaqueSource:    opaqueSource,
+
+		Timings: timings,
+		TempDir: tempDir,
+	}, nil
+}
+
+func (o Options) outputPaths(dest string) []string {
+	// Lists every file a run with options `o` would write, saving its output to `dest`.
+
+	ext := filepath.Ext(dest)
+	var paths []string
+	if p, ok := presets[o.Preset]; ok && len(p.variants) > 0 {
+		for _, size := range p.variants {
+			paths = append(paths, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dest, ext), size, ext))
+		}
+	} else {
+		paths = append(paths, dest)
+	}
+	for _, size := range o.Sizes {
+		paths = append(paths, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dest, ext), size, ext))
+	}
+	if o.Poster != "" {
+		paths = append(paths, o.Poster)
+	}
+	return paths
+}
+
+func checkOutputs(paths ...string) error {
+	// Fails with ErrOutputExists if any of `paths` already exists, so that nothing is replaced unasked.
+
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("error checking output path:\n  %w", causedError{ErrOutputExists,
+				fmt.Errorf("%s already exists. Use -force to replace it, or choose another output path.", path)})
+		}
+	}
+	return nil
+}
+
+func slowdownFactor(opts Options, sourceDelays []Delay) float64 {
+	// Works out how many times longer the output lasts than a source timed by `sourceDelays`,
+	// where opts.Speed or opts.Duration slows it down.
+
+	if opts.Speed > 0 {
+		return 1 / opts.Speed
+	} else if opts.Duration > 0 {
+		var sourceSeconds float64
+		for _, d := range sourceDelays {
+			if d.Num == 0 {
+				d = fpsToDelay(opts.DefaultFPS)
+			}
+			sourceSeconds += d.seconds()
+		}
+		return opts.Duration.Seconds() / sourceSeconds
+	}
+	return 1
+}
+
+func rifeFrameCounts(frameCount, loopFrameCount, factor uint64, once bool) (inputCount, finalCount uint64) {
+	// Counts the frames fed to RIFE to interpolate `frameCount` source frames, plus loop crossfade frames up to
+	// `loopFrameCount`, by `factor`, and the frames kept of its output.
+
+	// RIFE produces `factor` frames for every frame fed to it, including the copy of the first frame if looping.
+	// Numbering from 1, the trailing frames after that final input frame are dropped.
+	inputCount = loopFrameCount + 1
+	if once {
+		inputCount = frameCount
+	}
+	return inputCount, (inputCount-1)*factor + 1
+}
+
+func interpolatedDelays(sourceDelays []Delay, factor, frameCount, loopFrameCount, finalFrameCount uint64, once bool, opts Options) []Delay {
+	// Times the `finalFrameCount` frames interpolated by `factor` from `frameCount` source frames with delays `sourceDelays`,
+	// plus loop crossfade frames up to `loopFrameCount`, stretched to opts.Duration or sped up by opts.Speed if set.
+	// Played `once`, the frames last as long as the source does from its first frame to its last.
+
+	sourceDelay := func(sourceIndex uint64) Delay {
+		if sourceDelays[sourceIndex].Num == 0 {
+			// Fall back to the default frame rate where there's no frame delay
+			return fpsToDelay(opts.DefaultFPS)
+		}
+		return sourceDelays[sourceIndex]
+	}
+
+	// Each source frame's time is split evenly between it and the interpolated frames following it.
+	// Loop crossfade frames take the last frame's delay, and the final copy of the first frame takes its share of its delay.
+	frameDelays := make([]Delay, finalFrameCount)
+	for i := range frameDelays {
+		switch sourceIndex := uint64(i) / factor; {
+		case sourceIndex < frameCount:
+			frameDelays[i] = sourceDelay(sourceIndex).divide(factor)
+		case sourceIndex < loopFrameCount:
+			frameDelays[i] = sourceDelay(frameCount - 1).divide(factor)
+		default:
+			frameDelays[i] = sourceDelay(0).divide(factor)
+		}
+	}
+
+	// Played once, the last source frame ends the clip rather than leading anywhere, so the time between the last two
+	// is shared with it, between the frames interpolated from them and both of them
+	if once && frameCount > 1 {
+		lastStep := sourceDelay(frameCount - 2).divide(factor + 1)
+		for i := (frameCount - 2) * factor; i < finalFrameCount; i++ {
+			frameDelays[i] = lastStep
+		}
+	}
+
+	if opts.Duration > 0 {
+		frameDelays = fitDelays(frameDelays, opts.Duration)
+	} else if opts.Speed > 0 {
+		frameDelays = fitDelays(frameDelays, time.Duration(totalSeconds(frameDelays)/opts.Speed*float64(time.Second)))
+	}
+	return frameDelays
+}
+
+func outputFPS(opts Options, frameDelays []Delay) float64 {
+	// Finds the frame rate to resample frames timed by `frameDelays` to, or 0 to leave them be:
+	// opts.FPS, or the limit of opts.Preset for animations that would be faster.
+
+	fps := opts.FPS
+	if p, ok := presets[opts.Preset]; ok && p.maxFPS > 0 && (fps > p.maxFPS || (fps == 0 && float64(len(frameDelays))/totalSeconds(frameDelays) > p.maxFPS)) {
+		fps = p.maxFPS
+	}
+	return fps
+}
+
+// assembler turns a directory of merged frames, numbered from 1, into a finished animation.
+type assembler struct {
+	img2webp string
+	ffmpeg   string
+
+	// gifsicle, if set, optimizes GIF output, with lossy compression at level lossy if it's nonzero.
+	gifsicle string
+	lossy    uint
+
+	// pngOptimizer, if set, is the program APNG output is optimized with, as by optimizeAPNG.
+	pngOptimizer string
+
+	// warnings reports problems that don't stop assembly.
+	warnings *log.Logger
+
+	// argumentFile is set to pass img2webp its arguments in a file rather than on its command line.
+	argumentFile     bool
+	paddingSpecifier string
+	frameCount       uint64
+
+	// delays holds the duration of each frame.
+	delays []Delay
+
+	// loops is the number of times the animation plays, or 0 to loop forever.
+	loops uint64
+
+	// opaque is set if the frames have no transparency to keep.
+	opaque bool
+
+	// alphaThreshold is the least alpha a pixel needs to stay visible in a GIF.
+	alphaThreshold uint8
+
+	// crf is the quality WebM output is encoded at, from 0 to 63, lower being better, or 0 for the default of 30.
+	crf int
+
+	// progress, if set, is called with the number of frames assembled so far.
+	progress func(done uint64)
+}
+
+func (a assembler) assemble(ctx context.Context, frameDir, dest string) error {
+	// Assembles the frames in `frameDir` into an animation at path `dest`,
+	// as a GIF, WebP, or WebM if its extension is .gif, .webp, or .webm, or otherwise an APNG.
+
+	// img2webp and ffmpeg don't report their progress, so it's only known once they finish
+	var err error
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".webp":
+		err = a.assembleWebP(ctx, frameDir, dest)
+	case ".webm":
+		err = a.assembleWebM(ctx, frameDir, dest)
+	case ".gif":
+		return a.assembleGIF(ctx, frameDir, dest)
+	default:
+		return a.assembleAPNG(ctx, frameDir, dest)
+	}
+	if err == nil && a.progress != nil {
+		a.progress(a.frameCount)
+	}
+	return err
+}
+
+func (a assembler) assembleWebM(ctx context.Context, frameDir, dest string) error {
+	// Encodes the frames in `frameDir` into a VP9 WebM video at path `dest`, with an alpha channel unless the frames are opaque.
+
+	// ffmpeg's concat demuxer gives every frame its own duration, so uneven timing survives.
+	// Paths are relative to the list, and the last frame is listed twice, as otherwise its duration is ignored.
+	var list strings.Builder
+	for i, frameDelay := range a.delays {
+		_, _ = fmt.Fprintf(&list, "file '%s'\nduration %g\n", fmt.Sprintf(a.paddingSpecifier, i+1), frameDelay.seconds())
+	}
+	_, _ = fmt.Fprintf(&list, "file '%s'\n", fmt.Sprintf(a.paddingSpecifier, len(a.delays)))
+	listFile := filepath.Join(frameDir, "ffmpeg.txt")
+	if err := os.WriteFile(listFile, []byte(list.String()), 0600); err != nil {
+		return fmt.Errorf("error listing frames for WebM assembly:\n  %w", err)
+	}
+
+	return writeAtomically(dest, func(path string) error {
+		if err := command(ctx, a.ffmpeg, a.webmArgs(listFile, path)...).Run(); err != nil {
+			return fmt.Errorf("error assembling WebM:\n  %w", err)
+		}
+		return nil
+	})
+}
+
+func (a assembler) webmArgs(listFile, path string) []string {
+	// Produces the ffmpeg arguments that encode the frames listed in `listFile` into a WebM at path `path`.
+
+	pixelFormat := "yuva420p"
+	if a.opaque {
+		pixelFormat = "yuv420p"
+	}
+	crf := a.crf
+	if crf == 0 {
+		crf = 30
+	}
+	return []string{"-y", "-v", "error", "-f", "concat", "-safe", "0", "-i", listFile,
+		"-c:v", "libvpx-vp9", "-pix_fmt", pixelFormat, "-b:v", "0", "-crf", strconv.Itoa(crf), "-row-mt", "1", "-an", "-f", "webm", path}
+}
+
+func (a assembler) assembleWebP(ctx context.Context, frameDir, dest string) error {
+	// Assembles the frames in `frameDir` into a lossless animated WebP at path `dest`.
+
+	args := a.img2webpArgs()
+
+	if a.argumentFile {
+		// Given a single argument, img2webp reads its arguments from that file
+		argFile := filepath.Join(frameDir, "img2webp.txt")
+		if err := os.WriteFile(argFile, []byte(strings.Join(args, "\n")), 0600); err != nil {
+			return fmt.Errorf("error listing frames for WebP assembly:\n  %w", err)
+		}
+		args = []string{"img2webp.txt"}
+	}
+
+	return writeAtomically(dest, func(path string) error {
+		img2webp := command(ctx, a.img2webp, args...)
+		img2webp.Dir = frameDir
+		if err := img2webp.Run(); err != nil {
+			return fmt.Errorf("error assembling WebP:\n  %w", err)
+		}
+
+		webp := filepath.Join(frameDir, "animation.webp")
+		if err := os.Rename(webp, path); err != nil {
+			if _, err = copyFile(webp, path); err != nil {
+				return fmt.Errorf("error moving assembled WebP:\n  %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (a assembler) img2webpArgs() []string {
+	// Produces the img2webp arguments that assemble the frames into animation.webp, which are passed in a file
+	// if a.argumentFile is set.
+
+	// img2webp runs in the frame directory so that frames can be named without their full paths,
+	// as an argument file can't quote paths containing spaces
+	args := []string{"-loop", strconv.FormatUint(a.loops, 10), "-lossless"}
+	for i, frameDelay := range a.delays {
+		milliseconds := uint64(math.Round(frameDelay.seconds() * 1000))
+		if milliseconds == 0 {
+			milliseconds = 1
+		}
+		args = append(args, "-d", strconv.FormatUint(milliseconds, 10), fmt.Sprintf(a.paddingSpecifier, i+1))
+	}
+	return append(args, "-o", "animation.webp")
+}
+
+func (a assembler) assembleAPNG(ctx context.Context, frameDir, dest string) error {
+	// Assembles the frames in `frameDir` into an APNG at path `dest`.
+
+	return writeAtomically(dest, func(path string) error {
+		if err := writeAPNG(ctx, path, a.framePaths(frameDir), a.delays, a.loops, a.opaque, a.progress); err != nil {
+			return fmt.Errorf("error assembling APNG:\n  %w", err)
+		}
+		if a.pngOptimizer == "" {
+			return nil
+		}
+
+		kept, err := optimizeAPNG(ctx, a.pngOptimizer, path)
+		if err != nil {
+			return fmt.Errorf("error optimizing APNG:\n  %w", err)
+		}
+		if !kept {
+			a.warnings.Printf("%s didn't shrink %s without changing it, so it was left unoptimized", filepath.Base(a.pngOptimizer), filepath.Base(dest))
+		}
+		return nil
+	})
+}
+
+func (a assembler) assembleGIF(ctx context.Context, frameDir, dest string) error {
+	// Assembles the frames in `frameDir` into a GIF at path `dest`.
+
+	return writeAtomically(dest, func(path string) error {
+		if err := writeGIF(ctx, path, a.framePaths(frameDir), a.delays, a.loops, a.alphaThreshold, a.progress); err != nil {
+			return fmt.Errorf("error assembling GIF:\n  %w", err)
+		}
+		if a.gifsicle == "" {
+			return nil
+		}
+
+		if err := command(ctx, a.gifsicle, a.gifsicleArgs(path)...).Run(); err != nil {
+			return fmt.Errorf("error optimizing GIF:\n  %w", err)
+		}
+		return nil
+	})
+}
+
+func (a assembler) gifsicleArgs(path string) []string {
+	// Produces the gifsicle arguments that optimize the GIF at path `path`.
+
+	// gifsicle rewrites the file in place with --batch
+	args := []string{"--batch", "-O3"}
+	if a.lossy > 0 {
+		args = append(args, fmt.Sprintf("--lossy=%d", a.lossy))
+	}
+	return append(args, path)
+}
+
+func (a assembler) framePaths(frameDir string) []string {
+	// Lists the paths of the frames in `frameDir`, in order.
+
+	paths := make([]string, a.frameCount)
+	for i := range paths {
+		paths[i] = filepath.Join(frameDir, fmt.Sprintf(a.paddingSpecifier, i+1))
+	}
+	return paths
+}
+
+func writeAtomically(dest string, write func(path string) error) error {
+	// Has `write` produce a file at a temporary path beside `dest`, then renames it over `dest` once it's complete,
+	// so that anything watching `dest` never sees a partially written file.
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+strings.TrimSuffix(filepath.Base(dest), filepath.Ext(dest))+"-*"+filepath.Ext(dest))
+	if err != nil {
+		// Can't create files beside the destination, so just write it directly
+		return write(dest)
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer func(path string) { _ = os.Remove(path) }(tmpPath)
+
+	if err = write(tmpPath); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error validating output:\n  %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("error validating output:\n  %s was left empty.", filepath.Base(dest))
+	}
+
+	// Temporary files are created private to the user, unlike a freshly written output
+	_ = os.Chmod(tmpPath, 0644)
+
+	if err = os.Rename(tmpPath, dest); err != nil {
+		// Renaming can fail across filesystem boundaries, so fall back to copying the finished file into place
+		if _, err = copyFile(tmpPath, dest); err != nil {
+			return fmt.Errorf("error moving output into place:\n  %w", err)
+		}
+	}
+	return nil
+}
+
+func exportPoster(ctx context.Context, tools backend, frame, dest, background string) error {
+	// Saves the merged frame at path `frame` as a still image at path `dest`, in the format implied by its extension.
+
+	return writeAtomically(dest, func(path string) error {
+		switch strings.ToLower(filepath.Ext(dest)) {
+		case ".png":
+			// Merged frames are already PNGs with transparency; a copy suffices.
+			_, err := copyFile(frame, path)
+			return err
+		case ".jpg", ".jpeg", ".bmp":
+			// No alpha channel, so flatten against the matte colour.
+			return tools.export(ctx, frame, path, background, true)
+		default:
+			return tools.export(ctx, frame, path, background, false)
+		}
+	})
+}
+
+// Delay is a frame duration of Num/Den seconds.
+type Delay struct {
+	Num uint64
+	Den uint64
+}
+
+func (d Delay) divide(parts uint64) Delay {
+	// Splits the delay into `parts` equal parts.
+
+	return reducedDelay(d.Num, d.Den*parts)
+}
+
+func (d Delay) add(other Delay) Delay {
+	// Produces the delay lasting as long as both `d` and `other`.
+
+	return reducedDelay(d.Num*other.Den+other.Num*d.Den, d.Den*other.Den)
+}
+
+func reducedDelay(numerator, denominator uint64) Delay {
+	// Produces the delay of `numerator`/`denominator` seconds, reduced to be small enough for APNG's 16-bit delay fields.
+
+	divisor := gcd(numerator, denominator)
+	numerator, denominator = numerator/divisor, denominator/divisor
+	if denominator > math.MaxUint16 || numerator > math.MaxUint16 {
+		// Settle for millisecond precision
+		milliseconds := uint64(math.Round(float64(numerator) * 1000 / float64(denominator)))
+		if milliseconds > math.MaxUint16 {
+			milliseconds = math.MaxUint16
+		}
+		return reducedDelay(milliseconds, 1000)
+	}
+	return Delay{numerator, denominator}
+}
+
+func (d Delay) seconds() float64 {
+	return float64(d.Num) / float64(d.Den)
+}
+
+func factorForFPS(sourceDelays []Delay, fps float64) uint64 {
+	// Picks an interpolation factor giving at least `fps` frames per second across the average gap between source frames.
+
+	var total float64
+	var known int
+	for _, d := range sourceDelays {
+		if d.Num > 0 {
+			total += d.seconds()
+			known++
+		}
+	}
+	if known == 0 {
+		return 2
+	}
+
+	factor := uint64(math.Ceil(fps * total / float64(known)))
+	if factor < 2 {
+		factor = 2
+	}
+	return factor
+}
+
+func autoFactor(sourceDelays []Delay, fps, slowdown float64) uint64 {
+	// Picks an interpolation factor when none is given: enough for `fps` frames per second if it's set, or otherwise 2,
+	// raised for output lasting `slowdown` times as long as the source, so slow motion plays as smoothly as the original.
+
+	if fps > 0 {
+		return factorForFPS(sourceDelays, fps*slowdown)
+	}
+	return uint64(math.Ceil(2 * math.Max(slowdown, 1)))
+}
+
+func resampleFrames(delays []Delay, fps float64) []int {
+	// Picks frames to show at a constant `fps` from frames lasting `delays`, returning the index of the frame on screen
+	// at each tick. Frames are dropped where they're shorter than a tick, and repeated where they're longer.
+
+	var total float64
+	for _, d := range delays {
+		total += d.seconds()
+	}
+	tickCount := int(math.Round(total * fps))
+	if tickCount < 1 {
+		tickCount = 1
+	}
+
+	frames := make([]int, tickCount)
+	frame := 0
+	frameEnd := delays[0].seconds()
+	for tick := range frames {
+		// Sample the middle of each tick, to avoid favouring the frames either side of a boundary
+		t := (float64(tick) + 0.5) / fps
+		for t >= frameEnd && frame < len(delays)-1 {
+			frame++
+			frameEnd += delays[frame].seconds()
+		}
+		frames[tick] = frame
+	}
+	return frames
+}
+
+func fitDelays(delays []Delay, duration time.Duration) []Delay {
+	// Scales `delays` proportionally so that together they last exactly `duration`, to the millisecond.
+
+	var total float64
+	for _, d := range delays {
+		total += d.seconds()
+	}
+
+	// Round the running total rather than each delay, so rounding errors don't accumulate
+	fitted := make([]Delay, len(delays))
+	scale := duration.Seconds() / total
+	var elapsed float64
+	var elapsedMilliseconds uint64
+	for i, d := range delays {
+		elapsed += d.seconds() * scale
+		milliseconds := uint64(math.Round(elapsed * 1000))
+		frameMilliseconds := milliseconds - elapsedMilliseconds
+		if milliseconds <= elapsedMilliseconds {
+			// Every frame needs some time on screen
+			frameMilliseconds = 1
+		}
+		elapsedMilliseconds += frameMilliseconds
+		fitted[i] = reducedDelay(frameMilliseconds, 1000)
+	}
+	return fitted
+}
+
+func fpsToDelay(fps float64) Delay {
+	// Converts a frame rate to the delay of a single frame.
+
+	numerator := uint64(1000)
+	denominator := uint64(math.Round(fps * 1000))
+	for denominator > math.MaxUint16 {
+		numerator /= 10
+		denominator = uint64(math.Round(fps * float64(numerator)))
+	}
+	if denominator == 0 {
+		denominator = 1
+	}
+	return reducedDelay(numerator, denominator)
+}
+
+// ReadDelays reads the delay manifest at path, as for Options.Delays: one frame delay per line, either as a whole number
+// of hundredths of a second like GIF uses, or as a fraction of a second such as 1/30. Blank lines and lines starting
+// with # are ignored.
+func ReadDelays(path string) ([]Delay, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var delays []Delay
+	for n, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		numerator, denominator, isFraction := strings.Cut(line, "/")
+		if !isFraction {
+			denominator = "100"
+		}
+		num, numErr := strconv.ParseUint(strings.TrimSpace(numerator), 10, 64)
+		den, denErr := strconv.ParseUint(strings.TrimSpace(denominator), 10, 64)
+		if numErr != nil || denErr != nil || num == 0 || den == 0 {
+			return nil, fmt.Errorf("invalid delay on line %d: %s", n+1, line)
+		}
+		delays = append(delays, reducedDelay(num, den))
+	}
+	return delays, nil
+}
+
+// WriteDelays writes delays to path as a delay manifest that ReadDelays reads back, one fraction of a second per line.
+// Unknown delays, being zero, are written as 1/10, which is what Interpolate gives them by default.
+func WriteDelays(path string, delays []Delay) error {
+	var manifest strings.Builder
+	for _, d := range delays {
+		if d.Num == 0 {
+			d = Delay{1, 10}
+		}
+		_, _ = fmt.Fprintf(&manifest, "%d/%d\n", d.Num, d.Den)
+	}
+	return os.WriteFile(path, []byte(manifest.String()), 0644)
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Above this many frames, passing every frame path to img2webp risks exceeding the platform's
+// command line length limit (only around 32K characters on Windows), so fall back to an argument file.
+const maxInlineFrames = 250
+
+func useArgumentFile(img2webpArgs string, frameCount uint64) bool {
+	// Decides whether img2webp is passed its arguments for `frameCount` frames in a file, as Options.Img2webpArgs asks.
+
+	if img2webpArgs == "auto" {
+		return frameCount > maxInlineFrames
+	}
+	return img2webpArgs == "file"
+}
+
+func sourceAlphaDeviation(alphaDir, mergedDir, inputPaddingSpecifier, outputPaddingSpecifier string, frameCount, factor uint64) (uint8, error) {
+	// Finds the largest difference between the alpha of each of the `frameCount` source frames in `alphaDir`, numbered from 0,
+	// and that of the merged frame made from it in `mergedDir` by interpolating by `factor`.
+
+	var deviation uint8
+	for i := uint64(0); i < frameCount; i++ {
+		// Original frames come first in each run of interpolated frames, counting from 1
+		frameDeviation, err := maxAlphaDeviation(
+			filepath.Join(alphaDir, fmt.Sprintf(inputPaddingSpecifier, i)),
+			filepath.Join(mergedDir, fmt.Sprintf(outputPaddingSpecifier, i*factor+1)),
+		)
+		if err != nil {
+			return 0, err
+		}
+		if frameDeviation > deviation {
+			deviation = frameDeviation
+		}
+	}
+	return deviation, nil
+}
+
+func maxAlphaDeviation(sourceAlpha, merged string) (uint8, error) {
+	// Finds the largest difference between the grayscale alpha frame at path `sourceAlpha`
+	// and the alpha channel of the merged frame at path `merged`.
+
+	alphaImage, err := decodePNG(sourceAlpha)
+	if err != nil {
+		return 0, err
+	}
+	mergedImage, err := decodePNG(merged)
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := alphaImage.Bounds()
+	if bounds.Size() != mergedImage.Bounds().Size() {
+		return 0, fmt.Errorf("%s is %v, but %s is %v", filepath.Base(sourceAlpha), bounds.Size(), filepath.Base(merged), mergedImage.Bounds().Size())
+	}
+	offset := mergedImage.Bounds().Min.Sub(bounds.Min)
+
+	var deviation uint8
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			expected := color.GrayModel.Convert(alphaImage.At(x, y)).(color.Gray).Y
+			actual := color.NRGBAModel.Convert(mergedImage.At(x+offset.X, y+offset.Y)).(color.NRGBA).A
+			difference := expected - actual
+			if actual > expected {
+				difference = actual - expected
+			}
+			if difference > deviation {
+				deviation = difference
+			}
+		}
+	}
+	return deviation, nil
+}
+
+func collapseDuplicates(dirs []string, paddingSpecifier string, delays []Delay) ([]Delay, error) {
+	// Removes each frame that's identical in every one of `dirs` to the frame before it, numbering the remaining frames
+	// consecutively from 0, and returns their `delays`, each extended by those of the frames collapsed into it.
+	// Runs with unknown delays are left alone, as they have no total duration to give the remaining frame.
+
+	kept := []Delay{delays[0]}
+	previous := make([]image.Image, len(dirs))
+	for i := range delays {
+		current := make([]image.Image, len(dirs))
+		for j, dir := range dirs {
+			var err error
+			if current[j], err = decodePNG(filepath.Join(dir, fmt.Sprintf(paddingSpecifier, i))); err != nil {
+				return nil, err
+			}
+		}
+
+		identical := i > 0 && delays[i].Num != 0 && kept[len(kept)-1].Num != 0
+		for j := range dirs {
+			if !identical {
+				break
+			}
+			difference, err := frameDifference(previous[j], current[j])
+			if err != nil {
+				return nil, err
+			}
+			identical = difference == 0
+		}
+
+		if identical {
+			last := kept[len(kept)-1]
+			kept[len(kept)-1] = last.add(delays[i])
+			for _, dir := range dirs {
+				if err := os.Remove(filepath.Join(dir, fmt.Sprintf(paddingSpecifier, i))); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// Duplicates are compared against the first frame of their run, which is what's kept
+		previous = current
+		if i > 0 {
+			kept = append(kept, delays[i])
+		}
+		if index := len(kept) - 1; index != i {
+			for _, dir := range dirs {
+				if err := os.Rename(filepath.Join(dir, fmt.Sprintf(paddingSpecifier, i)), filepath.Join(dir, fmt.Sprintf(paddingSpecifier, index))); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return kept, nil
+}
+
+func findSceneCuts(frameDir, paddingSpecifier string, frameCount uint64, threshold float64) ([]uint64, error) {
+	// Lists the indices of frames in `frameDir`, numbered from 0, that differ from the following frame
+	// by more than `threshold`, as a mean fraction of each colour channel's range.
+
+	var cuts []uint64
+	previous, err := decodePNG(filepath.Join(frameDir, fmt.Sprintf(paddingSpecifier, 0)))
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(1); i < frameCount; i++ {
+		current, err := decodePNG(filepath.Join(frameDir, fmt.Sprintf(paddingSpecifier, i)))
+		if err != nil {
+			return nil, err
+		}
+		difference, err := frameDifference(previous, current)
+		if err != nil {
+			return nil, err
+		}
+		if difference > threshold {
+			cuts = append(cuts, i-1)
+		}
+		previous = current
+	}
+	return cuts, nil
+}
+
+func frameDifference(a, b image.Image) (float64, error) {
+	// Measures the mean absolute difference between the colour channels of `a` and `b`, from 0 for identical images to 1.
+
+	bounds := a.Bounds()
+	if bounds.Size() != b.Bounds().Size() {
+		return 0, fmt.Errorf("frames are different sizes, %v and %v", bounds.Size(), b.Bounds().Size())
+	}
+	offset := b.Bounds().Min.Sub(bounds.Min)
+
+	var total uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x+offset.X, y+offset.Y).RGBA()
+			total += absDifference(r1, r2) + absDifference(g1, g2) + absDifference(b1, b2)
+		}
+	}
+	return float64(total) / (3 * 0xFFFF * float64(bounds.Dx()*bounds.Dy())), nil
+}
+
+func absDifference(a, b uint32) uint64 {
+	if a > b {
+		return uint64(a - b)
+	}
+	return uint64(b - a)
+}
+
+func decodePNG(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	return png.Decode(file)
+}
+
+func countFrames(dir string) (uint64, error) {
+	// Counts the PNG frames in `dir`.
+
+	frames, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	return uint64(len(frames)), err
+}
+
+func checkExtracted(frameDir, alphaDir string, frameCount uint64) (opaque bool, err error) {
+	// Checks that `frameCount` frames were extracted into `frameDir`, and as many alpha frames into `alphaDir`, unless it's empty.
+	// Sources no alpha could be extracted from at all are reported as opaque, to be interpolated without it.
+
+	extractedFrames, err := countFrames(frameDir)
+	if err != nil {
+		return false, fmt.Errorf("error checking extracted frames:\n  %w", err)
+	}
+	if extractedFrames != frameCount {
+		return false, fmt.Errorf("error extracting frames from source:\n  Expected %d frames, but %d were extracted.", frameCount, extractedFrames)
+	}
+	if alphaDir == "" {
+		return false, nil
+	}
+	extractedAlpha, err := countFrames(alphaDir)
+	if err != nil {
+		return false, fmt.Errorf("error checking extracted alpha:\n  %w", err)
+	}
+	if extractedAlpha == 0 {
+		return true, nil
+	}
+	if extractedAlpha != frameCount {
+		return false, fmt.Errorf("error extracting alpha from source frames:\n  Expected alpha for %d frames, but %d were extracted.", frameCount, extractedAlpha)
+	}
+	return false, nil
+}
+
+func checkFrames(dir, paddingSpecifier string, frameCount uint64) error {
+	// Verifies that `dir` contains frames named by `paddingSpecifier` numbered from 1 to `frameCount`.
+
+	for i := uint64(1); i <= frameCount; i++ {
+		frameName := fmt.Sprintf(paddingSpecifier, i)
+		if _, err := os.Stat(filepath.Join(dir, frameName)); err != nil {
+			found, _ := countFrames(dir)
+			return fmt.Errorf("Expected %d frames named like %s, but %s is missing (%d PNG files found). "+
+				"This rife build may not support custom output name patterns with -f.", frameCount, fmt.Sprintf(paddingSpecifier, 1), frameName, found)
+		}
+	}
+	return nil
+}
+
+func coalesce(count uint64, errChannel chan error, cancel context.CancelFunc) error {
+	var err error
+	for i := uint64(0); i < count; i++ {
+		if procErr := <-errChannel; procErr != nil && err == nil {
+			// Save only the first error, cancelling the rest of the work, but wait for all channels to report back
+			err = procErr
+			cancel()
+		}
+	}
+	return err
+}
+
+func copyFile(src, dst string) (int64, error) {
+	// From https://opensource.com/article/18/6/copying-files-go
+	sourceFileStat, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	if !sourceFileStat.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", src)
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer func(source *os.File) { _ = source.Close() }(source)
+
+	destination, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer func(destination *os.File) { _ = destination.Close() }(destination)
+	nBytes, err := io.Copy(destination, source)
+	return nBytes, err
+}
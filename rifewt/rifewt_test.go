@@ -0,0 +1,270 @@
+package rifewt
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterlacedGIF(t *testing.T) {
+	// testdata/interlaced.gif holds the same two 16x13 frames as testdata/noninterlaced.gif, with their rows
+	// stored in interlaced order, 13 rows being enough to reach every one of the four passes.
+
+	interlaced, interlacedLoops, err := decodeGIF(filepath.Join("testdata", "interlaced.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, plainLoops, err := decodeGIF(filepath.Join("testdata", "noninterlaced.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interlaced) != 2 || len(interlaced) != len(plain) {
+		t.Fatalf("decoded %d interlaced and %d non-interlaced frames, want 2 of each", len(interlaced), len(plain))
+	}
+	if interlacedLoops != plainLoops {
+		t.Errorf("interlaced GIF loops %d times, non-interlaced %d", interlacedLoops, plainLoops)
+	}
+	for i := range interlaced {
+		if interlaced[i].delay != plain[i].delay {
+			t.Errorf("frame %d: delay %v, want %v", i, interlaced[i].delay, plain[i].delay)
+		}
+		if !bytes.Equal(interlaced[i].image.Pix, plain[i].image.Pix) {
+			t.Errorf("frame %d: interlaced pixels differ from non-interlaced ones", i)
+		}
+	}
+
+	// The frames extracted from it for rife are written non-interlaced
+	dir := t.TempDir()
+	for i, frame := range interlaced {
+		framePath := filepath.Join(dir, "frame"+string(rune('0'+i))+".png")
+		alphaPath := filepath.Join(dir, "alpha"+string(rune('0'+i))+".png")
+		if err = splitFrame(frame.image, framePath, alphaPath, color.RGBA{0x36, 0x39, 0x3F, 0xFF}, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{framePath, alphaPath} {
+			if interlace := pngInterlaceMethod(t, path); interlace != 0 {
+				t.Errorf("%s has interlace method %d, want 0", filepath.Base(path), interlace)
+			}
+		}
+	}
+}
+
+func pngInterlaceMethod(t *testing.T, path string) byte {
+	// Reads the interlace method from the IHDR chunk of the PNG at `path`, 0 for none and 1 for Adam7.
+
+	t.Helper()
+	chunks := readTestChunks(t, path)
+	if len(chunks) == 0 || chunks[0].kind != "IHDR" || len(chunks[0].data) != 13 {
+		t.Fatalf("%s doesn't start with an IHDR chunk", filepath.Base(path))
+	}
+	return chunks[0].data[12]
+}
+
+func TestCheckExtracted(t *testing.T) {
+	tests := []struct {
+		name          string
+		frames, alpha int
+		// noAlpha checks the frames alone, as for sources interpolated without alpha
+		noAlpha    bool
+		wantOpaque bool
+		wantErr    string
+	}{
+		{name: "matching", frames: 3, alpha: 3},
+		{name: "missing frames", frames: 2, alpha: 3, wantErr: "Expected 3 frames, but 2 were extracted."},
+		{name: "missing alpha", frames: 3, alpha: 2, wantErr: "Expected alpha for 3 frames, but 2 were extracted."},
+		{name: "extra alpha", frames: 3, alpha: 4, wantErr: "Expected alpha for 3 frames, but 4 were extracted."},
+		{name: "no alpha", frames: 3, alpha: 0, wantOpaque: true},
+		{name: "alpha not wanted", frames: 3, alpha: 0, noAlpha: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frameDir, alphaDir := t.TempDir(), t.TempDir()
+			writeEmptyFrames(t, frameDir, test.frames)
+			writeEmptyFrames(t, alphaDir, test.alpha)
+			if test.noAlpha {
+				alphaDir = ""
+			}
+
+			opaque, err := checkExtracted(frameDir, alphaDir, 3)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one saying %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opaque != test.wantOpaque {
+				t.Errorf("got opaque %v, want %v", opaque, test.wantOpaque)
+			}
+		})
+	}
+}
+
+func writeEmptyFrames(t *testing.T, dir string, count int) {
+	// Writes `count` empty files named as extracted frames into `dir`, which is all checkExtracted looks at.
+
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d.png", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOnceFrames(t *testing.T) {
+	// Played once, no frame is interpolated across the loop seam, leaving (frameCount-1)*factor+1 frames
+	// lasting as long as the source does from its first frame to its last.
+
+	// The third delay is missing, so it's taken from DefaultFPS as 1/10s
+	sourceDelays := []Delay{{1, 10}, {1, 5}, {0, 1}, {1, 10}, {3, 20}}
+	opts := Options{DefaultFPS: 10}
+	for _, factor := range []uint64{2, 3, 4} {
+		for frameCount := uint64(2); frameCount <= uint64(len(sourceDelays)); frameCount++ {
+			t.Run(fmt.Sprintf("%d frames by %d", frameCount, factor), func(t *testing.T) {
+				inputCount, finalCount := rifeFrameCounts(frameCount, frameCount, factor, true)
+				if inputCount != frameCount || finalCount != (frameCount-1)*factor+1 {
+					t.Fatalf("rife is fed %d frames and %d are kept, want %d and %d", inputCount, finalCount, frameCount, (frameCount-1)*factor+1)
+				}
+
+				delays := interpolatedDelays(sourceDelays[:frameCount], factor, frameCount, frameCount, finalCount, true, opts)
+				if uint64(len(delays)) != finalCount {
+					t.Fatalf("%d delays for %d frames", len(delays), finalCount)
+				}
+				var total, interior Delay = Delay{0, 1}, Delay{0, 1}
+				for _, d := range delays {
+					total = total.add(d)
+				}
+				for _, d := range sourceDelays[:frameCount-1] {
+					if d.Num == 0 {
+						d = Delay{1, 10}
+					}
+					interior = interior.add(d)
+				}
+				if total != interior {
+					t.Errorf("frames last %d/%d s, want the source's interior of %d/%d s", total.Num, total.Den, interior.Num, interior.Den)
+				}
+			})
+		}
+	}
+
+	// Looping, the copy of the first frame is interpolated to as well, and the whole source's time is kept
+	inputCount, finalCount := rifeFrameCounts(5, 5, 2, false)
+	if inputCount != 6 || finalCount != 11 {
+		t.Errorf("looping, rife is fed %d frames and %d are kept, want 6 and 11", inputCount, finalCount)
+	}
+	delays := interpolatedDelays(sourceDelays, 2, 5, 5, finalCount, false, opts)
+	var total Delay = Delay{0, 1}
+	for _, d := range delays[:10] {
+		total = total.add(d)
+	}
+	if total != (Delay{13, 20}) {
+		t.Errorf("looping frames before the first frame's copy last %d/%d s, want 13/20 s", total.Num, total.Den)
+	}
+}
+
+func TestMaxAlphaDeviation(t *testing.T) {
+	dir := t.TempDir()
+	alpha := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range alpha.Pix {
+		alpha.Pix[i] = uint8(i * 20)
+	}
+	alphaPath := filepath.Join(dir, "alpha.png")
+	writeTestPNG(t, alphaPath, alpha)
+
+	tests := []struct {
+		name string
+		// change alters the merged frame, which otherwise has exactly the source alpha, under a different colour
+		change func(merged *image.NRGBA)
+		want   uint8
+	}{
+		{"matching", func(*image.NRGBA) {}, 0},
+		{"more opaque", func(merged *image.NRGBA) { merged.Pix[4*5+3] += 9 }, 9},
+		{"less opaque", func(merged *image.NRGBA) { merged.Pix[4*11+3] -= 12 }, 12},
+		{"largest of several", func(merged *image.NRGBA) { merged.Pix[3] += 3; merged.Pix[4*7+3] -= 30 }, 30},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := image.NewNRGBA(alpha.Bounds())
+			for i, a := range alpha.Pix {
+				merged.Pix[4*i], merged.Pix[4*i+1], merged.Pix[4*i+2], merged.Pix[4*i+3] = 0x20, uint8(i), 0xC0, a
+			}
+			test.change(merged)
+			mergedPath := filepath.Join(dir, "merged.png")
+			writeTestPNG(t, mergedPath, merged)
+
+			deviation, err := maxAlphaDeviation(alphaPath, mergedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deviation != test.want {
+				t.Errorf("deviation %d, want %d", deviation, test.want)
+			}
+		})
+	}
+
+	// Frames of different sizes can't be compared
+	mergedPath := filepath.Join(dir, "larger.png")
+	writeTestPNG(t, mergedPath, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	if _, err := maxAlphaDeviation(alphaPath, mergedPath); err == nil {
+		t.Error("frames of different sizes were compared")
+	}
+}
+
+func TestSourceAlphaDeviation(t *testing.T) {
+	// Each source frame i is compared with merged frame i*factor+1, rather than any frame interpolated between them,
+	// which here are all fully opaque, so comparing one would show a large deviation.
+
+	const frameCount = 3
+	for _, factor := range []uint64{2, 3, 4} {
+		t.Run(fmt.Sprintf("factor %d", factor), func(t *testing.T) {
+			alphaDir, mergedDir := t.TempDir(), t.TempDir()
+			sourceAlpha := func(i uint64) uint8 { return uint8(10 + 40*i) }
+			for i := uint64(0); i < frameCount; i++ {
+				alpha := image.NewGray(image.Rect(0, 0, 2, 2))
+				for p := range alpha.Pix {
+					alpha.Pix[p] = sourceAlpha(i)
+				}
+				writeTestPNG(t, filepath.Join(alphaDir, fmt.Sprintf("%02d.png", i)), alpha)
+			}
+			// Looping output, ending with the copy of the first frame
+			writeMerged := func(frame uint64, alpha uint8) {
+				merged := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+				for p := 3; p < len(merged.Pix); p += 4 {
+					merged.Pix[p] = alpha
+				}
+				writeTestPNG(t, filepath.Join(mergedDir, fmt.Sprintf("%03d.png", frame)), merged)
+			}
+			for frame := uint64(1); frame <= frameCount*factor+1; frame++ {
+				alpha := uint8(0xFF)
+				if (frame-1)%factor == 0 {
+					alpha = sourceAlpha((frame - 1) / factor % frameCount)
+				}
+				writeMerged(frame, alpha)
+			}
+
+			deviation, err := sourceAlphaDeviation(alphaDir, mergedDir, "%02d.png", "%03d.png", frameCount, factor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deviation != 0 {
+				t.Errorf("deviation %d, want 0", deviation)
+			}
+
+			// A change to the last source frame's own output frame is found
+			writeMerged((frameCount-1)*factor+1, sourceAlpha(frameCount-1)+6)
+			if deviation, err = sourceAlphaDeviation(alphaDir, mergedDir, "%02d.png", "%03d.png", frameCount, factor); err != nil {
+				t.Fatal(err)
+			}
+			if deviation != 6 {
+				t.Errorf("deviation %d, want 6", deviation)
+			}
+		})
+	}
+}
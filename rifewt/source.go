@@ -0,0 +1,158 @@
+package rifewt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"path/filepath"
+)
+
+// sourceAnimation is what probing a source finds out about it, ahead of extracting its frames.
+type sourceAnimation struct {
+	// format names the kind of source: "APNG", "GIF", "video", "WebP", or otherwise the backend that read it.
+	format string
+
+	// frames holds the decoded frames of APNG and GIF sources, which are split in Go rather than by the backend,
+	// and is nil for other sources. Videos are decoded by ffmpeg into the scratch directory instead.
+	frames []composedFrame
+	video  videoInfo
+
+	count uint64
+	// delays lists the delay of each frame, zero where unknown.
+	delays []Delay
+	// loops is how many times the source plays, or 0 if it loops forever, as videos are taken to.
+	loops uint64
+}
+
+func probeSource(ctx context.Context, tools backend, ffmpeg, ffprobe, source, scratchDir string, warnings *log.Logger) (sourceAnimation, error) {
+	// Reads the frame count, timing, and loop count of `source`, decoding its frames if it's an APNG or GIF,
+	// or for videos, extracting them into `scratchDir` with `ffmpeg`, or if `scratchDir` is empty,
+	// estimating how many there are from the video's length and frame rate.
+
+	// ImageMagick only sees the first frame of an APNG, so APNGs are decoded here instead, as are GIFs, to save running the backend;
+	// both are split into frames and alpha here too. Videos are decoded with ffmpeg, and written out to be split the same way.
+	var src sourceAnimation
+	var err error
+	if isAPNG(source) {
+		src.format = "APNG"
+		if src.frames, src.loops, err = decodeAPNG(source); err != nil {
+			return sourceAnimation{}, fmt.Errorf("error reading APNG source:\n  %w", err)
+		}
+		src.count = uint64(len(src.frames))
+	} else if isVideo(source) {
+		src.format = "video"
+		if src.video, err = probeVideo(ctx, ffprobe, source); err != nil {
+			return sourceAnimation{}, fmt.Errorf("error reading video source:\n  %w", err)
+		}
+		if scratchDir == "" {
+			if src.video.duration == 0 || src.video.frameDelay.Num == 0 {
+				return sourceAnimation{}, fmt.Errorf("error reading video source:\n  Its length or frame rate is unknown, so its frames can't be counted without decoding them.")
+			}
+			src.count = uint64(math.Round(src.video.duration / src.video.frameDelay.seconds()))
+		} else if err = extractVideoFrames(ctx, ffmpeg, src.video, source, scratchDir); err != nil {
+			return sourceAnimation{}, fmt.Errorf("error extracting frames from video source:\n  %w", err)
+		} else if src.count, err = countFrames(scratchDir); err != nil {
+			return sourceAnimation{}, fmt.Errorf("error checking extracted frames:\n  %w", err)
+		}
+		src.delays = make([]Delay, src.count)
+		for i := range src.delays {
+			src.delays[i] = src.video.frameDelay
+		}
+	} else if frames, loops, gifErr := decodeGIF(source); gifErr == nil {
+		src.format = "GIF"
+		src.frames, src.loops = frames, loops
+		src.count = uint64(len(src.frames))
+	} else {
+		// Anything else, including GIFs too unusual for image/gif, is left to the backend
+		src.format = tools.name()
+		if src.delays, err = tools.probe(ctx, source); err != nil {
+			return sourceAnimation{}, fmt.Errorf("error getting number of frames in source:\n  %w", err)
+		}
+		src.count = uint64(len(src.delays))
+
+		// Animated WebPs time frames in milliseconds, which the backends don't always report faithfully,
+		// so read their timing directly
+		webp, err := readWebPAnimation(source)
+		if err != nil && !errors.Is(err, errNotAnimatedWebP) {
+			return sourceAnimation{}, fmt.Errorf("error reading WebP animation:\n  %w", err)
+		}
+		if err == nil {
+			if uint64(len(webp.durations)) != src.count {
+				// Older ImageMagick builds, and most ffmpeg builds, decode only the first frame of an animated WebP
+				return sourceAnimation{}, fmt.Errorf("error reading source frames:\n  The source has %d frames, but %s found %d. "+
+					"Decoding animated WebPs requires ImageMagick 7.0.10 or later, built with libwebp.", len(webp.durations), tools.name(), src.count)
+			}
+			src.format = "WebP"
+			src.loops = webp.loops
+			for i, milliseconds := range webp.durations {
+				src.delays[i] = Delay{}
+				if milliseconds > 0 {
+					src.delays[i] = reducedDelay(milliseconds, 1000)
+				}
+			}
+		} else if src.loops, err = readGIFLoops(source); err != nil {
+			if !errors.Is(err, errNotGIF) {
+				warnings.Printf("couldn't read the source's loop count, so the output will loop forever: %s", err)
+			}
+			src.loops = 0
+		}
+	}
+
+	if src.frames != nil {
+		src.delays = make([]Delay, src.count)
+		for i, frame := range src.frames {
+			src.delays[i] = frame.delay
+		}
+	}
+	return src, nil
+}
+
+func extractSource(ctx context.Context, tools backend, src *sourceAnimation, source, frameDir, alphaDir, scratchDir, paddingSpecifier, background string, noAlpha bool, errChannel chan error, cancel context.CancelFunc) error {
+	// Writes each frame of `source`, as probed into `src`, into `frameDir` as an opaque PNG numbered from 0 by `paddingSpecifier`,
+	// with fully transparent pixels taking on the colour `background`, and its alpha into `alphaDir`, unless `noAlpha` is set,
+	// in which case the frames are flattened against `background`. Decoded frames are released once they're written.
+
+	if src.frames == nil && src.format != "video" {
+		return tools.extract(ctx, source, frameDir, alphaDir, scratchDir, paddingSpecifier, background, noAlpha)
+	}
+
+	matte, err := resolveColour(ctx, tools, background)
+	if err != nil {
+		return fmt.Errorf("error reading matte colour:\n  %w", err)
+	}
+
+	if src.format == "video" {
+		paths, err := filepath.Glob(filepath.Join(scratchDir, "*.png"))
+		if err != nil {
+			return fmt.Errorf("error extracting frames from source:\n  %w", err)
+		}
+		return splitFrameFiles(ctx, paths, frameDir, alphaDir, paddingSpecifier, matte, noAlpha)
+	}
+
+	// As when merging, each frame takes a slot like an external program, to stay within the job limit
+	for i, frame := range src.frames {
+		go func(i int, frame *image.NRGBA, result chan error) {
+			release, localErr := acquire(ctx)
+			if localErr != nil {
+				result <- localErr
+				return
+			}
+			defer release()
+
+			name := fmt.Sprintf(paddingSpecifier, i)
+			if localErr := splitFrame(frame, filepath.Join(frameDir, name), filepath.Join(alphaDir, name), matte, noAlpha); localErr != nil {
+				result <- fmt.Errorf("error extracting frames from source:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(i, frame.image, errChannel)
+	}
+	if err = coalesce(uint64(len(src.frames)), errChannel, cancel); err != nil {
+		return err
+	}
+	src.frames = nil
+	return nil
+}
@@ -0,0 +1,91 @@
+package rifewt
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+)
+
+// bytesPerPixel is the space allowed for each pixel of each frame written to the temporary directory.
+// Interpolated frames compress poorly, so PNGs are taken to be as large as raw RGBA.
+const bytesPerPixel = 4
+
+// spaceMargin leaves 1/spaceMargin of the estimated space needed spare, for PNGs that compress worse than expected
+// and anything else writing to the same disk.
+const spaceMargin = 10
+
+func tempSpaceNeeded(size image.Point, inputFrames, factor, streams uint64, sizes []uint64) uint64 {
+	// Estimates the bytes written to the temporary directory for `inputFrames` frames of `size` interpolated by `factor`,
+	// in `streams` pipelines (colour, and alpha unless it's skipped): each stream's extracted and interpolated frames,
+	// then the merged frames, and a downscaled copy of them for each of `sizes`.
+
+	frameBytes := uint64(size.X) * uint64(size.Y) * bytesPerPixel
+	outputFrames := inputFrames * factor
+	needed := frameBytes * (streams*(inputFrames+outputFrames) + outputFrames)
+	for _, bound := range sizes {
+		// Copies fit within a square, so have at most its area, or the frames' if they're smaller
+		pixels := bound * bound
+		if area := uint64(size.X) * uint64(size.Y); area < pixels {
+			pixels = area
+		}
+		needed += pixels * bytesPerPixel * outputFrames
+	}
+	return needed
+}
+
+func checkTempSpace(dir string, needed uint64) error {
+	// Fails with ErrInsufficientSpace if the filesystem holding `dir` has less than `needed` bytes free,
+	// or has a little more, as the estimate is rough. Filesystems whose free space can't be read are assumed to have enough.
+
+	free, err := FreeSpace(dir)
+	if err != nil || free >= needed+needed/spaceMargin {
+		return nil
+	}
+	return causedError{ErrInsufficientSpace, fmt.Errorf("The frames need about %s, but only %s is free in %s.",
+		formatBytes(needed), formatBytes(free), filepath.Dir(dir))}
+}
+
+func sourceSize(source, sourceDir string, composedFrames []composedFrame) (image.Point, bool) {
+	// Finds the size of the source's frames, from frames already decoded or extracted into `sourceDir` if there are any,
+	// unless it's empty, and otherwise from the source's header. Returns false for formats whose header isn't understood here.
+
+	if len(composedFrames) > 0 {
+		return composedFrames[0].image.Bounds().Size(), true
+	}
+	if sourceDir != "" {
+		if frames, _ := filepath.Glob(filepath.Join(sourceDir, "*.png")); len(frames) > 0 {
+			source = frames[0]
+		}
+	}
+
+	if webp, err := readWebPAnimation(source); err == nil && webp.canvas != (image.Point{}) {
+		return webp.canvas, true
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return image.Point{}, false
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Point{}, false
+	}
+	return image.Point{X: config.Width, Y: config.Height}, true
+}
+
+func formatBytes(bytes uint64) string {
+	// Formats `bytes` in the largest binary unit that keeps it at least 1, to one decimal place.
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,442 @@
+package rifewt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SourceOptions selects how Inspect, Extract, and Convert read a source animation.
+type SourceOptions struct {
+	// Source is the path of the animation to read.
+	Source string
+
+	// Backend selects the image tool used to read sources that aren't decoded in Go, as for Options.Backend.
+	Backend string
+
+	// TempDir is the directory to create the temporary directory in, or empty for the system's.
+	// Videos are decoded into it in full, even by Inspect, to count their frames.
+	TempDir string
+
+	// Warnings reports problems that don't stop the run. If nil, they're discarded.
+	Warnings *log.Logger
+}
+
+// Animation describes a source animation's frames and timing.
+type Animation struct {
+	// Format names the kind of source: "APNG", "GIF", "video", "WebP", or otherwise the backend that read it.
+	Format string
+
+	// Frames is the number of frames, each of Size, or a zero Size if it couldn't be read.
+	Frames uint64
+	Size   image.Point
+
+	// Delays lists the delay of each frame, zero where the source doesn't give one.
+	Delays []Delay
+
+	// Loops is the number of times the animation plays, or 0 if it loops forever.
+	Loops uint64
+
+	// Transparent is set if any pixel of any frame is less than fully opaque, or for videos, if they have an alpha channel.
+	// It's only filled in by Inspect.
+	Transparent bool
+}
+
+// Estimate is a rough forecast of an interpolation run, made by Animation.Estimate.
+type Estimate struct {
+	Factor uint64
+
+	// Frames is the number of frames the output will have.
+	Frames uint64
+
+	// Bytes is roughly how large the output will be in the source's own format,
+	// taking interpolated frames to compress about as well as the source's.
+	Bytes int64
+
+	// TempBytes is roughly how much space the run's temporary frames will take, as checked before extracting them.
+	TempBytes uint64
+}
+
+// AssembleOptions holds the settings for assembling frames into an animation with Assemble.
+type AssembleOptions struct {
+	// Frames is a directory of PNG frames, played in the order of their names.
+	Frames string
+
+	// Alpha, if set, is a directory of grayscale PNGs, named as in Frames, to apply to the frames as their alpha,
+	// as Extract writes them. Otherwise the frames keep their own alpha.
+	Alpha string
+
+	// Dest is the path of the output, a GIF, WebP, or WebM if its extension is .gif, .webp, or .webm, or otherwise an APNG.
+	Dest string
+
+	// Delays, if set, gives each frame's delay, with zero delays and any unset lasting 1/FPS seconds.
+	// An FPS of 0 selects the default of 10.
+	Delays []Delay
+	FPS    float64
+
+	// Loops is the number of times the output plays, or 0 to loop forever.
+	Loops uint64
+
+	// AlphaThreshold, Optimize, and Lossy are as for Options.
+	AlphaThreshold uint8
+	Optimize       bool
+	Lossy          uint
+
+	// TempDir is the directory to create the temporary directory in, or empty for the system's.
+	TempDir string
+
+	// Overwrite replaces Dest if it already exists. Otherwise assembly fails with ErrOutputExists before doing anything.
+	Overwrite bool
+
+	// Warnings reports problems that don't stop the run. If nil, they're discarded.
+	Warnings *log.Logger
+}
+
+func (o SourceOptions) withDefaults() SourceOptions {
+	// Fills in the defaults for any unset options in `o`.
+
+	if o.Backend == "" {
+		o.Backend = "auto"
+	}
+	if o.Warnings == nil {
+		o.Warnings = log.New(io.Discard, "", 0)
+	}
+	return o
+}
+
+func (o AssembleOptions) withDefaults() AssembleOptions {
+	// Fills in the defaults for any unset options in `o`.
+
+	if o.FPS == 0 {
+		o.FPS = 10
+	}
+	if o.AlphaThreshold == 0 {
+		o.AlphaThreshold = 128
+	}
+	if o.Warnings == nil {
+		o.Warnings = log.New(io.Discard, "", 0)
+	}
+	return o
+}
+
+func readSource(ctx context.Context, opts SourceOptions, scratchDir string) (backend, sourceAnimation, error) {
+	// Locates the tools needed to read `opts.Source`, and probes it, using `scratchDir` for any frames decoded along the way.
+
+	tools, err := findBackend(ctx, opts.Backend)
+	if err != nil {
+		return nil, sourceAnimation{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	var ffmpeg, ffprobe string
+	if isVideo(opts.Source) {
+		if ffmpeg, err = findProgram("ffmpeg"); err != nil {
+			return nil, sourceAnimation{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+		if ffprobe, err = findProgram("ffprobe"); err != nil {
+			return nil, sourceAnimation{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+		}
+	}
+
+	src, err := probeSource(ctx, tools, ffmpeg, ffprobe, opts.Source, scratchDir, opts.Warnings)
+	if err != nil {
+		return nil, sourceAnimation{}, stageError("probe", err)
+	}
+	return tools, src, nil
+}
+
+func (src sourceAnimation) describe(source, scratchDir string) Animation {
+	// Summarises what's known of `source` from probing it, reading its size from its decoded frames or header.
+
+	size, _ := sourceSize(source, scratchDir, src.frames)
+	return Animation{Format: src.format, Frames: src.count, Size: size, Delays: src.delays, Loops: src.loops}
+}
+
+// Estimate forecasts the output of interpolating the animation by factor, looping unless once is set,
+// from the size of the source file in bytes.
+func (a Animation) Estimate(factor uint64, once bool, sourceBytes int64) Estimate {
+	// As in Interpolate, looping animations have a copy of the first frame appended, whose interpolated frames are dropped
+	inputFrames := a.Frames + 1
+	if once {
+		inputFrames = a.Frames
+	}
+	estimate := Estimate{Factor: factor}
+	if inputFrames > 0 {
+		estimate.Frames = (inputFrames-1)*factor + 1
+	}
+	if a.Frames > 0 {
+		estimate.Bytes = sourceBytes * int64(estimate.Frames) / int64(a.Frames)
+	}
+	streams := uint64(1)
+	if a.Transparent {
+		streams = 2
+	}
+	estimate.TempBytes = tempSpaceNeeded(a.Size, inputFrames, factor, streams, nil)
+	return estimate
+}
+
+// Inspect reads the frame count, size, timing, and loop count of the animation at path opts.Source,
+// and whether it has any transparency, which for sources read by the backend means extracting their alpha.
+func Inspect(ctx context.Context, opts SourceOptions) (Animation, error) {
+	opts = opts.withDefaults()
+
+	dir, err := os.MkdirTemp(opts.TempDir, "rife-inspection-*")
+	if err != nil {
+		return Animation{}, fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	defer func(path string) { _ = os.RemoveAll(path) }(dir)
+
+	tools, src, err := readSource(ctx, opts, dir)
+	if err != nil {
+		return Animation{}, err
+	}
+	animation := src.describe(opts.Source, dir)
+	if animation.Transparent, err = src.transparent(ctx, tools, opts.Source, dir); err != nil {
+		return Animation{}, stageError("extraction", fmt.Errorf("error checking source for transparency:\n  %w", err))
+	}
+	return animation, nil
+}
+
+func (src sourceAnimation) transparent(ctx context.Context, tools backend, source, scratchDir string) (bool, error) {
+	// Reports whether any pixel of `source`, as probed into `src`, is less than fully opaque,
+	// extracting its alpha into `scratchDir` if it was neither decoded in Go nor is a video.
+
+	switch {
+	case src.frames != nil:
+		for _, frame := range src.frames {
+			for i := 3; i < len(frame.image.Pix); i += 4 {
+				if frame.image.Pix[i] != 255 {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case src.format == "video":
+		return src.video.alpha, nil
+	}
+
+	frameDir, alphaDir := filepath.Join(scratchDir, "Frames"), filepath.Join(scratchDir, "Alpha")
+	for _, childDir := range []string{frameDir, alphaDir} {
+		if err := os.Mkdir(childDir, 0600); err != nil {
+			return false, fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+	}
+	paddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(src.count, 10)))
+	if err := tools.extract(ctx, source, frameDir, alphaDir, scratchDir, paddingSpecifier, defaultMatte, false); err != nil {
+		return false, err
+	}
+	// Backends write no alpha for sources without any
+	if alphaFrames, err := countFrames(alphaDir); err != nil || alphaFrames == 0 {
+		return false, err
+	}
+	opaque, err := allOpaque(alphaDir)
+	return !opaque, err
+}
+
+// Extract splits the animation at path opts.Source into the frames that Interpolate feeds to rife, writing each frame
+// into the Frames subdirectory of dir as an opaque PNG, numbered from 0, with fully transparent pixels taking on the colour
+// background (or the default matte colour if empty, or as for Options.Background, "auto"), and its alpha into the Alpha
+// subdirectory as a grayscale PNG of the same name. With noAlpha set, the frames are flattened against background instead,
+// and no alpha is written. Both subdirectories are created if need be.
+func Extract(ctx context.Context, opts SourceOptions, dir, background string, noAlpha bool) (Animation, error) {
+	opts = opts.withDefaults()
+
+	scratchDir, err := os.MkdirTemp(opts.TempDir, "rife-extraction-*")
+	if err != nil {
+		return Animation{}, fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	defer func(path string) { _ = os.RemoveAll(path) }(scratchDir)
+
+	tools, src, err := readSource(ctx, opts, scratchDir)
+	if err != nil {
+		return Animation{}, err
+	}
+	animation := src.describe(opts.Source, scratchDir)
+
+	if background == "" {
+		background = defaultMatte
+	} else if background == "auto" {
+		background = defaultMatte
+		if matte, ok := autoMatte(matteFrames(opts.Source, scratchDir, src.frames)); ok {
+			background = hexColour(matte)
+		}
+	}
+
+	frameDir, alphaDir := filepath.Join(dir, "Frames"), filepath.Join(dir, "Alpha")
+	for _, childDir := range []string{frameDir, alphaDir} {
+		if err = os.MkdirAll(childDir, 0755); err != nil {
+			return Animation{}, fmt.Errorf("error creating output directory:\n  %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errChannel := make(chan error)
+	defer close(errChannel)
+
+	paddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.FormatUint(src.count, 10)))
+	if err = extractSource(ctx, tools, &src, opts.Source, frameDir, alphaDir, scratchDir, paddingSpecifier, background, noAlpha, errChannel, cancel); err != nil {
+		return Animation{}, stageError("extraction", err)
+	}
+	return animation, nil
+}
+
+// Assemble builds an animation at path opts.Dest from the frames in opts.Frames,
+// applying the alpha in opts.Alpha to them first if it's set.
+func Assemble(ctx context.Context, opts AssembleOptions) error {
+	opts = opts.withDefaults()
+	if opts.FPS < 0 {
+		return errors.New("frame rate must be positive")
+	}
+	if opts.Lossy > 0 && !opts.Optimize {
+		return errors.New("-lossy only has an effect with -optimize")
+	}
+
+	framePaths, err := filepath.Glob(filepath.Join(opts.Frames, "*.png"))
+	if err != nil {
+		return fmt.Errorf("error finding frames:\n  %w", err)
+	}
+	if len(framePaths) == 0 {
+		return fmt.Errorf("error finding frames:\n  There are no PNG frames in %s.", opts.Frames)
+	}
+	if opts.Delays != nil && len(opts.Delays) != len(framePaths) {
+		return fmt.Errorf("error applying frame delays:\n  %d delays given, but there are %d frames.", len(opts.Delays), len(framePaths))
+	}
+	if !opts.Overwrite {
+		if err = checkOutputs(opts.Dest); err != nil {
+			return err
+		}
+	}
+
+	asm, err := findAssembler(opts.Dest, opts.Optimize)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(opts.TempDir, "rife-assembly-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	defer func(path string) { _ = os.RemoveAll(path) }(dir)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errChannel := make(chan error)
+	defer close(errChannel)
+
+	// The assembler expects frames numbered from 1, as rife writes them, with their alpha already applied
+	paddingSpecifier := fmt.Sprintf("%%0%dd.png", len(strconv.Itoa(len(framePaths))))
+	for i, framePath := range framePaths {
+		go func(framePath, stagedPath string, result chan error) {
+			release, localErr := acquire(ctx)
+			if localErr != nil {
+				result <- localErr
+				return
+			}
+			defer release()
+
+			if opts.Alpha != "" {
+				localErr = mergeFrame(framePath, filepath.Join(opts.Alpha, filepath.Base(framePath)), stagedPath, color.RGBA{}, 0, 0, nil)
+			} else if localErr = os.Link(framePath, stagedPath); localErr != nil {
+				// Maybe hardlinking just isn't supported
+				_, localErr = copyFile(framePath, stagedPath)
+			}
+			if localErr != nil {
+				result <- fmt.Errorf("error preparing frames for assembly:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(framePath, filepath.Join(dir, fmt.Sprintf(paddingSpecifier, i+1)), errChannel)
+	}
+	if err = coalesce(uint64(len(framePaths)), errChannel, cancel); err != nil {
+		return stageError("merge", err)
+	}
+
+	delays := make([]Delay, len(framePaths))
+	copy(delays, opts.Delays)
+	for i, d := range delays {
+		if d.Num == 0 {
+			delays[i] = fpsToDelay(opts.FPS)
+		}
+	}
+
+	asm.lossy = opts.Lossy
+	asm.warnings = opts.Warnings
+	asm.argumentFile = useArgumentFile("auto", uint64(len(framePaths)))
+	asm.paddingSpecifier = paddingSpecifier
+	asm.frameCount = uint64(len(framePaths))
+	asm.delays = delays
+	asm.loops = opts.Loops
+	asm.alphaThreshold = opts.AlphaThreshold
+	if err = asm.assemble(ctx, dir, opts.Dest); err != nil {
+		return stageError("assembly", err)
+	}
+	return nil
+}
+
+// Convert rewrites the animation at path source.Source in another format, assembled as by Assemble with the settings
+// in assembly, but for its Frames, Alpha, and Loops, which come from the source, and its Delays, which do too if nil.
+func Convert(ctx context.Context, source SourceOptions, assembly AssembleOptions) error {
+	source = source.withDefaults()
+	// Checked before extracting, rather than once that's been done for nothing
+	if !assembly.Overwrite {
+		if err := checkOutputs(assembly.Dest); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp(source.TempDir, "rife-conversion-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	defer func(path string) { _ = os.RemoveAll(path) }(dir)
+
+	animation, err := Extract(ctx, source, dir, "", false)
+	if err != nil {
+		return err
+	}
+
+	assembly.Frames, assembly.Alpha, assembly.Loops = filepath.Join(dir, "Frames"), filepath.Join(dir, "Alpha"), animation.Loops
+	if assembly.TempDir == "" {
+		assembly.TempDir = source.TempDir
+	}
+	if assembly.Delays == nil {
+		assembly.Delays = animation.Delays
+	}
+	// Backends write no alpha for sources without any
+	if alphaFrames, err := countFrames(assembly.Alpha); err != nil || alphaFrames == 0 {
+		assembly.Alpha = ""
+	}
+	return Assemble(ctx, assembly)
+}
+
+func findAssembler(dest string, optimize bool) (assembler, error) {
+	// Locates the programs needed to assemble an animation at path `dest`, optimizing it if `optimize` is set.
+
+	var asm assembler
+	var err error
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".webp":
+		asm.img2webp, err = findProgram("img2webp")
+	case ".webm":
+		asm.ffmpeg, err = findProgram("ffmpeg")
+	case ".gif":
+		if optimize {
+			asm.gifsicle, err = findProgram("gifsicle")
+		}
+	default:
+		if optimize {
+			asm.pngOptimizer, err = findProgram(pngOptimizers...)
+		}
+	}
+	if err != nil {
+		return assembler{}, fmt.Errorf("error locating dependency:\n  %w", causedError{ErrDependencyMissing, err})
+	}
+	return asm, nil
+}
@@ -0,0 +1,86 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// upscalers are the programs that can upscale frames with -upscale, in order of preference.
+var upscalers = []string{"realesrgan-ncnn-vulkan", "waifu2x-ncnn-vulkan"}
+
+// upscaleFactors are the factors both upscalers support: Real-ESRGAN's anime video model manages 2 to 4, and waifu2x powers of 2.
+var upscaleFactors = map[uint64]bool{2: true, 4: true}
+
+func upscaleCommand(ctx context.Context, upscaler, inputDir, outputDir string, factor uint64, gpus []int) process {
+	// Produces a command upscaling the frames in `inputDir` by `factor` into `outputDir`, keeping their names,
+	// on the devices `gpus`, or the one the upscaler picks if empty.
+
+	args := []string{"-i", inputDir, "-o", outputDir, "-s", strconv.FormatUint(factor, 10), "-f", "png"}
+	// Real-ESRGAN's default model only quadruples, while its anime video model, which suits emotes and stickers, does either
+	if strings.HasPrefix(strings.ToLower(filepath.Base(upscaler)), "realesrgan") {
+		args = append(args, "-n", "realesr-animevideov3")
+	}
+	if len(gpus) > 0 {
+		ids := make([]string, len(gpus))
+		for i, gpu := range gpus {
+			ids[i] = strconv.Itoa(gpu)
+		}
+		args = append(args, "-g", strings.Join(ids, ","))
+	}
+	return command(ctx, upscaler, args...)
+}
+
+func upscaleFrames(ctx context.Context, report progressReporter, upscaler string, factor uint64, dirs []string, gpus [][]int, errChannel chan error, cancel context.CancelFunc) error {
+	// Upscales the frames in each of `dirs` by `factor` at once, on the devices `gpus` assigns to each,
+	// then replaces each directory with its upscaled copy, so later stages find the frames where they left them.
+
+	frameCounts := make([]uint64, len(dirs))
+	var totalFrames uint64
+	upscaledDirs := make([]string, len(dirs))
+	for i, childDir := range dirs {
+		var err error
+		if frameCounts[i], err = countFrames(childDir); err != nil {
+			return fmt.Errorf("error reading frames to upscale:\n  %w", err)
+		}
+		totalFrames += frameCounts[i]
+		upscaledDirs[i] = childDir + "Upscaled"
+		if err := os.Mkdir(upscaledDirs[i], 0600); err != nil {
+			return fmt.Errorf("error creating temporary subdirectory:\n  %w", err)
+		}
+	}
+
+	stopWatching := report.watch("upscaling", totalFrames, upscaledDirs...)
+	defer stopWatching()
+
+	for i := range dirs {
+		go func(inputDir, outputDir string, gpus []int, result chan error) {
+			if localErr := upscaleCommand(ctx, upscaler, inputDir, outputDir, factor, gpus).Run(); localErr != nil {
+				result <- fmt.Errorf("error upscaling frames:\n  %w", localErr)
+				return
+			}
+			result <- nil
+		}(dirs[i], upscaledDirs[i], gpus[i], errChannel)
+	}
+	if err := coalesce(uint64(len(dirs)), errChannel, cancel); err != nil {
+		return err
+	}
+	stopWatching()
+
+	for i, childDir := range dirs {
+		// Frames the upscaler skipped would otherwise surface as confusing failures later
+		if upscaled, err := countFrames(upscaledDirs[i]); err != nil || upscaled != frameCounts[i] {
+			return fmt.Errorf("error reading upscaled frames:\n  Expected %d frames, but %d were upscaled.", frameCounts[i], upscaled)
+		}
+		if err := os.RemoveAll(childDir); err != nil {
+			return fmt.Errorf("error replacing frames with upscaled frames:\n  %w", err)
+		}
+		if err := os.Rename(upscaledDirs[i], childDir); err != nil {
+			return fmt.Errorf("error replacing frames with upscaled frames:\n  %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package rifewt
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// videoExtensions lists the extensions of sources that are decoded with ffmpeg rather than ImageMagick.
+var videoExtensions = map[string]bool{".mp4": true, ".m4v": true, ".mov": true, ".webm": true, ".mkv": true, ".avi": true}
+
+func isVideo(path string) bool {
+	return videoExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// videoInfo describes the first video stream of a video file.
+type videoInfo struct {
+	codec string
+	// frameDelay is zero if the frame rate is unknown.
+	frameDelay Delay
+	alpha      bool
+
+	width, height int
+	// duration is that of the whole file, or zero if it's unknown.
+	duration float64
+}
+
+func probeVideo(ctx context.Context, ffprobe, path string) (videoInfo, error) {
+	// Reads the codec, frame rate, size, and whether there's an alpha channel from the first video stream of the file at path `path`,
+	// along with the file's duration.
+
+	output, err := command(ctx, ffprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,pix_fmt,avg_frame_rate,r_frame_rate,width,height:stream_tags=alpha_mode:format=duration",
+		"-of", "default=noprint_wrappers=1", path).Output()
+	if err != nil {
+		return videoInfo{}, err
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			values[key] = value
+		}
+	}
+	if values["codec_name"] == "" {
+		return videoInfo{}, fmt.Errorf("no video stream found")
+	}
+
+	info := videoInfo{codec: values["codec_name"]}
+	// VP8 and VP9 store alpha as a side stream, flagged by a tag, which ffmpeg's native decoders ignore
+	info.alpha = values["TAG:alpha_mode"] == "1" || pixelFormatHasAlpha(values["pix_fmt"])
+	info.width, _ = strconv.Atoi(values["width"])
+	info.height, _ = strconv.Atoi(values["height"])
+	info.duration, _ = strconv.ParseFloat(values["duration"], 64)
+	for _, rate := range []string{values["avg_frame_rate"], values["r_frame_rate"]} {
+		numerator, denominator, found := strings.Cut(rate, "/")
+		frames, err1 := strconv.ParseUint(numerator, 10, 64)
+		seconds, err2 := strconv.ParseUint(denominator, 10, 64)
+		if found && err1 == nil && err2 == nil && frames > 0 && seconds > 0 {
+			info.frameDelay = reducedDelay(seconds, frames)
+			break
+		}
+	}
+	return info, nil
+}
+
+func pixelFormatHasAlpha(format string) bool {
+	// Reports whether the ffmpeg pixel format `format`, such as yuva420p or rgba, has an alpha channel.
+
+	for _, prefix := range []string{"yuva", "rgba", "argb", "bgra", "abgr", "gbrap", "ya", "pal8"} {
+		if strings.HasPrefix(format, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func extractVideoFrames(ctx context.Context, ffmpeg string, info videoInfo, path, dir string) error {
+	// Decodes every frame of the video at path `path` into `dir` as PNGs, which sort in frame order.
+
+	return command(ctx, ffmpeg, videoFrameArgs(info, path, dir)...).Run()
+}
+
+func videoFrameArgs(info videoInfo, path, dir string) []string {
+	// Produces the ffmpeg arguments that decode every frame of the video at path `path` into `dir`.
+
+	var args []string
+	if info.alpha {
+		// Only the libvpx decoders read the alpha side stream of VP8 and VP9 videos
+		switch info.codec {
+		case "vp8":
+			args = append(args, "-c:v", "libvpx")
+		case "vp9":
+			args = append(args, "-c:v", "libvpx-vp9")
+		}
+	}
+	pixelFormat := "rgb24"
+	if info.alpha {
+		pixelFormat = "rgba"
+	}
+	return append(args, "-i", path, "-map", "0:v:0", "-pix_fmt", pixelFormat, "-v", "error", filepath.Join(dir, "%08d.png"))
+}
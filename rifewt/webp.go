@@ -0,0 +1,100 @@
+package rifewt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// webpAnimation holds the timing of an animated WebP, read directly from its chunks.
+type webpAnimation struct {
+	// durations lists each frame's duration in milliseconds.
+	durations []uint64
+	// loops is the number of times the animation plays, or 0 to loop forever.
+	loops uint64
+	// canvas is the animation's size, or zero if it has no VP8X chunk giving it.
+	canvas image.Point
+}
+
+// errNotAnimatedWebP is returned by readWebPAnimation for files that aren't animated WebPs.
+var errNotAnimatedWebP = errors.New("not an animated WebP")
+
+func readWebPAnimation(path string) (webpAnimation, error) {
+	// Reads the frame timing of the animated WebP at path `path`.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return webpAnimation{}, err
+	}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	var header [12]byte
+	if _, err = io.ReadFull(file, header[:]); err != nil || !bytes.Equal(header[0:4], []byte("RIFF")) || !bytes.Equal(header[8:12], []byte("WEBP")) {
+		return webpAnimation{}, errNotAnimatedWebP
+	}
+
+	var animation webpAnimation
+	animated := false
+	for {
+		// Each chunk is a four character code and a little-endian size, followed by its data, padded to an even length
+		var chunkHeader [8]byte
+		if _, err = io.ReadFull(file, chunkHeader[:]); err != nil {
+			break
+		}
+		fourCC := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		padded := size + size%2
+
+		switch fourCC {
+		case "VP8X":
+			// Flags (1 byte), reserved (3 bytes), then the canvas width and height less one (3 bytes each)
+			var data [10]byte
+			if size < int64(len(data)) {
+				return webpAnimation{}, fmt.Errorf("truncated VP8X chunk")
+			}
+			if _, err = io.ReadFull(file, data[:]); err != nil {
+				return webpAnimation{}, err
+			}
+			animation.canvas.X = int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+			animation.canvas.Y = int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+			padded -= int64(len(data))
+		case "ANIM":
+			// Background colour (4 bytes), then loop count (2 bytes)
+			var data [6]byte
+			if size < int64(len(data)) {
+				return webpAnimation{}, fmt.Errorf("truncated ANIM chunk")
+			}
+			if _, err = io.ReadFull(file, data[:]); err != nil {
+				return webpAnimation{}, err
+			}
+			animated = true
+			animation.loops = uint64(binary.LittleEndian.Uint16(data[4:6]))
+			padded -= int64(len(data))
+		case "ANMF":
+			// Frame X and Y offsets, width and height (3 bytes each), then duration (3 bytes), then flags
+			var data [16]byte
+			if size < int64(len(data)) {
+				return webpAnimation{}, fmt.Errorf("truncated ANMF chunk")
+			}
+			if _, err = io.ReadFull(file, data[:]); err != nil {
+				return webpAnimation{}, err
+			}
+			duration := uint64(data[12]) | uint64(data[13])<<8 | uint64(data[14])<<16
+			animation.durations = append(animation.durations, duration)
+			padded -= int64(len(data))
+		}
+
+		if _, err = file.Seek(padded, io.SeekCurrent); err != nil {
+			return webpAnimation{}, err
+		}
+	}
+
+	if !animated {
+		return webpAnimation{}, errNotAnimatedWebP
+	}
+	return animation, nil
+}
@@ -0,0 +1,1003 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// Job statuses, as reported by the server.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobLogLines is how many of its latest log lines a job keeps for clients streaming its events.
+const jobLogLines = 500
+
+// jobFile is the file in each job's directory recording the job, so it's picked up again after a restart.
+const jobFile = "job.json"
+
+// jobFields are the form fields a job may set options with when it's submitted.
+var jobFields = []string{"x", "fps", "matte", "preset", "once", "no-alpha", "optimize", "reverse", "format"}
+
+// outputFormats maps the formats a job, or -format for output to stdout, may ask for to the extension of the output.
+var outputFormats = map[string]string{"gif": ".gif", "apng": ".png", "png": ".png", "webp": ".webp", "webm": ".webm"}
+
+// job is an upload being interpolated by the server, and what's reported about it.
+type job struct {
+	ID     string `json:"id"`
+	Input  string `json:"input"`
+	Status string `json:"status"`
+	// Stage, Done, and Total are the latest progress, as in rifewt.Progress
+	Stage    string     `json:"stage,omitempty"`
+	Done     uint64     `json:"done"`
+	Total    uint64     `json:"total"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Result describes the output once the job is done, with its download path, or the object it was uploaded to, as the output
+	Result *resultReport `json:"result,omitempty"`
+	// SourceURL names where the job downloads its input from, if anywhere, as an http://, https://, s3://, or gs:// URL,
+	// and DestURL the object it uploads its output to, if any, as an s3:// or gs:// URL
+	SourceURL string `json:"sourceURL,omitempty"`
+	DestURL   string `json:"destURL,omitempty"`
+
+	// dir holds the job's upload, output, temporary frames, and jobFile, and nothing else,
+	// with source and dest naming the upload and output within it
+	dir    string
+	source string
+	dest   string
+	// fields are the options the job was submitted with, from jobFields
+	fields map[string]string
+	// cancel stops the job while it's queued or running, and started is when it last started running
+	cancel  context.CancelFunc
+	started time.Time
+
+	// logs holds the job's latest warnings, and with -verbose, the programs it ran and their output,
+	// out of loggedLines written in all
+	logs        []string
+	loggedLines int
+	// changed is closed, and replaced, whenever the job changes, to wake clients streaming its events
+	changed chan struct{}
+}
+
+func (j job) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// jobRecord is what's saved of a job in its jobFile.
+type jobRecord struct {
+	job
+	Source string            `json:"source"`
+	Dest   string            `json:"dest"`
+	Fields map[string]string `json:"fields"`
+}
+
+// jobLog is written to by a job's loggers, adding each line to the job's logs.
+type jobLog struct {
+	server *jobServer
+	job    *job
+}
+
+func (l jobLog) Write(p []byte) (int, error) {
+	lines := strings.Split(strings.TrimRight(string(p), "\n"), "\n")
+	l.server.update(l.job, func() {
+		l.job.logs = append(l.job.logs, lines...)
+		l.job.loggedLines += len(lines)
+		if len(l.job.logs) > jobLogLines {
+			l.job.logs = l.job.logs[len(l.job.logs)-jobLogLines:]
+		}
+	})
+	return len(p), nil
+}
+
+// jobServer runs the jobs submitted to it over HTTP, a few at a time.
+type jobServer struct {
+	ctx       context.Context
+	workDir   string
+	base      rifewt.Options
+	run       runSettings
+	maxUpload int64
+	buckets   map[string]bool
+	urls      bool
+	keep      time.Duration
+	slots     chan struct{}
+	logger    *log.Logger
+	metrics   *metrics
+
+	mutex sync.Mutex
+	jobs  map[string]*job
+	wg    sync.WaitGroup
+	// saveMutex is held while recording a job, so that records are written one at a time, in order
+	saveMutex sync.Mutex
+}
+
+func runServe(args []string) {
+	// Serves an HTTP API to interpolate uploaded animations, until interrupted.
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	finishFlags := interpolationFlags(flags)
+	listen := flags.String("listen", ":8080", "`address` to listen on")
+	workDir := flags.String("work", "", "`directory` to keep each job's upload, output, and temporary frames in, and to resume unfinished jobs from (default a new temporary directory)")
+	maxUpload := flags.String("max-upload", "100MB", "largest upload `size` to accept")
+	concurrent := flags.Int("concurrent", 1, "number of jobs to interpolate at once; the GPU is shared, so more rarely helps")
+	keep := flags.Duration("keep", time.Hour, "how long to keep finished jobs, and their outputs, before deleting them")
+	allowURLSources := flags.Bool("allow-url-sources", false, "let jobs download their input from an http:// or https:// URL in \"source\", from public addresses only")
+	buckets := flags.String("buckets", "", "comma-separated `buckets`, as s3://bucket or gs://bucket, that jobs may download objects from and upload outputs to (default none, refusing object URLs)")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s serve [flags]\ninterpolation flags set the defaults for every job\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	errorLogger := log.New(os.Stderr, "", 0)
+	if err := applyDefaults(flags, args); err != nil {
+		errorLogger.Fatal("error reading default options:\n  ", err)
+	}
+	if args = parseArgs(flags, args); len(args) != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts, run := finishFlags()
+	if opts.Poster != "" || opts.Delays != nil || run.dryRun {
+		errorLogger.Fatal("-poster, -delays, and -dry-run can't be used with serve")
+	}
+	uploadLimit, err := parseByteSize(*maxUpload)
+	if err != nil || uploadLimit <= 0 {
+		errorLogger.Fatal("invalid maximum upload size: " + *maxUpload)
+	}
+	if *concurrent < 1 {
+		errorLogger.Fatal("number of concurrent jobs must be at least 1")
+	}
+	if *keep <= 0 {
+		errorLogger.Fatal("time to keep finished jobs must be positive")
+	}
+	allowedBuckets, err := parseBuckets(*buckets)
+	if err != nil {
+		errorLogger.Fatal(err)
+	}
+
+	// A temporary work directory is removed on exit, while one that was asked for keeps its jobs for next time
+	temporary := *workDir == ""
+	if temporary {
+		if *workDir, err = os.MkdirTemp(opts.TempDir, "rifewt-serve-"); err != nil {
+			errorLogger.Fatal("error creating work directory:\n  ", err)
+		}
+	} else if err = os.MkdirAll(*workDir, 0700); err != nil {
+		errorLogger.Fatal("error creating work directory:\n  ", err)
+	}
+	if *workDir, err = filepath.Abs(*workDir); err != nil {
+		errorLogger.Fatal("error recognizing work directory:\n  ", err)
+	}
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	server := &jobServer{
+		ctx:       ctx,
+		workDir:   *workDir,
+		base:      opts,
+		run:       run,
+		maxUpload: uploadLimit,
+		buckets:   allowedBuckets,
+		urls:      *allowURLSources,
+		keep:      *keep,
+		slots:     make(chan struct{}, *concurrent),
+		logger:    errorLogger,
+		metrics:   newMetrics(),
+		jobs:      make(map[string]*job),
+	}
+	if err = server.load(); err != nil {
+		errorLogger.Fatal("error reading jobs from work directory:\n  ", err)
+	}
+	go server.expire()
+	httpServer := &http.Server{Addr: *listen, Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+
+	errorLogger.Printf("listening on %s", *listen)
+	err = httpServer.ListenAndServe()
+	stop()
+	server.wg.Wait()
+	if temporary {
+		_ = os.RemoveAll(*workDir)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		errorLogger.Fatal("error serving:\n  ", err)
+	}
+	errorLogger.Print("interrupted")
+	os.Exit(exitInterrupted)
+}
+
+func parseBuckets(list string) (map[string]bool, error) {
+	// Parses -buckets, a comma-separated list of buckets as s3://bucket or gs://bucket, with or without a trailing slash.
+
+	buckets := make(map[string]bool)
+	for _, bucket := range strings.Split(list, ",") {
+		bucket = strings.TrimSuffix(strings.TrimSpace(bucket), "/")
+		if bucket == "" {
+			continue
+		}
+		scheme, name, _ := strings.Cut(bucket, "://")
+		if (scheme != "s3" && scheme != "gs") || name == "" || strings.Contains(name, "/") {
+			return nil, errors.New("invalid bucket: " + bucket)
+		}
+		buckets[bucket] = true
+	}
+	return buckets, nil
+}
+
+func (s *jobServer) checkBucket(object objectURL) error {
+	// Checks that `object` is in one of the buckets allowed by -buckets, as the server's own credentials
+	// would otherwise let anyone who can reach it read or replace any object they cover.
+
+	if !s.buckets[object.bucketURL()] {
+		return fmt.Errorf("objects in %s can't be used; the server only accepts those in the buckets given with -buckets", object.bucketURL())
+	}
+	return nil
+}
+
+func (s *jobServer) checkURLSource() error {
+	// Checks that jobs may download their input from a URL, which they may only with -allow-url-sources,
+	// as it has the server make requests on a client's behalf.
+
+	if !s.urls {
+		return errors.New("URL sources can't be used; the server only downloads them with -allow-url-sources")
+	}
+	return nil
+}
+
+func (s *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Routes requests: GET /jobs lists the jobs, and POST /jobs submits one, while for each job,
+	// GET /jobs/ID reports on it, GET /jobs/ID/events streams its progress, GET /jobs/ID/output downloads its output,
+	// and POST /jobs/ID/cancel and POST /jobs/ID/retry cancel it or queue it again. GET /metrics exports metrics to Prometheus.
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	var handle func()
+	method := http.MethodGet
+	switch {
+	case path == "jobs" && r.Method == http.MethodPost:
+		handle, method = func() { s.submit(w, r) }, http.MethodPost
+	case path == "jobs":
+		handle = func() { s.list(w, r) }
+	case path == "metrics":
+		handle = func() { s.metrics.ServeHTTP(w, r) }
+	case len(parts) == 2 && parts[0] == "jobs":
+		handle = func() { s.report(w, parts[1]) }
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "output":
+		handle = func() { s.download(w, r, parts[1]) }
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "events":
+		handle = func() { s.streamEvents(w, r, parts[1]) }
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "cancel":
+		handle, method = func() { s.cancelJob(w, parts[1]) }, http.MethodPost
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "retry":
+		handle, method = func() { s.retryJob(w, parts[1]) }, http.MethodPost
+	}
+
+	if handle == nil {
+		writeError(w, http.StatusNotFound, "There's nothing at "+r.URL.Path+".")
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "Use "+method+" for "+r.URL.Path+".")
+		return
+	}
+	handle()
+}
+
+func (s *jobServer) submit(w http.ResponseWriter, r *http.Request) {
+	// Saves the animation uploaded in the multipart form field "file" into a directory of its own,
+	// or notes the URL or object named in the field "source" to download there when the job runs,
+	// and queues a job to interpolate it with the options in the other fields, replying with the job.
+	// The output is uploaded to the object named in the field "dest", if there is one.
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Uploads may be at most %d bytes.", s.maxUpload))
+		} else {
+			writeError(w, http.StatusBadRequest, "error reading upload:\n  "+err.Error())
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	sourceURL, destURL := r.FormValue("source"), r.FormValue("dest")
+	upload, header, err := r.FormFile("file")
+	input := ""
+	switch {
+	case err == nil && sourceURL != "":
+		_ = upload.Close()
+		writeError(w, http.StatusBadRequest, "Give either an upload in \"file\" or a URL in \"source\", not both.")
+		return
+	case err == nil:
+		defer upload.Close()
+		input = header.Filename
+	case isInputURL(sourceURL):
+		if err = s.checkURLSource(); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		input = inputURLName(sourceURL)
+	case sourceURL != "":
+		object, ok := parseObjectURL(sourceURL)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "unrecognized source URL: "+sourceURL)
+			return
+		}
+		if err = s.checkBucket(object); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		input = path.Base(object.key)
+	default:
+		writeError(w, http.StatusBadRequest, "The animation must be uploaded in the form field \"file\", or named by a URL in \"source\".")
+		return
+	}
+	if destObject, ok := parseObjectURL(destURL); destURL != "" && !ok {
+		writeError(w, http.StatusBadRequest, "unrecognized destination URL: "+destURL)
+		return
+	} else if ok {
+		if err = s.checkBucket(destObject); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	fields := make(map[string]string)
+	for _, name := range jobFields {
+		if value := r.FormValue(name); value != "" {
+			fields[name] = value
+		}
+	}
+	opts, err := s.jobOptions(fields)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "error naming job:\n  "+err.Error())
+		return
+	}
+	j := &job{ID: id, Input: filepath.Base(input), Status: jobQueued, SourceURL: sourceURL, DestURL: destURL, Created: time.Now().UTC(),
+		dir: filepath.Join(s.workDir, id), fields: fields, changed: make(chan struct{})}
+	if j.Input == "." || j.Input == string(filepath.Separator) {
+		j.Input = "input"
+	}
+	if err = os.Mkdir(j.dir, 0700); err != nil {
+		writeError(w, http.StatusInternalServerError, "error creating job directory:\n  "+err.Error())
+		return
+	}
+	// The upload keeps only its extension, which tells videos apart, so it can't collide with the output,
+	// whose name is only seen by the job, so it's named for its format alone
+	j.source = "input" + strings.ToLower(filepath.Ext(j.Input))
+	j.dest = "output" + filepath.Ext(defaultOutputPath(j.source, opts, ""))
+	if format := fields["format"]; format != "" {
+		j.dest = "output" + outputFormats[format]
+	}
+	if upload != nil {
+		err = saveUpload(upload, filepath.Join(j.dir, j.source))
+	}
+	if err == nil {
+		err = s.save(j)
+	}
+	if err != nil {
+		_ = os.RemoveAll(j.dir)
+		writeError(w, http.StatusInternalServerError, "error saving upload:\n  "+err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	s.jobs[id] = j
+	s.queue(j)
+	s.mutex.Unlock()
+
+	s.logger.Printf("%s : queued %s", id, j.Input)
+	snapshot, _ := s.snapshot(id)
+	w.Header().Set("Location", "/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (s *jobServer) jobOptions(fields map[string]string) (rifewt.Options, error) {
+	// Applies the options a job asks for in the form `fields` over the server's own.
+	// Only those choosing what's made are accepted, leaving paths and resource limits to the server.
+
+	opts := s.base
+	if value := fields["x"]; value != "" {
+		factor, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || factor < 2 {
+			return opts, errors.New("invalid interpolation factor: " + value)
+		}
+		opts.Factor = factor
+	}
+	if value := fields["fps"]; value != "" {
+		fps, err := strconv.ParseFloat(value, 64)
+		if err != nil || fps <= 0 {
+			return opts, errors.New("invalid frame rate: " + value)
+		}
+		opts.FPS = fps
+		if fields["x"] == "" {
+			// As on the command line, the factor is chosen to suit the frame rate unless it's given
+			opts.Factor = 0
+		}
+	}
+	if value := fields["matte"]; value != "" {
+		opts.Background = value
+	}
+	if value := fields["preset"]; value != "" {
+		opts.Preset = value
+	}
+	for name, field := range map[string]*bool{"once": &opts.Once, "no-alpha": &opts.NoAlpha, "optimize": &opts.Optimize, "reverse": &opts.Reverse} {
+		if value := fields[name]; value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid value for %s: %s", name, value)
+			}
+			*field = parsed
+		}
+	}
+	if format := fields["format"]; format != "" {
+		if _, ok := outputFormats[format]; !ok {
+			return opts, errors.New("unrecognized output format: " + format)
+		}
+		if opts.Preset != "" {
+			return opts, errors.New("format can't be chosen along with a preset, which decides it")
+		}
+	}
+	opts.Overwrite = true
+	return opts, opts.Validate()
+}
+
+func (s *jobServer) queue(j *job) {
+	// Starts the queued job `j` in the background, to run once a slot is free. The caller must hold s.mutex.
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	j.cancel = cancel
+	s.wg.Add(1)
+	go s.process(ctx, j)
+}
+
+func (s *jobServer) process(ctx context.Context, j *job) {
+	// Interpolates the job `j` once a slot is free, recording its progress and result, unless `ctx` is cancelled first.
+	// Jobs stopped by the server shutting down are left as they are, to be resumed when it's next started.
+
+	defer s.wg.Done()
+	queued := time.Now()
+	s.metrics.enqueue()
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		s.metrics.dequeue()
+		return
+	}
+	defer func() { <-s.slots }()
+	if ctx.Err() != nil {
+		s.metrics.dequeue()
+		return
+	}
+	start := time.Now()
+	s.update(j, func() { j.Status, j.started = jobRunning, start })
+	s.saveLogged(j)
+	s.metrics.start(start.Sub(queued))
+
+	opts, err := s.jobOptions(j.fields)
+	opts.Source, opts.Dest, opts.TempDir = filepath.Join(j.dir, j.source), filepath.Join(j.dir, j.dest), j.dir
+	opts.Progress = func(p rifewt.Progress) {
+		s.update(j, func() { j.Stage, j.Done, j.Total = p.Stage, p.Done, p.Total })
+	}
+	opts.Warnings = log.New(jobLog{s, j}, "warning: ", 0)
+	if opts.Verbose != nil {
+		opts.Verbose = log.New(jobLog{s, j}, "", 0)
+	}
+	runCtx := ctx
+	if s.run.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, s.run.timeout)
+		defer cancel()
+	}
+	// Jobs resumed from a previous run are checked again, in case -buckets or -allow-url-sources has changed since
+	if object, ok := parseObjectURL(j.SourceURL); err == nil && ok {
+		err = s.checkBucket(object)
+	}
+	if object, ok := parseObjectURL(j.DestURL); err == nil && ok {
+		err = s.checkBucket(object)
+	}
+	if err == nil && isInputURL(j.SourceURL) {
+		err = s.checkURLSource()
+	}
+	if err == nil && j.SourceURL != "" {
+		err = s.downloadSource(runCtx, j)
+		opts.Source = filepath.Join(j.dir, j.source)
+	}
+	var res rifewt.Result
+	if err == nil {
+		res, err = rifewt.Interpolate(runCtx, opts)
+	}
+	var destObject objectURL
+	if err == nil && j.DestURL != "" {
+		destObject, _ = parseObjectURL(j.DestURL)
+		s.update(j, func() { j.Stage, j.Done, j.Total = "upload", 0, 0 })
+		if err = uploadOutputs(runCtx, j.dir, destObject); err != nil {
+			err = fmt.Errorf("error uploading output to %s:\n  %w", j.DestURL, err)
+		}
+	}
+	if ctx.Err() != nil {
+		s.metrics.finish(jobCancelled, res, err)
+		return
+	}
+
+	// The job may have been cancelled just as it finished, in which case it stays cancelled
+	finished := time.Now().UTC()
+	var status string
+	if err != nil {
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("error interpolating %s:\n  Timed out after %s.", j.Input, s.run.timeout)
+		}
+		s.update(j, func() {
+			if j.Status == jobRunning {
+				j.Status, j.Error, j.Finished = jobFailed, err.Error(), &finished
+			}
+			status = j.Status
+		})
+		s.logger.Printf("%s : %s", j.ID, err)
+	} else {
+		report := newResultReport(j.Input, res, time.Since(start))
+		report.Output = "/jobs/" + j.ID + "/output"
+		if j.DestURL != "" {
+			report.Output = uploadedObject(res.Dest, destObject).String()
+		}
+		s.update(j, func() {
+			if j.Status == jobRunning {
+				j.Status, j.Result, j.Finished = jobDone, &report, &finished
+			}
+			status = j.Status
+		})
+		s.logger.Printf("%s : %d frames -> %d frames", j.ID, res.SourceFrames, res.OutputFrames)
+	}
+	s.metrics.finish(status, res, err)
+	s.saveLogged(j)
+	if status != jobCancelled {
+		s.notify(j)
+	}
+}
+
+func (s *jobServer) downloadSource(ctx context.Context, j *job) error {
+	// Downloads the job's source, from an object or URL, into its directory, unless it was downloaded
+	// before the server last stopped, holding it to the same limit as uploads.
+
+	if _, err := os.Stat(filepath.Join(j.dir, j.source)); err == nil {
+		return nil
+	}
+	s.update(j, func() { j.Stage, j.Done, j.Total = "download", 0, 0 })
+
+	// The download is only put in place once it's whole, so one cut off by the server stopping is started again
+	partial := filepath.Join(j.dir, "download")
+	_ = os.RemoveAll(partial)
+	err := os.Mkdir(partial, 0700)
+	defer os.RemoveAll(partial)
+	downloaded := filepath.Join(partial, j.source)
+	if object, ok := parseObjectURL(j.SourceURL); err == nil && ok {
+		err = downloadObject(ctx, object, downloaded, s.maxUpload)
+	} else if err == nil {
+		downloaded, err = downloadInput(ctx, publicClient, j.SourceURL, downloaded, s.maxUpload)
+	}
+	if err == nil {
+		err = os.Rename(downloaded, filepath.Join(j.dir, filepath.Base(downloaded)))
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading %s:\n  %w", j.SourceURL, err)
+	}
+	// URLs without extensions are named for their content type once it's known
+	s.update(j, func() { j.source = filepath.Base(downloaded) })
+	return nil
+}
+
+func (s *jobServer) notify(j *job) {
+	// Posts a notification of the finished job `j` to -notify-url, if it was given, in the background.
+
+	if s.run.notifyURL == "" {
+		return
+	}
+	s.mutex.Lock()
+	n := notification{ID: j.ID, Input: j.Input, Status: j.Status, Error: j.Error, Result: j.Result}
+	if j.Result != nil {
+		n.Output = j.Result.Output
+	}
+	if !j.started.IsZero() && j.Finished != nil {
+		n.Elapsed = j.Finished.Sub(j.started).Seconds()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := notify(context.Background(), s.run.notifyURL, n); err != nil {
+			s.logger.Printf("%s : error notifying %s:\n  %s", n.ID, s.run.notifyURL, err)
+		}
+	}()
+}
+
+func (s *jobServer) report(w http.ResponseWriter, id string) {
+	// Replies with the job `id`.
+
+	if j, ok := s.snapshot(id); ok {
+		writeJSON(w, http.StatusOK, j)
+	} else {
+		writeError(w, http.StatusNotFound, "There's no job "+id+".")
+	}
+}
+
+func (s *jobServer) cancelJob(w http.ResponseWriter, id string) {
+	// Stops the job `id` if it's queued or running, replying with the job.
+
+	s.mutex.Lock()
+	j, ok := s.jobs[id]
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "There's no job "+id+".")
+		return
+	}
+
+	cancelled := false
+	finished := time.Now().UTC()
+	s.update(j, func() {
+		if !j.finished() {
+			j.cancel()
+			j.Status, j.Finished = jobCancelled, &finished
+			cancelled = true
+		}
+	})
+	snapshot, _ := s.snapshot(id)
+	if !cancelled {
+		writeError(w, http.StatusConflict, "The job is already "+snapshot.Status+".")
+		return
+	}
+	s.saveLogged(j)
+	s.notify(j)
+	s.logger.Printf("%s : cancelled", id)
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func (s *jobServer) retryJob(w http.ResponseWriter, id string) {
+	// Queues the job `id` again if it failed or was cancelled, replying with the job.
+
+	s.mutex.Lock()
+	j, ok := s.jobs[id]
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "There's no job "+id+".")
+		return
+	}
+
+	queued := false
+	s.update(j, func() {
+		if j.Status == jobFailed || j.Status == jobCancelled {
+			j.Status, j.Stage, j.Done, j.Total, j.Error, j.Finished, j.Result = jobQueued, "", 0, 0, "", nil, nil
+			j.logs, j.loggedLines, j.started = nil, 0, time.Time{}
+			s.queue(j)
+			queued = true
+		}
+	})
+	snapshot, _ := s.snapshot(id)
+	if !queued {
+		writeError(w, http.StatusConflict, "Only failed or cancelled jobs can be retried, and the job is "+snapshot.Status+".")
+		return
+	}
+	s.saveLogged(j)
+	s.logger.Printf("%s : queued again", id)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (s *jobServer) list(w http.ResponseWriter, r *http.Request) {
+	// Replies with every job, oldest first, or only those with the status given by the query parameter "status".
+
+	status := r.URL.Query().Get("status")
+	s.mutex.Lock()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if status == "" || j.Status == status {
+			jobs = append(jobs, *j)
+		}
+	}
+	s.mutex.Unlock()
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Created.Before(jobs[b].Created) })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *jobServer) update(j *job, change func()) {
+	// Makes `change` to the job `j` while no one's reading it, then wakes anyone waiting for it to change.
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change()
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (s *jobServer) snapshot(id string) (job, bool) {
+	// Copies the job `id` as it is now, to report on it.
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (s *jobServer) save(j *job) error {
+	// Records the job `j` in its jobFile, replacing the file whole so that a crash never leaves half of one.
+
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.mutex.Lock()
+	record := jobRecord{*j, j.source, j.dest, j.fields}
+	s.mutex.Unlock()
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(j.dir, jobFile)
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *jobServer) saveLogged(j *job) {
+	// Records the job `j` in its jobFile, only logging any failure, as the job can carry on regardless.
+
+	if err := s.save(j); err != nil {
+		s.logger.Printf("%s : error recording job:\n  %s", j.ID, err)
+	}
+}
+
+func (s *jobServer) load() error {
+	// Picks up the jobs recorded in the work directory by an earlier run, queueing those that hadn't finished again,
+	// oldest first. Directories without a readable jobFile are left alone.
+
+	entries, err := os.ReadDir(s.workDir)
+	if err != nil {
+		return err
+	}
+	var unfinished []*job
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.workDir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, jobFile))
+		if err != nil {
+			continue
+		}
+		var record jobRecord
+		if err = json.Unmarshal(data, &record); err != nil || record.ID != entry.Name() {
+			s.logger.Printf("%s : skipping unreadable job record", entry.Name())
+			continue
+		}
+		j := &record.job
+		j.dir, j.source, j.dest, j.fields, j.changed = dir, record.Source, record.Dest, record.Fields, make(chan struct{})
+		if !j.finished() {
+			j.Status, j.Stage, j.Done, j.Total = jobQueued, "", 0, 0
+			unfinished = append(unfinished, j)
+		}
+		s.jobs[j.ID] = j
+	}
+
+	sort.Slice(unfinished, func(a, b int) bool { return unfinished[a].Created.Before(unfinished[b].Created) })
+	s.mutex.Lock()
+	for _, j := range unfinished {
+		s.queue(j)
+	}
+	s.mutex.Unlock()
+	if len(s.jobs) > 0 {
+		s.logger.Printf("picked up %d jobs, %d of them unfinished", len(s.jobs), len(unfinished))
+	}
+	return nil
+}
+
+func (s *jobServer) expire() {
+	// Deletes finished jobs, and their directories, once they've been kept for s.keep, until the server stops.
+
+	interval := time.Minute
+	if s.keep < interval {
+		interval = s.keep
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*job
+		s.mutex.Lock()
+		for id, j := range s.jobs {
+			if j.Finished != nil && time.Since(*j.Finished) >= s.keep {
+				expired = append(expired, j)
+				delete(s.jobs, id)
+			}
+		}
+		s.mutex.Unlock()
+		for _, j := range expired {
+			_ = os.RemoveAll(j.dir)
+		}
+	}
+}
+
+func (s *jobServer) download(w http.ResponseWriter, r *http.Request, id string) {
+	// Sends the output of the job `id`, named after its upload as the command line would name it, if it's done.
+
+	j, ok := s.snapshot(id)
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, "There's no job "+id+".")
+		return
+	case j.Status == jobFailed:
+		writeError(w, http.StatusConflict, "The job failed:\n  "+j.Error)
+		return
+	case j.Status == jobCancelled:
+		writeError(w, http.StatusConflict, "The job was cancelled.")
+		return
+	case j.Status != jobDone:
+		writeError(w, http.StatusConflict, "The job is still "+j.Status+".")
+		return
+	}
+
+	output, err := os.Open(filepath.Join(j.dir, j.dest))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "The output is gone:\n  "+err.Error())
+		return
+	}
+	defer output.Close()
+	info, err := output.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "error reading output:\n  "+err.Error())
+		return
+	}
+	// Named as the command line would name the output, with the server's -suffix and the extension of the format made.
+	// The job ran, so its options are valid.
+	opts, _ := s.jobOptions(j.fields)
+	name := defaultOutputPath(j.Input, opts, s.run.suffix)
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + filepath.Ext(j.dest)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), output)
+}
+
+func (s *jobServer) streamEvents(w http.ResponseWriter, r *http.Request, id string) {
+	// Streams the job `id` as server-sent events until it finishes: "log" events for each line it logs,
+	// "progress" events for its progress through each stage, and "status" events holding the whole job
+	// whenever its status changes, the last of which is sent once it's done, failed, or cancelled.
+
+	j, ok := s.snapshot(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "There's no job "+id+".")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Events can't be streamed over this connection.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Lines dropped before the client connected, or while it fell behind, are skipped
+	var last job
+	sentLines := 0
+	for {
+		for i := len(j.logs) - (j.loggedLines - sentLines); i < len(j.logs); i++ {
+			if i >= 0 {
+				writeEvent(w, "log", struct {
+					Line string `json:"line"`
+				}{j.logs[i]})
+			}
+		}
+		sentLines = j.loggedLines
+		if j.Stage != last.Stage || j.Done != last.Done || j.Total != last.Total {
+			writeEvent(w, "progress", struct {
+				Stage string `json:"stage"`
+				Done  uint64 `json:"done"`
+				Total uint64 `json:"total"`
+			}{j.Stage, j.Done, j.Total})
+		}
+		if j.Status != last.Status {
+			writeEvent(w, "status", j)
+		}
+		flusher.Flush()
+		if j.finished() {
+			return
+		}
+
+		last = j
+		select {
+		case <-j.changed:
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+		if j, ok = s.snapshot(id); !ok {
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event string, value any) {
+	// Writes a server-sent event named `event`, with `value` as JSON for its data.
+
+	data, _ := json.Marshal(value)
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+func saveUpload(upload io.Reader, path string) error {
+	// Writes everything read from `upload` to a new file at `path`.
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, upload); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func newJobID() (string, error) {
+	// Picks a random ID for a job, which also names its directory.
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	// Replies with `value` as JSON, with the HTTP status `status`.
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	// Replies with a JSON object holding the error `message`, with the HTTP status `status`.
+
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
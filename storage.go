@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body, as signed for requests without one.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectURL names an object in S3, or S3-compatible storage, as s3://bucket/key,
+// or in Google Cloud Storage, as gs://bucket/key.
+type objectURL struct {
+	scheme string
+	bucket string
+	key    string
+}
+
+// objectCredentials are the keys requests to a store are signed with, as AWS Signature Version 4 has it.
+// Google Cloud Storage accepts these signatures too, made with HMAC keys.
+type objectCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+// existingObjectError is the error for an output object that's already there, which matches rifewt.ErrOutputExists,
+// as for output files.
+type existingObjectError string
+
+func (e existingObjectError) Error() string {
+	return string(e) + " already exists. Use -force to replace it, or choose another output path."
+}
+
+func (e existingObjectError) Is(target error) bool {
+	return target == rifewt.ErrOutputExists
+}
+
+func parseObjectURL(s string) (objectURL, bool) {
+	// Picks out the object named by `s`, reporting whether it's an s3:// or gs:// URL naming one.
+
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok || (scheme != "s3" && scheme != "gs") {
+		return objectURL{}, false
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return objectURL{}, false
+	}
+	return objectURL{scheme, bucket, key}, true
+}
+
+func (o objectURL) String() string {
+	return o.scheme + "://" + o.bucket + "/" + o.key
+}
+
+func (o objectURL) bucketURL() string {
+	// Names the object's bucket as s3://bucket or gs://bucket.
+
+	return o.scheme + "://" + o.bucket
+}
+
+func (o objectURL) credentials() objectCredentials {
+	// Reads the credentials for the object's store from the environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+	// AWS_SESSION_TOKEN, and AWS_REGION or AWS_DEFAULT_REGION for S3, and GS_ACCESS_KEY_ID and GS_SECRET_ACCESS_KEY,
+	// an HMAC key, for Cloud Storage. Without keys, requests are sent unsigned, which is enough for public objects.
+
+	if o.scheme == "gs" {
+		return objectCredentials{accessKey: os.Getenv("GS_ACCESS_KEY_ID"), secretKey: os.Getenv("GS_SECRET_ACCESS_KEY"), region: "auto"}
+	}
+	credentials := objectCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       os.Getenv("AWS_REGION"),
+	}
+	if credentials.region == "" {
+		credentials.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if credentials.region == "" {
+		credentials.region = "us-east-1"
+	}
+	return credentials
+}
+
+func (o objectURL) httpURL(region string) (*url.URL, error) {
+	// Works out the HTTP URL of the object, with its key escaped as signatures require. S3 objects are reached at AWS_ENDPOINT_URL, for S3-compatible stores
+	// such as MinIO, if it's set, by path, and otherwise at their bucket's own host, unless its name has dots,
+	// which its TLS certificate doesn't cover.
+
+	segments := strings.Split(o.key, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSigned(segment)
+	}
+	escapedKey := strings.Join(segments, "/")
+	switch {
+	case o.scheme == "gs":
+		return url.Parse("https://storage.googleapis.com/" + o.bucket + "/" + escapedKey)
+	case os.Getenv("AWS_ENDPOINT_URL") != "":
+		return url.Parse(strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/") + "/" + o.bucket + "/" + escapedKey)
+	case strings.Contains(o.bucket, "."):
+		return url.Parse("https://s3." + region + ".amazonaws.com/" + o.bucket + "/" + escapedKey)
+	default:
+		return url.Parse("https://" + o.bucket + ".s3." + region + ".amazonaws.com/" + escapedKey)
+	}
+}
+
+func (o objectURL) newRequest(ctx context.Context, method string, body io.Reader, payloadHash, contentType string) (*http.Request, error) {
+	// Makes a request for the object, signed if there are credentials for its store,
+	// with the hex SHA-256 hash of `body` as `payloadHash`, and `contentType`, if it's set, as its content type.
+
+	credentials := o.credentials()
+	target, err := o.httpURL(credentials.region)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if credentials.accessKey != "" && credentials.secretKey != "" {
+		signRequest(req, payloadHash, credentials, time.Now().UTC())
+	}
+	return req, nil
+}
+
+func signRequest(req *http.Request, payloadHash string, credentials objectCredentials, now time.Time) {
+	// Signs `req` with `credentials` as of `now` by AWS Signature Version 4, covering its host and every header set,
+	// which are all lowercased and canonicalized as the signature requires.
+
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(headers[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Query parameters are sorted, and spaces in them encoded as %20 rather than +
+	query := req.URL.Query()
+	var canonicalQuery []string
+	for _, name := range sortedKeys(query) {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, escapeSigned(name)+"="+escapeSigned(value))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + credentials.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + credentials.secretKey)
+	for _, part := range []string{date, credentials.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.accessKey, scope, signedHeaders, signature))
+}
+
+func escapeSigned(s string) string {
+	// Percent-encodes `s` as AWS signatures require, leaving only unreserved characters as they are.
+
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func objectError(res *http.Response) error {
+	// Describes the failed response `res` from a store, with the code and message from its XML error if it has one.
+
+	var reply struct {
+		Code    string
+		Message string
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if xml.Unmarshal(body, &reply) == nil && reply.Code != "" {
+		return fmt.Errorf("The store replied %s: %s: %s", res.Status, reply.Code, reply.Message)
+	}
+	return fmt.Errorf("The store replied %s.", res.Status)
+}
+
+func downloadObject(ctx context.Context, object objectURL, path string, limit int64) error {
+	// Downloads `object` into a new file at `path`, failing if it's larger than `limit` bytes, unless `limit` is 0.
+
+	req, err := object.newRequest(ctx, http.MethodGet, nil, emptyPayloadHash, "")
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return objectError(res)
+	}
+	return saveDownload(res, path, limit)
+}
+
+func objectExists(ctx context.Context, object objectURL) bool {
+	// Reports whether `object` is known to exist. Stores may not say when it's missing, as S3 doesn't
+	// without permission to list the bucket, in which case it's taken not to.
+
+	req, err := object.newRequest(ctx, http.MethodHead, nil, emptyPayloadHash, "")
+	if err != nil {
+		return false
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	_ = res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+func uploadObject(ctx context.Context, path string, object objectURL) error {
+	// Uploads the file at `path` to `object`, replacing it if it exists, with the content type of its extension.
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// A body whose length is given as 0 is otherwise taken to be of unknown length, and sent in chunks, which stores refuse
+	var body io.Reader = file
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := object.newRequest(ctx, http.MethodPut, body, hex.EncodeToString(hash.Sum(nil)), objectContentType(object.key))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return objectError(res)
+	}
+	return nil
+}
+
+func uploadedObject(file string, output objectURL) objectURL {
+	// Names the object the staged output `file` is uploaded to, for the output object `output`, which is the same
+	// but for the extension, which presets may change, and the size appended to downscaled copies.
+
+	uploaded := output
+	uploaded.key = strings.TrimSuffix(output.key, path.Ext(output.key)) + strings.TrimPrefix(filepath.Base(file), "output")
+	return uploaded
+}
+
+func uploadOutputs(ctx context.Context, staging string, output objectURL) error {
+	// Uploads the outputs staged in `staging` for the output object `output`: every file named from "output",
+	// including downscaled copies, each to the object named by uploadedObject.
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), "output") {
+			continue
+		}
+		file := filepath.Join(staging, entry.Name())
+		if err = uploadObject(ctx, file, uploadedObject(file, output)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectContentType(key string) string {
+	// Chooses the content type to store an output named `key` with.
+
+	switch strings.ToLower(path.Ext(key)) {
+	case ".gif":
+		return "image/gif"
+	case ".png", ".apng":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	case ".webm":
+		return "video/webm"
+	}
+	return "application/octet-stream"
+}
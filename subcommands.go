@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// subcommands maps the name of each subcommand, other than the default of interpolate, to what runs it
+// with the arguments following its name.
+var subcommands = map[string]func(args []string){
+	"extract":  runExtract,
+	"assemble": runAssemble,
+	"convert":  runConvert,
+	"info":     runInfo,
+	"watch":    runWatch,
+	"serve":    runServe,
+	"discord":  runDiscord,
+	"telegram": runTelegram,
+	"doctor": func(args []string) {
+		ctx, stop := subcommandContext()
+		healthy := runDoctor(ctx, os.Stdout)
+		stop()
+		if !healthy {
+			os.Exit(1)
+		}
+	},
+}
+
+// estimateFactors are the interpolation factors info forecasts the output of.
+var estimateFactors = []uint64{2, 3, 4}
+
+// infoReport is what info prints with -json.
+type infoReport struct {
+	Format string `json:"format"`
+	Frames uint64 `json:"frames"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Delays are in seconds, with 0 for frames without a delay
+	Delays      []float64      `json:"delays"`
+	Duration    float64        `json:"duration"`
+	Loops       uint64         `json:"loops"`
+	Transparent bool           `json:"transparent"`
+	Bytes       int64          `json:"bytes"`
+	Estimates   []infoEstimate `json:"estimates"`
+}
+
+// infoEstimate forecasts interpolating the source by Factor, in info's JSON.
+type infoEstimate struct {
+	Factor uint64 `json:"factor"`
+	Frames uint64 `json:"frames"`
+	// Bytes is the output's likely size in the source's format, and TempBytes that of the temporary frames
+	Bytes     int64  `json:"bytes"`
+	TempBytes uint64 `json:"tempBytes"`
+}
+
+// delaysFile is the delay manifest written by extract beside the frames, and read by assemble from the same place.
+const delaysFile = "delays.txt"
+
+func newSubcommandFlags(name, usage string) *flag.FlagSet {
+	// Creates the flag set for the subcommand `name`, whose positional arguments are described by `usage`.
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s %s [flags] %s\nflags may be given before or after the positional arguments\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func sourceFlags(flags *flag.FlagSet) *rifewt.SourceOptions {
+	// Adds the flags choosing how sources are read to `flags`, returning the options they set.
+
+	opts := &rifewt.SourceOptions{Warnings: log.New(os.Stderr, "warning: ", 0)}
+	flags.StringVar(&opts.Backend, "backend", "auto", "image tool for sources not decoded in Go: magick, ffmpeg, or auto")
+	flags.StringVar(&opts.TempDir, "tmpdir", "", "`directory` to write temporary frames in (default TMPDIR, or the system's)")
+	return opts
+}
+
+func assemblyFlags(flags *flag.FlagSet) (*rifewt.AssembleOptions, func()) {
+	// Adds the flags controlling assembly to `flags`, returning the options they set,
+	// and a function to check them once `flags` is parsed.
+
+	opts := &rifewt.AssembleOptions{Warnings: log.New(os.Stderr, "warning: ", 0)}
+	alphaThreshold := flags.Uint("alpha-threshold", 128, "least alpha, from 1 to 255, a pixel needs to stay visible in GIF output")
+	flags.BoolVar(&opts.Optimize, "optimize", false, "shrink GIF output with gifsicle -O3, and APNG output with apngopt, oxipng, or zopflipng")
+	flags.UintVar(&opts.Lossy, "lossy", 0, "gifsicle lossy compression `level` for -optimize, such as 80 (default lossless)")
+	flags.BoolVar(&opts.Overwrite, "force", false, "replace the output if it already exists")
+	return opts, func() {
+		if *alphaThreshold < 1 || *alphaThreshold > 255 {
+			log.New(os.Stderr, "", 0).Fatal("alpha threshold must be between 1 and 255")
+		}
+		opts.AlphaThreshold = uint8(*alphaThreshold)
+	}
+}
+
+func subcommandContext() (context.Context, context.CancelFunc) {
+	// Produces a context for a subcommand that's cancelled by SIGINT or SIGTERM, stopping any running programs.
+
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func exitOnFailure(ctx context.Context, err error) {
+	// Reports `err`, if any, and exits with the status for its cause, or as interrupted if `ctx` was cancelled.
+
+	if err == nil {
+		return
+	}
+	errorLogger := log.New(os.Stderr, "", 0)
+	if ctx.Err() != nil {
+		errorLogger.Print("interrupted")
+		os.Exit(exitInterrupted)
+	}
+	errorLogger.Print(err)
+	os.Exit(failureStatus(err))
+}
+
+func runExtract(args []string) {
+	// Splits a source into opaque frames and grayscale alpha, as fed to rife, along with a delay manifest.
+
+	flags := newSubcommandFlags("extract", "input.gif dir")
+	source := sourceFlags(flags)
+	background := flags.String("matte", "#36393F", "matte `colour` for transparent pixels, or auto to match the edges of transparent areas")
+	noAlpha := flags.Bool("no-alpha", false, "flatten the source against the matte colour, writing no alpha")
+	args = parseArgs(flags, args)
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	source.Source = args[0]
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	animation, err := rifewt.Extract(ctx, *source, args[1], *background, *noAlpha)
+	if err == nil {
+		err = rifewt.WriteDelays(filepath.Join(args[1], delaysFile), animation.Delays)
+	}
+	exitOnFailure(ctx, err)
+	fmt.Printf("%s : %d frames extracted to %s\n", args[0], animation.Frames, args[1])
+}
+
+func runAssemble(args []string) {
+	// Builds an animation from a directory of frames, or from the frames, alpha, and delays written by extract.
+
+	flags := newSubcommandFlags("assemble", "frames-dir output.png|output.gif")
+	opts, checkAssembly := assemblyFlags(flags)
+	flags.StringVar(&opts.Alpha, "alpha", "", "`directory` of grayscale PNGs, named as the frames are, to apply as their alpha")
+	delayManifest := flags.String("delays", "", "`file` listing a delay for each frame")
+	flags.Float64Var(&opts.FPS, "fps", 10, "frame `rate` for frames without a delay")
+	flags.Uint64Var(&opts.Loops, "loops", 0, "number of times the output plays (default 0, forever)")
+	flags.StringVar(&opts.TempDir, "tmpdir", "", "`directory` to write temporary frames in (default TMPDIR, or the system's)")
+	args = parseArgs(flags, args)
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	checkAssembly()
+	errorLogger := log.New(os.Stderr, "", 0)
+	if opts.FPS <= 0 {
+		errorLogger.Fatal("frame rate must be positive")
+	}
+	opts.Frames, opts.Dest = args[0], args[1]
+
+	// A directory written by extract holds the frames, their alpha, and their delays
+	if info, err := os.Stat(filepath.Join(args[0], "Frames")); err == nil && info.IsDir() {
+		opts.Frames = filepath.Join(args[0], "Frames")
+		if alpha, _ := filepath.Glob(filepath.Join(args[0], "Alpha", "*.png")); opts.Alpha == "" && len(alpha) > 0 {
+			opts.Alpha = filepath.Join(args[0], "Alpha")
+		}
+		if _, err = os.Stat(filepath.Join(args[0], delaysFile)); *delayManifest == "" && err == nil {
+			*delayManifest = filepath.Join(args[0], delaysFile)
+		}
+	}
+	if *delayManifest != "" {
+		delays, err := rifewt.ReadDelays(*delayManifest)
+		if err != nil {
+			errorLogger.Fatal("error reading delay manifest:\n  ", err)
+		}
+		opts.Delays = delays
+	}
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	exitOnFailure(ctx, rifewt.Assemble(ctx, *opts))
+	fmt.Printf("%s : assembled into %s\n", args[0], args[1])
+}
+
+func runConvert(args []string) {
+	// Rewrites a source in another format, keeping its frames, timing, and transparency.
+
+	flags := newSubcommandFlags("convert", "input.gif output.png|output.gif")
+	source := sourceFlags(flags)
+	opts, checkAssembly := assemblyFlags(flags)
+	args = parseArgs(flags, args)
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	checkAssembly()
+	source.Source, opts.Dest = args[0], args[1]
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	exitOnFailure(ctx, rifewt.Convert(ctx, *source, *opts))
+	fmt.Printf("%s : converted to %s\n", args[0], args[1])
+}
+
+func runInfo(args []string) {
+	// Prints a source's format, frame count, size, timing, loop count, and transparency,
+	// with estimates of interpolating it, as text or as JSON for scripts.
+
+	flags := newSubcommandFlags("info", "input.gif")
+	source := sourceFlags(flags)
+	asJSON := flags.Bool("json", false, "print a JSON object, with each frame's delay, instead of text")
+	args = parseArgs(flags, args)
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	source.Source = args[0]
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	animation, err := rifewt.Inspect(ctx, *source)
+	exitOnFailure(ctx, err)
+	sourceInfo, err := os.Stat(args[0])
+	exitOnFailure(ctx, err)
+
+	report := infoReport{
+		Format:      animation.Format,
+		Frames:      animation.Frames,
+		Width:       animation.Size.X,
+		Height:      animation.Size.Y,
+		Delays:      make([]float64, len(animation.Delays)),
+		Loops:       animation.Loops,
+		Transparent: animation.Transparent,
+		Bytes:       sourceInfo.Size(),
+	}
+	unknown := 0
+	for i, d := range animation.Delays {
+		if d.Num == 0 {
+			unknown++
+			continue
+		}
+		report.Delays[i] = float64(d.Num) / float64(d.Den)
+		report.Duration += report.Delays[i]
+	}
+	report.Duration = math.Round(report.Duration*1000) / 1000
+	for _, factor := range estimateFactors {
+		estimate := animation.Estimate(factor, false, report.Bytes)
+		report.Estimates = append(report.Estimates, infoEstimate{estimate.Factor, estimate.Frames, estimate.Bytes, estimate.TempBytes})
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		exitOnFailure(ctx, encoder.Encode(report))
+		return
+	}
+	loops := "forever"
+	if animation.Loops > 0 {
+		loops = fmt.Sprintf("%d times", animation.Loops)
+	}
+
+	fmt.Printf("format:   %s\n", animation.Format)
+	fmt.Printf("frames:   %d\n", animation.Frames)
+	if animation.Size != (image.Point{}) {
+		fmt.Printf("size:     %dx%d\n", animation.Size.X, animation.Size.Y)
+	}
+	switch {
+	case unknown == len(animation.Delays):
+		fmt.Println("duration: unknown, as no frame has a delay")
+	case unknown > 0:
+		fmt.Printf("duration: %gs, not counting %d frames without a delay\n", report.Duration, unknown)
+	default:
+		fmt.Printf("duration: %gs\n", report.Duration)
+	}
+	fmt.Printf("plays:    %s\n", loops)
+	fmt.Printf("alpha:    %t\n", report.Transparent)
+	for _, estimate := range report.Estimates {
+		fmt.Printf("at %dx:    %d frames, about %.1f KiB, with %.1f MiB of temporary frames\n",
+			estimate.Factor, estimate.Frames, float64(estimate.Bytes)/(1<<10), float64(estimate.TempBytes)/(1<<20))
+	}
+}
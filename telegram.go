@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// telegramAPI is the base URL of the Telegram Bot API.
+const telegramAPI = "https://api.telegram.org"
+
+// The Bot API's limits on the files bots download and upload, in bytes, and on the length of messages, in characters.
+const (
+	telegramDownloadLimit = 20 * 1000 * 1000
+	telegramUploadLimit   = 50 * 1000 * 1000
+	telegramMessageLimit  = 4096
+)
+
+// telegramHelp is the bot's reply to messages without a file.
+const telegramHelp = "Send me a GIF, APNG, WebP, or video sticker, and I'll send it back smoother. " +
+	"Add a caption to choose how: x3 for three frames for each one (two by default), sticker for a video sticker, or gif for a GIF."
+
+// telegramUpdate is an update from getUpdates, as far as the bot reads it.
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramMessage is a message sent to the bot.
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text      string        `json:"text"`
+	Caption   string        `json:"caption"`
+	Animation *telegramFile `json:"animation"`
+	Document  *telegramFile `json:"document"`
+	Sticker   *struct {
+		telegramFile
+		IsAnimated bool `json:"is_animated"`
+		IsVideo    bool `json:"is_video"`
+	} `json:"sticker"`
+}
+
+// telegramFile is a file attached to a message.
+type telegramFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+// telegramBot answers the messages sent to a Telegram bot, interpolating their files a few at a time.
+type telegramBot struct {
+	ctx    context.Context
+	token  string
+	base   rifewt.Options
+	run    runSettings
+	slots  chan struct{}
+	client *http.Client
+	logger *log.Logger
+	wg     sync.WaitGroup
+
+	// userInterval is how long each user must wait between files, and nextAllowed when each user may next send one,
+	// with busy set for users whose file is being interpolated
+	userInterval time.Duration
+	usersMutex   sync.Mutex
+	nextAllowed  map[int64]time.Time
+	busy         map[int64]bool
+}
+
+func runTelegram(args []string) {
+	// Runs a Telegram bot that interpolates the animations sent to it, until interrupted.
+
+	flags := flag.NewFlagSet("telegram", flag.ExitOnError)
+	finishFlags := interpolationFlags(flags)
+	token := flags.String("token", "", "the bot's `token`, from @BotFather")
+	userInterval := flags.Duration("user-interval", time.Minute, "how long each user must wait between files; each may also only have one file interpolated at a time")
+	concurrent := flags.Int("concurrent", 1, "number of files to interpolate at once")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s telegram [flags]\ninterpolation flags set the defaults for every file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	errorLogger := log.New(os.Stderr, "", 0)
+	if err := applyDefaults(flags, args); err != nil {
+		errorLogger.Fatal("error reading default options:\n  ", err)
+	}
+	if args = parseArgs(flags, args); len(args) != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts, run := finishFlags()
+	if opts.Poster != "" || opts.Delays != nil || run.dryRun {
+		errorLogger.Fatal("-poster, -delays, and -dry-run can't be used with telegram")
+	}
+	if *token == "" {
+		errorLogger.Fatal("-token must be given, or RIFEWT_TOKEN set")
+	}
+	if *userInterval < 0 {
+		errorLogger.Fatal("interval between each user's files can't be negative")
+	}
+	if *concurrent < 1 {
+		errorLogger.Fatal("number of concurrent files must be at least 1")
+	}
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	bot := &telegramBot{
+		ctx:          ctx,
+		token:        *token,
+		base:         opts,
+		run:          run,
+		slots:        make(chan struct{}, *concurrent),
+		client:       &http.Client{Timeout: 2 * time.Minute},
+		logger:       errorLogger,
+		userInterval: *userInterval,
+		nextAllowed:  make(map[int64]time.Time),
+		busy:         make(map[int64]bool),
+	}
+	errorLogger.Print("waiting for messages")
+	bot.poll()
+	bot.wg.Wait()
+	errorLogger.Print("interrupted")
+	os.Exit(exitInterrupted)
+}
+
+func (b *telegramBot) poll() {
+	// Long-polls for messages until the bot is stopped, answering each in the background.
+
+	var offset int64
+	for b.ctx.Err() == nil {
+		var updates []telegramUpdate
+		params := url.Values{"offset": {strconv.FormatInt(offset, 10)}, "timeout": {"50"}, "allowed_updates": {`["message"]`}}
+		if err := b.call(b.ctx, "getUpdates", params, &updates); err != nil {
+			if b.ctx.Err() == nil {
+				b.logger.Print("error getting messages:\n  ", err)
+				select {
+				case <-b.ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				b.wg.Add(1)
+				go b.answer(*update.Message)
+			}
+		}
+	}
+}
+
+func (b *telegramBot) answer(message telegramMessage) {
+	// Interpolates the file in `message`, replying with the output, or otherwise explains what the bot does.
+
+	defer b.wg.Done()
+	var file *telegramFile
+	sticker := false
+	switch {
+	case message.Sticker != nil && message.Sticker.IsAnimated:
+		b.replyText(message, "Animated stickers are drawn as vector shapes, not frames, so there's nothing to interpolate. Video stickers work, though.")
+		return
+	case message.Sticker != nil && !message.Sticker.IsVideo:
+		b.replyText(message, "That sticker isn't animated.")
+		return
+	case message.Sticker != nil:
+		file, sticker = &message.Sticker.telegramFile, true
+	case message.Animation != nil:
+		file = message.Animation
+	case message.Document != nil:
+		file = message.Document
+	default:
+		b.replyText(message, telegramHelp)
+		return
+	}
+	if file.FileSize > telegramDownloadLimit {
+		b.replyText(message, fmt.Sprintf("That file is too large; bots can only download files of up to %d MB.", telegramDownloadLimit/1000/1000))
+		return
+	}
+
+	opts := b.base
+	for _, word := range strings.Fields(strings.ToLower(message.Caption)) {
+		switch {
+		case word == "sticker":
+			sticker = true
+		case word == "gif":
+			sticker = false
+		case strings.HasPrefix(word, "x") || strings.HasSuffix(word, "x"):
+			if factor, err := strconv.ParseUint(strings.Trim(word, "x"), 10, 64); err == nil && factor >= 2 {
+				opts.Factor = factor
+			}
+		}
+	}
+	if sticker {
+		opts.Preset = "telegram-sticker"
+	} else if opts.Preset == "" && (opts.MaxSize == 0 || opts.MaxSize > telegramUploadLimit) {
+		opts.MaxSize = telegramUploadLimit
+	}
+
+	// Each user gets one file at a time, and waits a while between them, so no one user can hog the GPU
+	var user int64
+	if message.From != nil {
+		user = message.From.ID
+	}
+	if busy, wait := b.reserve(user); busy {
+		b.replyText(message, "Please wait for your last file to be finished before sending another.")
+		return
+	} else if wait > 0 {
+		b.replyText(message, fmt.Sprintf("Please wait %s before sending another file.", wait.Round(time.Second)))
+		return
+	}
+	defer b.release(user)
+
+	output, err := b.interpolate(opts, file)
+	if b.ctx.Err() != nil {
+		err = errors.New("The bot was stopped before it could finish.")
+	}
+
+	// The reply goes out even when the bot's stopping, so no one's left waiting
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err != nil {
+		b.logger.Printf("%d : %s", user, err)
+		b.replyTextWithin(ctx, message, "Couldn't interpolate that: "+err.Error())
+		return
+	}
+	defer os.RemoveAll(filepath.Dir(output))
+
+	// Outputs other than stickers are sent as documents, which Telegram leaves as they are, keeping their transparency
+	method, field := "sendDocument", "document"
+	if sticker {
+		method, field = "sendSticker", "sticker"
+	}
+	params := map[string]string{"chat_id": strconv.FormatInt(message.Chat.ID, 10), "reply_to_message_id": strconv.FormatInt(message.MessageID, 10)}
+	if err = b.upload(ctx, method, params, field, output); err != nil {
+		b.logger.Print("error sending output:\n  ", err)
+		b.replyTextWithin(ctx, message, "Couldn't send the result: "+err.Error())
+	}
+}
+
+func (b *telegramBot) reserve(user int64) (bool, time.Duration) {
+	// Marks `user` as having a file interpolated, if they may, or otherwise reports whether they already have one,
+	// or how long until they may send another.
+
+	b.usersMutex.Lock()
+	defer b.usersMutex.Unlock()
+	if b.busy[user] {
+		return true, 0
+	}
+	if wait := time.Until(b.nextAllowed[user]); wait > 0 {
+		return false, wait
+	}
+	b.busy[user] = true
+	return false, 0
+}
+
+func (b *telegramBot) release(user int64) {
+	// Marks `user`'s file as finished, starting their wait for the next.
+
+	b.usersMutex.Lock()
+	defer b.usersMutex.Unlock()
+	delete(b.busy, user)
+	b.nextAllowed[user] = time.Now().Add(b.userInterval)
+	for other, next := range b.nextAllowed {
+		if time.Now().After(next) {
+			delete(b.nextAllowed, other)
+		}
+	}
+}
+
+func (b *telegramBot) interpolate(opts rifewt.Options, file *telegramFile) (string, error) {
+	// Downloads `file` into a temporary directory, and interpolates it there with `opts`, returning the output's path.
+
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	var info struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := b.call(b.ctx, "getFile", url.Values{"file_id": {file.FileID}}, &info); err != nil {
+		return "", fmt.Errorf("error finding file:\n  %w", err)
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+	case <-b.ctx.Done():
+		return "", b.ctx.Err()
+	}
+	defer func() { <-b.slots }()
+
+	dir, err := os.MkdirTemp(opts.TempDir, "rifewt-telegram-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary directory:\n  %w", err)
+	}
+	name := file.FileName
+	if name == "" {
+		name = filepath.Base(info.FilePath)
+	}
+	opts.Source = filepath.Join(dir, "input"+strings.ToLower(filepath.Ext(info.FilePath)))
+	opts.Dest = filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))+"-Interpolated"+filepath.Ext(defaultOutputPath(name, opts, "")))
+	opts.TempDir = dir
+	if err = downloadFile(b.ctx, b.client, telegramAPI+"/file/bot"+b.token+"/"+info.FilePath, opts.Source, telegramDownloadLimit); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("error downloading file:\n  %w", b.redact(err))
+	}
+
+	ctx := b.ctx
+	if b.run.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.run.timeout)
+		defer cancel()
+	}
+	res, err := rifewt.Interpolate(ctx, opts)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("Timed out after %s.", b.run.timeout)
+		}
+		return "", err
+	}
+	b.logger.Printf("%s : %d frames -> %d frames", name, res.SourceFrames, res.OutputFrames)
+	return res.Dest, nil
+}
+
+func (b *telegramBot) replyText(message telegramMessage, text string) {
+	// Replies to `message` with `text`, logging any failure.
+
+	b.replyTextWithin(b.ctx, message, text)
+}
+
+func (b *telegramBot) replyTextWithin(ctx context.Context, message telegramMessage, text string) {
+	// Replies to `message` with `text` unless `ctx` is cancelled first, logging any failure.
+
+	text = truncateMessage(text, telegramMessageLimit)
+	params := url.Values{"chat_id": {strconv.FormatInt(message.Chat.ID, 10)}, "reply_to_message_id": {strconv.FormatInt(message.MessageID, 10)}, "text": {text}}
+	if err := b.call(ctx, "sendMessage", params, nil); err != nil {
+		b.logger.Print("error replying to message:\n  ", err)
+	}
+}
+
+func truncateMessage(text string, limit int) string {
+	// Shortens `text` to at most `limit` characters, ending it with "..." if any were cut, without splitting any.
+	// Characters are counted in UTF-16 code units, as chat services count them, so those beyond the Basic Multilingual Plane,
+	// such as most emoji, count as two.
+
+	length := 0
+	cut := -1
+	for i, r := range text {
+		units := 1
+		if r > 0xFFFF {
+			units = 2
+		}
+		if cut < 0 && length+units > limit-3 {
+			cut = i
+		}
+		if length += units; length > limit {
+			return text[:cut] + "..."
+		}
+	}
+	return text
+}
+
+func (b *telegramBot) call(ctx context.Context, method string, params url.Values, result any) error {
+	// Calls the Bot API's `method` with `params`, decoding its result into `result`, if it isn't nil.
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+"/bot"+b.token+"/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return b.redact(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.send(req, result)
+}
+
+func (b *telegramBot) upload(ctx context.Context, method string, params map[string]string, field, path string) error {
+	// Calls the Bot API's `method` with `params`, uploading the file at `path` as `field`.
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range params {
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	if err := attachFile(form, field, path); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+"/bot"+b.token+"/"+method, &body)
+	if err != nil {
+		return b.redact(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return b.send(req, nil)
+}
+
+func (b *telegramBot) send(req *http.Request, result any) error {
+	// Sends `req` to the Bot API, decoding its result into `result`, if it isn't nil, or returning its description of what went wrong.
+
+	// getUpdates waits up to 50 seconds for messages, longer than other calls are given
+	client := b.client
+	if strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		client = &http.Client{Timeout: 70 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return b.redact(err)
+	}
+	defer res.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 16<<20)).Decode(&reply); err != nil {
+		return fmt.Errorf("Telegram replied %s, unreadably: %w", res.Status, err)
+	}
+	if !reply.OK {
+		return fmt.Errorf("Telegram replied %s: %s", res.Status, reply.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(reply.Result, result)
+	}
+	return nil
+}
+
+func (b *telegramBot) redact(err error) error {
+	// Removes the bot's token from `err`, as the URLs of failed requests are part of their errors, and errors are logged.
+
+	if err == nil || !strings.Contains(err.Error(), b.token) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), b.token, "<token>"))
+}
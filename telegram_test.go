@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  string
+	}{
+		{"short", "error", 10, "error"},
+		{"at the limit", "0123456789", 10, "0123456789"},
+		{"over the limit", "0123456789a", 10, "0123456..."},
+		// é takes two bytes but is one character, so nothing is cut
+		{"multibyte within the limit", strings.Repeat("é", 10), 10, strings.Repeat("é", 10)},
+		{"multibyte over the limit", strings.Repeat("é", 11), 10, strings.Repeat("é", 7) + "..."},
+		// Emoji take two UTF-16 code units each, and aren't split
+		{"emoji", strings.Repeat("😀", 6), 10, strings.Repeat("😀", 3) + "..."},
+		{"emoji across the cut", "012345😀789", 10, "012345..."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := truncateMessage(test.text, test.limit)
+			if got != test.want {
+				t.Errorf("truncateMessage(%q, %d) = %q, want %q", test.text, test.limit, got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateMessage(%q, %d) split a character", test.text, test.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RifeWithTransparency/rifewt"
+)
+
+// watchExtensions are the kinds of file watch picks up: GIFs, APNGs, and WebPs.
+var watchExtensions = map[string]bool{".gif": true, ".png": true, ".apng": true, ".webp": true}
+
+// watchedFile is what a poll of the watched directory saw of a file, to tell when it's finished being written.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+func runWatch(args []string) {
+	// Interpolates each animation dropped into a directory, polling it for new files until interrupted.
+	// Polling needs no third-party dependency, unlike fsnotify, and sees files on network shares that don't send
+	// notifications, while a file would need checking over an interval to tell it's been written in full either way.
+
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	finishFlags := interpolationFlags(flags)
+	outDir := flags.String("out", "", "`directory` to save results in (default Interpolated within the watched directory)")
+	doneDir := flags.String("done", "", "`directory` to move sources to once interpolated (default Done within the watched directory)")
+	failedDir := flags.String("failed", "", "`directory` to move sources that fail to, beside a note of the error (default Failed within the watched directory)")
+	interval := flags.Duration("interval", 2*time.Second, "how often to look for new files; a file is picked up once it's gone unchanged for this long")
+	metricsAddress := flags.String("metrics", "", "`address` to serve Prometheus metrics on, at /metrics (default none)")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s watch [flags] dir\nflags may be given before or after the directory, and include those for interpolating\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	errorLogger := log.New(os.Stderr, "", 0)
+	if err := applyDefaults(flags, args); err != nil {
+		errorLogger.Fatal("error reading default options:\n  ", err)
+	}
+	args = parseArgs(flags, args)
+	if len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts, run := finishFlags()
+	if opts.Poster != "" || opts.Delays != nil {
+		errorLogger.Fatal("-poster and -delays can't be used with watch, as they apply to a single input")
+	}
+	if run.dryRun {
+		errorLogger.Fatal("-dry-run can't be used with watch, which moves each source aside once it's done")
+	}
+	if *interval <= 0 {
+		errorLogger.Fatal("polling interval must be positive")
+	}
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		errorLogger.Fatal("error recognizing watched directory:\n  ", err)
+	}
+	for _, childDir := range []*string{outDir, doneDir, failedDir} {
+		if *childDir == "" {
+			continue
+		}
+		if *childDir, err = filepath.Abs(*childDir); err != nil {
+			errorLogger.Fatal("error recognizing directory:\n  ", err)
+		}
+	}
+	if *outDir == "" {
+		*outDir = filepath.Join(dir, "Interpolated")
+	}
+	if *doneDir == "" {
+		*doneDir = filepath.Join(dir, "Done")
+	}
+	if *failedDir == "" {
+		*failedDir = filepath.Join(dir, "Failed")
+	}
+	for _, childDir := range []string{*outDir, *doneDir, *failedDir} {
+		// Results or sources put back in the watched directory would be picked up again
+		if childDir == dir {
+			errorLogger.Fatal("-out, -done, and -failed must be directories other than the one watched")
+		}
+		if err = os.MkdirAll(childDir, 0755); err != nil {
+			errorLogger.Fatal("error creating directory:\n  ", err)
+		}
+	}
+
+	ctx, stop := subcommandContext()
+	defer stop()
+	if *metricsAddress != "" {
+		run.metrics = newMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", run.metrics)
+		metricsServer := &http.Server{Addr: *metricsAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			_ = metricsServer.Close()
+		}()
+		go func() {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errorLogger.Fatal("error serving metrics:\n  ", err)
+			}
+		}()
+	}
+	errorLogger.Printf("watching %s, saving results to %s", dir, *outDir)
+
+	// Files are handed to workers once they've stopped changing, and forgotten once they've been moved out of the way
+	seen := make(map[string]watchedFile)
+	var busy sync.Map
+	var wg sync.WaitGroup
+	inputSlots := make(chan struct{}, run.jobs)
+	for ctx.Err() == nil {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errorLogger.Print("error reading watched directory:\n  ", err)
+		}
+		current := make(map[string]watchedFile)
+		for _, entry := range entries {
+			// Hidden files include those assemblers are still writing before renaming them into place
+			name := entry.Name()
+			if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || !watchExtensions[strings.ToLower(filepath.Ext(name))] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			state := watchedFile{info.Size(), info.ModTime()}
+			current[path] = state
+			if previous, ok := seen[path]; !ok || previous != state {
+				continue
+			}
+			if _, running := busy.LoadOrStore(path, true); running {
+				continue
+			}
+
+			// Each file waits here for a slot, so watch only ever has one queued
+			queued := time.Now()
+			run.metrics.enqueue()
+			inputSlots <- struct{}{}
+			run.metrics.start(time.Since(queued))
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				defer func() { <-inputSlots }()
+				defer busy.Delete(path)
+				watchFile(ctx, path, *outDir, *doneDir, *failedDir, opts, run, errorLogger)
+			}(path)
+		}
+		seen = current
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(*interval):
+		}
+	}
+
+	wg.Wait()
+	errorLogger.Print("interrupted")
+	os.Exit(exitInterrupted)
+}
+
+func watchFile(ctx context.Context, path, outDir, doneDir, failedDir string, opts rifewt.Options, run runSettings, errorLogger *log.Logger) {
+	// Interpolates the file at `path` into `outDir`, then moves it into `doneDir`, or if that fails, into `failedDir`,
+	// beside a note of the error. Files being interpolated when `ctx` is cancelled are left where they are.
+
+	input := path
+	output := ""
+	if run.template == "" {
+		output = filepath.Join(outDir, filepath.Base(defaultOutputPath(path, opts, run.suffix)))
+	}
+
+	err := interpolateFile(ctx, path, output, opts, run)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		if _, err = moveAside(path, doneDir); err != nil {
+			errorLogger.Printf("%s : error moving source aside:\n  %s", input, err)
+		}
+		return
+	}
+
+	errorLogger.Printf("%s : %s", input, err)
+	moved, moveErr := moveAside(path, failedDir)
+	if moveErr != nil {
+		errorLogger.Printf("%s : error moving failed source aside:\n  %s", input, moveErr)
+		return
+	}
+	note := fmt.Sprintf("%s\n\nexit status %d\n", err, failureStatus(err))
+	if writeErr := os.WriteFile(moved+".error.txt", []byte(note), 0644); writeErr != nil {
+		errorLogger.Printf("%s : error noting failure:\n  %s", input, writeErr)
+	}
+}
+
+func moveAside(path, dir string) (string, error) {
+	// Moves the file at `path` into `dir`, numbering it if a file of the same name is already there,
+	// and returns its new path.
+
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(filepath.Base(path), ext)
+	dest := filepath.Join(dir, stem+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dest); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		dest = filepath.Join(dir, stem+"-"+strconv.Itoa(i)+ext)
+	}
+	return dest, os.Rename(path, dest)
+}